@@ -10,8 +10,8 @@ import (
 	"strings"
 
 	"github.com/davecgh/go-spew/spew"
+	"github.com/rcleveng/assistant/server/llm/kernel"
 	"github.com/spf13/cobra"
-	pb "google.golang.org/api/chat/v1"
 )
 
 var rootCmd = &cobra.Command{
@@ -26,22 +26,26 @@ var rootCmd = &cobra.Command{
 var (
 	debugChatURL string
 	verbose      bool
+	sessionId    string
 )
 
 func init() {
 	rootCmd.PersistentFlags().StringVar(&debugChatURL, "url", "http://localhost:8080/chat/basic", "http endpoint to the debug chat server")
 	rootCmd.PersistentFlags().BoolVar(&verbose, "verbose", false, "be verbose")
+	rootCmd.PersistentFlags().StringVar(&sessionId, "session", "", "session id to continue, defaults to one per user")
 }
 
 type BasicChat struct {
-	Name string `json:"name,omitempty"`
-	Text string `json:"text,omitempty"`
+	Name    string `json:"name,omitempty"`
+	Text    string `json:"text,omitempty"`
+	Session string `json:"session,omitempty"`
 }
 
 func chat(text []string) error {
 	b, err := json.Marshal(BasicChat{
-		Name: os.Getenv("LOGNAME"),
-		Text: strings.Join(text, "\n"),
+		Name:    os.Getenv("LOGNAME"),
+		Text:    strings.Join(text, "\n"),
+		Session: sessionId,
 	})
 	if err != nil {
 		return err
@@ -63,7 +67,7 @@ func chat(text []string) error {
 		return err
 	}
 
-	chatResp := &pb.Message{}
+	chatResp := &kernel.Response{}
 	json.Unmarshal(jsonbytes, chatResp)
 
 	if verbose {
@@ -72,6 +76,10 @@ func chat(text []string) error {
 	}
 
 	fmt.Println(chatResp.Text)
+	if len(chatResp.Citations) > 0 {
+		fmt.Println("\nSources:")
+		fmt.Println(kernel.FormatCitations(chatResp.Citations))
+	}
 
 	return nil
 }
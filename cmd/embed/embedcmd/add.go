@@ -2,6 +2,7 @@ package embedcmd
 
 import (
 	"context"
+	"errors"
 	"fmt"
 
 	"github.com/davecgh/go-spew/spew"
@@ -30,16 +31,20 @@ var addCmd = &cobra.Command{
 	},
 }
 
-var author int64
+var (
+	addAuthor int64
+	addScope  string
+)
 
 func init() {
 	RootCmd.AddCommand(addCmd)
-	addCmd.LocalFlags().Int64Var(&author, "author", 0, "sets the author's email address ")
+	addCmd.Flags().Int64Var(&addAuthor, "author", 0, "sets the author of the text")
+	addCmd.Flags().StringVar(&addScope, "scope", string(db.GlobalScope), "who can see the text: global, channel:<id> or user:<id>")
 }
 
 func add(env *env.Environment, text []string) error {
 	ctx := context.Background()
-	llm, err := palm.NewPalmLLMClient(ctx, env)
+	llm, err := palm.NewClientForEnvironment(ctx, env)
 	if err != nil {
 		return err
 	}
@@ -52,8 +57,8 @@ func add(env *env.Environment, text []string) error {
 	var edb db.EmbeddingsDB
 
 	if UseDatabase {
-		fmt.Println("Using postgresql database")
-		edb, err = db.NewPostgresDatabase(env)
+		fmt.Printf("Using %s database\n", db.Backend(env))
+		edb, err = db.NewEmbeddingsDB(ctx, env)
 		if err != nil {
 			return err
 		}
@@ -63,7 +68,7 @@ func add(env *env.Environment, text []string) error {
 	}
 	defer edb.Close()
 
-	if err = embedAndAdd(ctx, splitter, llm, edb, text); err != nil {
+	if err = embedAndAdd(ctx, splitter, llm, edb, addAuthor, db.Scope(addScope), text); err != nil {
 		return err
 	}
 
@@ -74,7 +79,7 @@ type Splitter interface {
 	SplitText(text string) ([]string, error)
 }
 
-func embedAndAdd(ctx context.Context, splitter Splitter, lm llm.LlmClient, db db.EmbeddingsDB, texts []string) error {
+func embedAndAdd(ctx context.Context, splitter Splitter, lm llm.LlmClient, db db.EmbeddingsDB, author int64, scope db.Scope, texts []string) error {
 	splits := make([]string, 0, len(texts))
 	for _, text := range texts {
 		cursplits, err := splitter.SplitText(text)
@@ -84,25 +89,36 @@ func embedAndAdd(ctx context.Context, splitter Splitter, lm llm.LlmClient, db db
 		splits = append(splits, cursplits...)
 	}
 
-	resp, err := lm.BatchEmbedText(ctx, splits)
-	if err != nil {
-		fmt.Printf("ERROR: %v\n\n", err)
+	// Splits that couldn't be embedded are reported, the rest are still added.
+	embeddings, err := lm.BatchEmbedText(ctx, splits, llm.DocumentEmbedding(""))
+	var batchErr *llm.BatchError
+	if err != nil && !errors.As(err, &batchErr) {
+		return err
+	}
+	if len(embeddings) != len(splits) {
+		return fmt.Errorf("expected %d embeddings, got %d", len(splits), len(embeddings))
 	}
 
-	glog.V(2).Info(spew.Sdump(resp))
-
-	for i, e := range resp {
-		author := int64(0)
-		if i < len(splits) {
+	glog.V(2).Info(spew.Sdump(embeddings))
 
-			glog.V(1).Infof("Embedding: [%d] [%#v] '%s']\n", i, e, splits[i])
-			if _, err := db.Add(author, splits[i], e); err != nil {
-				return err
+	added := 0
+	for i, e := range embeddings {
+		if e == nil {
+			reason := errors.New("no embedding returned")
+			if batchErr != nil && batchErr.Errors[i] != nil {
+				reason = batchErr.Errors[i]
 			}
-		} else {
-			fmt.Printf("past end of splits with i=%d\n", i)
-			fmt.Printf("Past Split Embedding: [%d] [%#v]]\n", i, e)
+			fmt.Printf("Unable to embed split %d: %v\n", i, reason)
+			continue
+		}
+		glog.V(1).Infof("Embedding: [%d] [%#v] '%s']\n", i, e, splits[i])
+		if _, err := db.Add(ctx, author, "", scope, splits[i], e); err != nil {
+			return err
 		}
+		added++
+	}
+	if added < len(splits) {
+		return errors.Join(fmt.Errorf("added %d of %d splits", added, len(splits)), err)
 	}
 	return nil
 }
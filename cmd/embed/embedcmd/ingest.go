@@ -0,0 +1,98 @@
+package embedcmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rcleveng/assistant/server/db"
+	"github.com/rcleveng/assistant/server/env"
+	"github.com/rcleveng/assistant/server/ingest"
+	"github.com/rcleveng/assistant/server/llm/palm"
+	"github.com/spf13/cobra"
+	"github.com/tmc/langchaingo/textsplitter"
+)
+
+var ingestCmd = &cobra.Command{
+	Use:   "ingest <path|glob|dir>...",
+	Short: "Add Markdown, text, HTML and JSONL files, skipping unchanged ones",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		env, err := env.NewEnvironmentForPlatform(env.COMMANDLINE)
+		if err != nil {
+			return err
+		}
+		return ingestFiles(env, args)
+	},
+}
+
+var (
+	ingestAuthor int64
+	ingestScope  string
+)
+
+func init() {
+	RootCmd.AddCommand(ingestCmd)
+	ingestCmd.Flags().Int64Var(&ingestAuthor, "author", 0, "sets the author of the documents")
+	ingestCmd.Flags().StringVar(&ingestScope, "scope", string(db.GlobalScope), "who can see the documents: global, channel:<id> or user:<id>")
+}
+
+// Returns the splitter used for documents.
+func newSplitter() textsplitter.RecursiveCharacter {
+	splitter := textsplitter.NewRecursiveCharacter()
+	splitter.ChunkOverlap = 20
+	splitter.ChunkSize = 1000
+	return splitter
+}
+
+// Opens the database selected by the environment, which must be able to
+// store documents.
+func openDocumentsDB(ctx context.Context, env *env.Environment) (db.DocumentsDB, error) {
+	edb, err := db.NewEmbeddingsDB(ctx, env)
+	if err != nil {
+		return nil, err
+	}
+	docs, ok := edb.(db.DocumentsDB)
+	if !ok {
+		edb.Close()
+		return nil, fmt.Errorf("the %s backend can't store documents", db.Backend(env))
+	}
+	return docs, nil
+}
+
+func ingestFiles(env *env.Environment, args []string) error {
+	ctx := context.Background()
+	llm, err := palm.NewClientForEnvironment(ctx, env)
+	if err != nil {
+		return err
+	}
+	defer llm.Close()
+
+	docs, err := openDocumentsDB(ctx, env)
+	if err != nil {
+		return err
+	}
+	defer docs.Close()
+
+	ingester := ingest.NewIngester(llm, docs, newSplitter())
+	ingester.Author = ingestAuthor
+	ingester.Scope = db.Scope(ingestScope)
+
+	for _, arg := range args {
+		paths, err := ingest.Expand(arg)
+		if err != nil {
+			return err
+		}
+		for _, path := range paths {
+			result, err := ingester.Ingest(ctx, path)
+			if err != nil {
+				return err
+			}
+			if result.Skipped {
+				fmt.Println("Unchanged:", path)
+			} else {
+				fmt.Printf("Ingested: %s (%d chunks)\n", path, result.Chunks)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package embedcmd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/rcleveng/assistant/server/db"
+	"github.com/rcleveng/assistant/server/env"
+	"github.com/spf13/cobra"
+)
+
+var listCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "List stored embeddings",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		env, err := env.NewEnvironmentForPlatform(env.COMMANDLINE)
+		if err != nil {
+			return err
+		}
+		return list(env)
+	},
+}
+
+var (
+	listLimit  int
+	listAfter  int64
+	listScopes []string
+)
+
+func init() {
+	RootCmd.AddCommand(listCmd)
+	listCmd.Flags().IntVar(&listLimit, "limit", 20, "number of embeddings to list, 0 lists all")
+	listCmd.Flags().Int64Var(&listAfter, "after", 0, "only list ids after this one, for the next page")
+	listCmd.Flags().StringSliceVar(&listScopes, "scope", nil, "only list these scopes, e.g. global,user:slack:U123 (default all)")
+}
+
+// Longest content shown for each embedding.
+const maxListContent = 80
+
+func list(env *env.Environment) error {
+	ctx := context.Background()
+	edb, err := db.NewEmbeddingsDB(ctx, env)
+	if err != nil {
+		return err
+	}
+	defer edb.Close()
+
+	var scopes []db.Scope
+	for _, s := range listScopes {
+		scopes = append(scopes, db.Scope(s))
+	}
+	memories, err := edb.List(ctx, db.ListOptions{AfterID: listAfter, Limit: listLimit, Scopes: scopes})
+	if err != nil {
+		return err
+	}
+	if len(memories) == 0 {
+		fmt.Println("no embeddings")
+		return nil
+	}
+
+	for _, m := range memories {
+		content := strings.Join(strings.Fields(m.Content), " ")
+		if len(content) > maxListContent {
+			content = content[:maxListContent-3] + "..."
+		}
+		fmt.Printf("%d\t%s\t%s\t%s\n", m.ID, m.Created.Format("2006-01-02"), m.Scope, content)
+	}
+	if listLimit > 0 && len(memories) == listLimit {
+		fmt.Printf("next page: --after %d\n", memories[len(memories)-1].ID)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package embedcmd
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rcleveng/assistant/server/db"
+	"github.com/rcleveng/assistant/server/db/migrations"
+	"github.com/rcleveng/assistant/server/env"
+	"github.com/spf13/cobra"
+)
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Manage the database schema",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return fmt.Errorf("need command: up, down or status")
+	},
+}
+
+var migrateUpCmd = &cobra.Command{
+	Use:   "up",
+	Short: "Apply all outstanding migrations",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return migrate(func(ctx context.Context, m *migrations.Migrator) error {
+			done, err := m.Up(ctx)
+			for _, d := range done {
+				fmt.Printf("applied %04d_%s\n", d.Version, d.Name)
+			}
+			if err == nil && len(done) == 0 {
+				fmt.Println("already up to date")
+			}
+			return err
+		})
+	},
+}
+
+var downSteps int
+
+var migrateDownCmd = &cobra.Command{
+	Use:   "down",
+	Short: "Revert the most recent migrations",
+	Long: `Revert the most recent migrations.
+
+The first postgres migration can't be reverted, it adopts the embeddings
+table of databases created before migrations existed and reverting it would
+drop every stored memory.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return migrate(func(ctx context.Context, m *migrations.Migrator) error {
+			done, err := m.Down(ctx, downSteps)
+			for _, d := range done {
+				fmt.Printf("reverted %04d_%s\n", d.Version, d.Name)
+			}
+			return err
+		})
+	},
+}
+
+var migrateStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "List migrations and whether they have been applied",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return migrate(func(ctx context.Context, m *migrations.Migrator) error {
+			status, err := m.Status(ctx)
+			if err != nil {
+				return err
+			}
+			for _, s := range status {
+				applied := "pending"
+				if s.Applied {
+					applied = "applied " + s.AppliedAt.Format(time.RFC3339)
+				}
+				fmt.Printf("%04d_%s\t%s\n", s.Version, s.Name, applied)
+			}
+			return nil
+		})
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(migrateCmd)
+	migrateCmd.AddCommand(migrateUpCmd, migrateDownCmd, migrateStatusCmd)
+	migrateDownCmd.Flags().IntVar(&downSteps, "steps", 1, "number of migrations to revert")
+}
+
+func migrate(run func(ctx context.Context, m *migrations.Migrator) error) error {
+	env, err := env.NewEnvironmentForPlatform(env.COMMANDLINE)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	migrator, close, err := db.NewMigrator(ctx, env)
+	if err != nil {
+		return err
+	}
+	defer close()
+	return run(ctx, migrator)
+}
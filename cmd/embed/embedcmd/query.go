@@ -6,6 +6,7 @@ import (
 
 	"github.com/rcleveng/assistant/server/db"
 	"github.com/rcleveng/assistant/server/env"
+	"github.com/rcleveng/assistant/server/llm"
 	"github.com/rcleveng/assistant/server/llm/palm"
 	"github.com/spf13/cobra"
 )
@@ -30,36 +31,59 @@ var queryCmd = &cobra.Command{
 }
 
 var (
-	count int
+	count          int
+	queryScopes    []string
+	minSimilarity  float32
+	queryMode      string
+	queryDiversity float32
 )
 
 func init() {
 	RootCmd.AddCommand(queryCmd)
-	queryCmd.LocalFlags().IntVar(&count, "count", 1, "number of closest matches to find")
+	queryCmd.Flags().IntVar(&count, "count", 1, "number of closest matches to find")
+	queryCmd.Flags().Float32Var(&minSimilarity, "min_similarity", 0, "drop matches with a lower cosine similarity")
+	queryCmd.Flags().StringSliceVar(&queryScopes, "scope", nil, "only search these scopes, e.g. global,user:slack:U123 (default all)")
+	queryCmd.Flags().StringVar(&queryMode, "mode", string(db.VectorSearch), "vector, or hybrid to also match the words of the query")
+	queryCmd.Flags().Float32Var(&queryDiversity, "diversity", 0, "between 0 and 1, how much to prefer matches unlike earlier ones (MMR)")
 }
 
 func query(env *env.Environment, text string) error {
+	mode, err := db.ParseSearchMode(queryMode)
+	if err != nil {
+		return err
+	}
 	ctx := context.Background()
-	llm, err := palm.NewPalmLLMClient(ctx, env)
+	lm, err := palm.NewPalmLLMClient(ctx, env)
 	if err != nil {
 		return err
 	}
-	defer llm.Close()
+	defer lm.Close()
 
-	embeddings, err := llm.EmbedText(ctx, text)
+	embeddings, err := lm.EmbedText(ctx, text, llm.QueryEmbedding())
 	if err != nil {
 		return err
 	}
 
 	var edb db.EmbeddingsDB
 
-	edb, err = db.NewPostgresDatabase(env)
+	edb, err = db.NewEmbeddingsDB(ctx, env)
 	if err != nil {
 		return err
 	}
 	defer edb.Close()
 
-	matches, err := edb.Find(embeddings, count)
+	var scopes []db.Scope
+	for _, s := range queryScopes {
+		scopes = append(scopes, db.Scope(s))
+	}
+	matches, err := edb.Find(ctx, embeddings, db.FindOptions{
+		Count:         count,
+		MinSimilarity: minSimilarity,
+		Scopes:        scopes,
+		Mode:          mode,
+		Query:         text,
+		Diversity:     queryDiversity,
+	})
 	if err != nil {
 		return err
 	}
@@ -70,7 +94,10 @@ func query(env *env.Environment, text string) error {
 	}
 
 	for _, m := range matches {
-		fmt.Println("Match:", m)
+		fmt.Printf("Match: [%d] %.3f %s\n", m.ID, m.Similarity, m.Content)
+		if m.Source != "" {
+			fmt.Printf("  from %s (chunk %d)\n", m.Source, m.Chunk)
+		}
 	}
 
 	return nil
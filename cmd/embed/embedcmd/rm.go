@@ -1,24 +1,54 @@
 package embedcmd
 
 import (
+	"context"
 	"fmt"
+	"strconv"
 
+	"github.com/rcleveng/assistant/server/db"
+	"github.com/rcleveng/assistant/server/env"
 	"github.com/spf13/cobra"
 )
 
 var removeCmd = &cobra.Command{
-	Use:   "rm",
+	Use:   "rm <id>...",
 	Short: "remove an embedding",
+	Args:  cobra.MinimumNArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
-		// env, err := env.NewEnvironment(env.COMMANDLINE)
-		// if err != nil {
-		// 	return err
-		// }
+		env, err := env.NewEnvironmentForPlatform(env.COMMANDLINE)
+		if err != nil {
+			return err
+		}
 
-		return fmt.Errorf("implement me")
+		ids := make([]int64, 0, len(args))
+		for _, arg := range args {
+			id, err := strconv.ParseInt(arg, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid id '%s'", arg)
+			}
+			ids = append(ids, id)
+		}
+		return remove(env, ids)
 	},
 }
 
 func init() {
 	RootCmd.AddCommand(removeCmd)
 }
+
+func remove(env *env.Environment, ids []int64) error {
+	ctx := context.Background()
+	edb, err := db.NewEmbeddingsDB(ctx, env)
+	if err != nil {
+		return err
+	}
+	defer edb.Close()
+
+	for _, id := range ids {
+		if err := edb.Delete(ctx, id); err != nil {
+			return fmt.Errorf("unable to remove %d: %w", id, err)
+		}
+		fmt.Println("Removed:", id)
+	}
+	return nil
+}
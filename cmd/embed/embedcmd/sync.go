@@ -0,0 +1,93 @@
+package embedcmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/rcleveng/assistant/server/db"
+	"github.com/rcleveng/assistant/server/env"
+	"github.com/rcleveng/assistant/server/ingest"
+	"github.com/rcleveng/assistant/server/llm/palm"
+	"github.com/spf13/cobra"
+)
+
+var syncCmd = &cobra.Command{
+	Use:   "sync <dir>",
+	Short: "Ingest new and changed files in a directory and remove deleted ones",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		env, err := env.NewEnvironmentForPlatform(env.COMMANDLINE)
+		if err != nil {
+			return err
+		}
+		return syncDir(env, args[0])
+	},
+}
+
+var (
+	syncAuthor   int64
+	syncScope    string
+	syncWatch    bool
+	syncDebounce time.Duration
+)
+
+func init() {
+	RootCmd.AddCommand(syncCmd)
+	syncCmd.Flags().Int64Var(&syncAuthor, "author", 0, "sets the author of the documents")
+	syncCmd.Flags().StringVar(&syncScope, "scope", string(db.GlobalScope), "who can see the documents: global, channel:<id> or user:<id>")
+	syncCmd.Flags().BoolVarP(&syncWatch, "watch", "w", false, "keep running and sync whenever files change")
+	syncCmd.Flags().DurationVar(&syncDebounce, "debounce", time.Second, "with --watch, how long files must be unchanged before syncing")
+}
+
+func printSync(result *ingest.SyncResult, err error) {
+	if result != nil {
+		for _, f := range result.Files {
+			if !f.Skipped {
+				fmt.Printf("Ingested: %s (%d chunks, %d embedded)\n", f.Path, f.Chunks, f.Embedded)
+			}
+		}
+		for _, uri := range result.Removed {
+			fmt.Println("Removed:", uri)
+		}
+		fmt.Printf("Synced %d files, %d changed, %d removed\n", len(result.Files), result.Changed(), len(result.Removed))
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+	}
+}
+
+func syncDir(env *env.Environment, dir string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	llm, err := palm.NewClientForEnvironment(ctx, env)
+	if err != nil {
+		return err
+	}
+	defer llm.Close()
+
+	docs, err := openDocumentsDB(ctx, env)
+	if err != nil {
+		return err
+	}
+	defer docs.Close()
+
+	ingester := ingest.NewIngester(llm, docs, newSplitter())
+	ingester.Author = syncAuthor
+	ingester.Scope = db.Scope(syncScope)
+
+	if syncWatch {
+		fmt.Printf("Watching %s, press Ctrl-C to stop\n", dir)
+		return ingester.Watch(ctx, dir, syncDebounce, printSync)
+	}
+	result, err := ingester.Sync(ctx, dir)
+	if err != nil {
+		return err
+	}
+	printSync(result, nil)
+	return nil
+}
@@ -0,0 +1,61 @@
+package embedcmd
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/rcleveng/assistant/server/db"
+	"github.com/rcleveng/assistant/server/env"
+	"github.com/rcleveng/assistant/server/llm"
+	"github.com/rcleveng/assistant/server/llm/palm"
+	"github.com/spf13/cobra"
+)
+
+var updateCmd = &cobra.Command{
+	Use:   "update <id> <text>",
+	Short: "Replace the text of an embedding and embed it again",
+	Args:  cobra.MinimumNArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		env, err := env.NewEnvironmentForPlatform(env.COMMANDLINE)
+		if err != nil {
+			return err
+		}
+		id, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid id '%s'", args[0])
+		}
+		return update(env, id, strings.Join(args[1:], " "))
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(updateCmd)
+}
+
+func update(env *env.Environment, id int64, text string) error {
+	ctx := context.Background()
+	lm, err := palm.NewPalmLLMClient(ctx, env)
+	if err != nil {
+		return err
+	}
+	defer lm.Close()
+
+	embeddings, err := lm.EmbedText(ctx, text, llm.DocumentEmbedding(""))
+	if err != nil {
+		return err
+	}
+
+	edb, err := db.NewEmbeddingsDB(ctx, env)
+	if err != nil {
+		return err
+	}
+	defer edb.Close()
+
+	if err := edb.Update(ctx, id, text, embeddings); err != nil {
+		return fmt.Errorf("unable to update %d: %w", id, err)
+	}
+	fmt.Println("Updated:", id)
+	return nil
+}
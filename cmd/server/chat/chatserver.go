@@ -4,20 +4,21 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"html"
 	"log/slog"
 	"net/http"
 	"net/http/httputil"
+	"net/url"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/coreos/go-oidc/v3/oidc"
 	"github.com/davecgh/go-spew/spew"
 	"github.com/rcleveng/assistant/server"
-	"github.com/rcleveng/assistant/server/db"
 	"github.com/rcleveng/assistant/server/env"
-	"github.com/rcleveng/assistant/server/llm"
 	"github.com/rcleveng/assistant/server/llm/kernel"
-	"github.com/rcleveng/assistant/server/llm/palm"
+	"github.com/rcleveng/assistant/server/session"
 
 	pb "google.golang.org/api/chat/v1"
 )
@@ -28,13 +29,11 @@ const jwtURL = "https://www.googleapis.com/service_accounts/v1/jwk/"
 
 type ChatHandler struct {
 	verifier  *oidc.IDTokenVerifier
-	llm       llm.LlmClient
-	db        db.EmbeddingsDB
 	projectID string
 	kernel    kernel.Kernel
 }
 
-func NewChatHandler(ctx context.Context, environment *env.Environment) (*ChatHandler, error) {
+func NewChatHandler(ctx context.Context, environment *env.Environment, kernel kernel.Kernel) (*ChatHandler, error) {
 	// TODO: query the metadata server if we're on cloud run.
 	projectID := os.Getenv("GOOGLE_CLOUD_PROJECT")
 	if projectID == "" {
@@ -50,28 +49,11 @@ func NewChatHandler(ctx context.Context, environment *env.Environment) (*ChatHan
 	ks := oidc.NewRemoteKeySet(ctx, jwtURL+chatIssuer)
 	verifier := oidc.NewVerifier(chatIssuer, ks, config)
 
-	kernel, err := kernel.NewHandRolledKernel(ctx, environment)
-	if err != nil {
-		return nil, err
-	}
-
-	llm, err := palm.NewPalmLLMClient(ctx, environment)
-	if err != nil {
-		return nil, err
-	}
-
-	edb, err := db.NewPostgresDatabase(environment)
-	if err != nil {
-		return nil, err
-	}
-
 	return &ChatHandler{
 		verifier:  verifier,
-		llm:       llm,
-		db:        edb,
 		projectID: projectID,
 		kernel:    kernel,
-	}, err
+	}, nil
 }
 
 // Validate the Chat Token
@@ -104,14 +86,27 @@ func (handler *ChatHandler) validateChatToken(context context.Context, tokenStri
 
 // CHAT
 
-func CreateResponseCard(cardId, sessionId, text, uri string) (*pb.Message, error) {
-	button := pb.GoogleAppsCardV1Button{
-		Text: "Learn More",
-		OnClick: &pb.GoogleAppsCardV1OnClick{
-			OpenLink: &pb.GoogleAppsCardV1OpenLink{
-				Url: uri + "/chat/action/12344",
-			},
-		},
+// Subtitles for replies from tools other than ANSWER.
+var actionSubtitles = map[string]string{
+	"REMEMBER": "Saved to memory",
+	"FORGET":   "Removed from memory",
+	"CALENDAR": "From your calendar",
+}
+
+// Creates the reply card, cited sources are listed under the text and Learn
+// More opens the first one that has a link.
+func CreateResponseCard(cardId, sessionId string, resp *kernel.Response, uri string) (*pb.Message, error) {
+	buttons := make([]*pb.GoogleAppsCardV1Button, 0, 3)
+	for _, c := range resp.Citations {
+		if link := c.Link(); link != "" {
+			buttons = append(buttons, &pb.GoogleAppsCardV1Button{
+				Text: "Learn More",
+				OnClick: &pb.GoogleAppsCardV1OnClick{
+					OpenLink: &pb.GoogleAppsCardV1OpenLink{Url: link},
+				},
+			})
+			break
+		}
 	}
 	// <a href="https://www.flaticon.com/free-icons/thumbs-down" title="thumbs down icons">Thumbs down icons created by Freepik - Flaticon</a>
 
@@ -124,7 +119,7 @@ func CreateResponseCard(cardId, sessionId, text, uri string) (*pb.Message, error
 		//Text: "Thumbs Up",
 		OnClick: &pb.GoogleAppsCardV1OnClick{
 			OpenLink: &pb.GoogleAppsCardV1OpenLink{
-				Url: fmt.Sprintf("%s/feedback/up/%s", uri, sessionId),
+				Url: feedbackURL(uri, "up", sessionId, resp.TraceID),
 			},
 		},
 	}
@@ -137,38 +132,76 @@ func CreateResponseCard(cardId, sessionId, text, uri string) (*pb.Message, error
 		},
 		OnClick: &pb.GoogleAppsCardV1OnClick{
 			OpenLink: &pb.GoogleAppsCardV1OpenLink{
-				Url: fmt.Sprintf("%s/feedback/down/%s", uri, sessionId),
+				Url: feedbackURL(uri, "down", sessionId, resp.TraceID),
+			},
+		},
+	}
+	buttons = append(buttons, &thumbsUpButton, &thumbsDownButton)
+
+	widgets := []*pb.GoogleAppsCardV1Widget{{
+		TextParagraph: &pb.GoogleAppsCardV1TextParagraph{
+			Text: resp.Text,
+		},
+	}}
+	if len(resp.Citations) > 0 {
+		widgets = append(widgets, &pb.GoogleAppsCardV1Widget{
+			TextParagraph: &pb.GoogleAppsCardV1TextParagraph{
+				Text: "<b>Sources</b>\n" + citationsText(resp.Citations),
 			},
+		})
+	}
+	widgets = append(widgets, &pb.GoogleAppsCardV1Widget{
+		ButtonList: &pb.GoogleAppsCardV1ButtonList{
+			Buttons: buttons,
 		},
+	})
+
+	subtitle := "Created with the Robsite Assistant"
+	if s, found := actionSubtitles[resp.Action]; found {
+		subtitle = s
 	}
+
 	card := &pb.CardWithId{
 		Card: &pb.GoogleAppsCardV1Card{
 			Header: &pb.GoogleAppsCardV1CardHeader{
 				ImageType: "CIRCLE",
 				ImageUrl:  "https://developers.google.com/chat/images/chat-product-icon.png",
-				Subtitle:  "Created with the Robsite Assistant",
+				Subtitle:  subtitle,
 				Title:     "Robsite Assistant Reply",
 			},
 			Sections: []*pb.GoogleAppsCardV1Section{{
-				Widgets: []*pb.GoogleAppsCardV1Widget{{
-					TextParagraph: &pb.GoogleAppsCardV1TextParagraph{
-						Text: text,
-					},
-				}, {
-					ButtonList: &pb.GoogleAppsCardV1ButtonList{
-						Buttons: []*pb.GoogleAppsCardV1Button{
-							&button, &thumbsUpButton, &thumbsDownButton},
-					},
-				}},
+				Widgets: widgets,
 			}},
 		},
 		CardId: cardId,
 	}
 
-	resp := &pb.Message{
+	return &pb.Message{
 		CardsV2: []*pb.CardWithId{card},
+	}, nil
+}
+
+// Returns the link for feedback on a reply, the trace ties it to the reply's
+// steps in the logs.
+func feedbackURL(uri, kind, sessionId, traceId string) string {
+	u := fmt.Sprintf("%s/feedback/%s/%s", uri, kind, sessionId)
+	if traceId != "" {
+		u += "?trace=" + url.QueryEscape(traceId)
 	}
-	return resp, nil
+	return u
+}
+
+// Returns a line for each citation, linked when the source has a link.
+func citationsText(citations []kernel.Citation) string {
+	lines := make([]string, len(citations))
+	for i, c := range citations {
+		label := html.EscapeString(c.Label())
+		if link := c.Link(); link != "" {
+			label = fmt.Sprintf(`<a href="%s">%s</a>`, html.EscapeString(link), label)
+		}
+		lines[i] = fmt.Sprintf("[%d] %s", c.Number, label)
+	}
+	return strings.Join(lines, "\n")
 }
 
 func (handler *ChatHandler) DebugCard(w http.ResponseWriter, r *http.Request) {
@@ -184,7 +217,7 @@ func (handler *ChatHandler) DebugCard(w http.ResponseWriter, r *http.Request) {
 	if text == "" {
 		text = "This is a test"
 	}
-	resp, err := CreateResponseCard("TestCard", sessionId, text, uri)
+	resp, err := CreateResponseCard("TestCard", sessionId, &kernel.Response{Text: text}, uri)
 	if err != nil {
 		resp = &pb.Message{
 			Text: "Error creating Card",
@@ -196,8 +229,27 @@ func (handler *ChatHandler) DebugCard(w http.ResponseWriter, r *http.Request) {
 type BasicChat struct {
 	Name string `json:"name,omitempty"`
 	Text string `json:"text,omitempty"`
+	// Optional session id, defaults to one session per name.  Only the
+	// name's own sessions, basic:NAME or basic:NAME:ANYTHING, are accepted so
+	// callers can't join a Chat or Slack conversation.
+	Session string `json:"session,omitempty"`
 }
 
+// Returns the session for a basic chat, or an error if the requested one
+// doesn't belong to the name.
+func basicSessionID(req *BasicChat) (string, error) {
+	own := session.BasicSessionID(req.Name)
+	if req.Session == "" {
+		return own, nil
+	}
+	if req.Session != own && !strings.HasPrefix(req.Session, own+":") {
+		return "", fmt.Errorf("session '%s' does not belong to '%s'", req.Session, req.Name)
+	}
+	return req.Session, nil
+}
+
+// Chats as the name in the request.  Names aren't authenticated so the
+// server only routes here outside of Cloud Run, for local development.
 func (handler *ChatHandler) HandleChatBasic(w http.ResponseWriter, r *http.Request) {
 	uri := server.GetPublicEndpoint(r)
 	slog.Info("HandleChatBasic URI: " + uri)
@@ -206,8 +258,16 @@ func (handler *ChatHandler) HandleChatBasic(w http.ResponseWriter, r *http.Reque
 	json.NewDecoder(r.Body).Decode(&req)
 	slog.Info(fmt.Sprint("Decoded Message: ", spew.Sdump(req)))
 
-	sessionId := "0"
-	text, err := handler.kernel.Chat(r.Context(), req.Name, sessionId, req.Text)
+	if req.Name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	sessionId, err := basicSessionID(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp, err := handler.kernel.Chat(r.Context(), kernel.BasicSpeaker(req.Name), sessionId, req.Text)
 	if err != nil {
 		slog.Error("Error: ", "error", err)
 		server.EncodeAndLogResponse(&pb.Message{
@@ -216,9 +276,8 @@ func (handler *ChatHandler) HandleChatBasic(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	server.EncodeAndLogResponse(&pb.Message{
-		Text: text,
-	}, w)
+	// The whole response, its text field is compatible with pb.Message.
+	server.EncodeAndLogResponse(resp, w)
 
 }
 
@@ -252,12 +311,14 @@ func (handler *ChatHandler) HandleChatApp(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	name := req.Message.Sender.DisplayName
-
-	// todo - make a real session id
-	sessionId := "0"
+	var space string
+	if req.Space != nil {
+		space = req.Space.Name
+	}
+	sessionId := chatSessionID(&req)
 
-	text, err := handler.kernel.Chat(r.Context(), name, sessionId, req.Message.ArgumentText)
+	speaker := kernel.ChatSpeaker(req.Message.Sender.Name, req.Message.Sender.DisplayName, space)
+	reply, err := handler.kernel.Chat(r.Context(), speaker, sessionId, req.Message.ArgumentText)
 	if err != nil {
 		slog.Error("Error in handleChat: ", "error", err)
 		server.EncodeAndLogResponse(&pb.Message{
@@ -266,7 +327,14 @@ func (handler *ChatHandler) HandleChatApp(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	resp, err := CreateResponseCard("ChatResponseCard", sessionId, text, uri)
+	// Clarifying questions are sent as plain text so they read like part of
+	// the conversation.
+	if reply.FollowUp {
+		server.EncodeAndLogResponse(&pb.Message{Text: reply.Text}, w)
+		return
+	}
+
+	resp, err := CreateResponseCard("ChatResponseCard", sessionId, reply, uri)
 	if err != nil {
 		slog.Error("Error creating card (CreateResponseCard): ", "error", err)
 		server.EncodeAndLogResponse(&pb.Message{
@@ -278,8 +346,36 @@ func (handler *ChatHandler) HandleChatApp(w http.ResponseWriter, r *http.Request
 	server.EncodeAndLogResponse(resp, w)
 }
 
-func (handler *ChatHandler) Close() {
-	if handler.llm != nil {
-		handler.llm.Close()
+// Returns the session for a message.  Outside of DMs the sender is part of
+// the session so people in the same space or thread each have their own
+// conversation with the assistant.
+func chatSessionID(req *pb.DeprecatedEvent) string {
+	var space, thread string
+	user := req.Message.Sender.Name
+	if req.Space != nil {
+		space = req.Space.Name
+		if req.Space.SingleUserBotDm || req.Space.Type == "DM" || req.Space.SpaceType == "DIRECT_MESSAGE" {
+			user = ""
+		}
+	}
+	if req.Message.Thread != nil {
+		thread = req.Message.Thread.Name
 	}
+	return session.ChatSessionID(space, thread, user)
+}
+
+// Reports whether the kernel's databases can be reached.
+func (handler *ChatHandler) HandleHealth(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	if err := handler.kernel.Ping(ctx); err != nil {
+		slog.ErrorContext(ctx, "database health check failed", "error", err)
+		http.Error(w, "database unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte{'o', 'k', '\n'})
+}
+
+// The kernel, and its LLM client, belong to the caller.
+func (handler *ChatHandler) Close() {
 }
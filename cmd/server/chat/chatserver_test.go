@@ -16,6 +16,10 @@ import (
 	"github.com/coreos/go-oidc/v3/oidc"
 	"github.com/go-jose/go-jose/v3"
 	"github.com/rcleveng/assistant/server/db"
+	"github.com/rcleveng/assistant/server/llm"
+	"github.com/rcleveng/assistant/server/llm/fake"
+	"github.com/rcleveng/assistant/server/llm/kernel"
+	"github.com/rcleveng/assistant/server/session"
 	pb "google.golang.org/api/chat/v1"
 )
 
@@ -72,16 +76,36 @@ func (c *TestLlmClient) GenerateText(ctx context.Context, prompt string) (string
 	return prompt, nil
 }
 
+func (c *TestLlmClient) GenerateTextStream(ctx context.Context, prompt string) (<-chan llm.StreamChunk, error) {
+	text, err := c.GenerateText(ctx, prompt)
+	if err != nil {
+		return nil, err
+	}
+	stream := make(chan llm.StreamChunk, 2)
+	stream <- llm.StreamChunk{Text: text}
+	stream <- llm.StreamChunk{Done: true}
+	close(stream)
+	return stream, nil
+}
+
+func (c *TestLlmClient) GenerateMessages(ctx context.Context, messages []llm.Message) (*llm.Generation, error) {
+	text, err := c.GenerateText(ctx, llm.MessagesText(messages))
+	if err != nil {
+		return nil, err
+	}
+	return &llm.Generation{Text: text}, nil
+}
+
 func (c *TestLlmClient) Close() error {
 	c.Opened = false
 	return nil
 }
 
-func (c *TestLlmClient) EmbedText(ctx context.Context, text string) ([]float32, error) {
+func (c *TestLlmClient) EmbedText(ctx context.Context, text string, opts llm.EmbedOptions) ([]float32, error) {
 	return nil, nil
 }
 
-func (c *TestLlmClient) BatchEmbedText(ctx context.Context, text []string) ([][]float32, error) {
+func (c *TestLlmClient) BatchEmbedText(ctx context.Context, text []string, opts llm.EmbedOptions) ([][]float32, error) {
 	return nil, nil
 }
 
@@ -94,10 +118,9 @@ func NewChatHandlerForTest(keySet *oidc.StaticKeySet, llm *TestLlmClient) *ChatH
 	edb := db.NoopEmbeddingsDB{}
 	return &ChatHandler{
 		verifier: verifier,
-		llm:      llm,
-		db:       edb,
 		// This needs to match the clientid above
 		projectID: defaultChatAppProject,
+		kernel:    kernel.NewHandRolledKernelWithClients(llm, edb, session.NewMemoryStore()),
 	}
 }
 
@@ -159,3 +182,137 @@ func TestSmoke(t *testing.T) {
 	}
 
 }
+
+type unreachableDB struct {
+	db.NoopEmbeddingsDB
+}
+
+func (unreachableDB) Ping(ctx context.Context) error {
+	return fmt.Errorf("connection refused")
+}
+
+func TestHealth(t *testing.T) {
+	llm := &TestLlmClient{}
+	handler := &ChatHandler{kernel: kernel.NewHandRolledKernelWithClients(llm, db.NoopEmbeddingsDB{}, session.NewMemoryStore())}
+	response := httptest.NewRecorder()
+	handler.HandleHealth(response, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if response.Code != http.StatusOK {
+		t.Errorf("Expected healthy, got %d", response.Code)
+	}
+
+	handler = &ChatHandler{kernel: kernel.NewHandRolledKernelWithClients(llm, unreachableDB{}, session.NewMemoryStore())}
+	response = httptest.NewRecorder()
+	handler.HandleHealth(response, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if response.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected unavailable, got %d", response.Code)
+	}
+}
+
+func TestResponseCardCitations(t *testing.T) {
+	buttons := func(m *pb.Message) []*pb.GoogleAppsCardV1Button {
+		widgets := m.CardsV2[0].Card.Sections[0].Widgets
+		return widgets[len(widgets)-1].ButtonList.Buttons
+	}
+
+	resp, err := CreateResponseCard("c", "s1", &kernel.Response{Text: "No sources", TraceID: "t1"}, "https://assistant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.CardsV2[0].Card.Sections[0].Widgets) != 2 || len(buttons(resp)) != 2 {
+		t.Errorf("Expected only the text and feedback buttons without citations, got %#v", resp.CardsV2[0].Card.Sections[0].Widgets)
+	}
+	if url := buttons(resp)[0].OnClick.OpenLink.Url; url != "https://assistant/feedback/up/s1?trace=t1" {
+		t.Errorf("Expected feedback for the trace, got %s", url)
+	}
+
+	citations := []kernel.Citation{
+		{Number: 1, Title: "Notes", Source: "file:///home/rob/notes.md"},
+		{Number: 2, Title: "Handbook <v2>", Source: "https://example.com/handbook"},
+	}
+	resp, err = CreateResponseCard("c", "s1", &kernel.Response{Text: "Cited [1] [2]", Action: "REMEMBER", Citations: citations}, "https://assistant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sources := resp.CardsV2[0].Card.Sections[0].Widgets[1].TextParagraph.Text
+	want := "<b>Sources</b>\n[1] Notes\n[2] <a href=\"https://example.com/handbook\">Handbook &lt;v2&gt;</a>"
+	if sources != want {
+		t.Errorf("Expected sources %q, got %q", want, sources)
+	}
+	if subtitle := resp.CardsV2[0].Card.Header.Subtitle; subtitle != "Saved to memory" {
+		t.Errorf("Expected the subtitle for REMEMBER, got %s", subtitle)
+	}
+	learnMore := buttons(resp)[0]
+	if learnMore.Text != "Learn More" || learnMore.OnClick.OpenLink.Url != "https://example.com/handbook" {
+		t.Errorf("Expected Learn More to open the handbook, got %#v", learnMore)
+	}
+}
+
+func TestChatBasic(t *testing.T) {
+	client := fake.NewLlmClient("NEEDMORE: Which city?")
+	handler := &ChatHandler{kernel: kernel.NewHandRolledKernelWithClients(client, db.NoopEmbeddingsDB{}, session.NewMemoryStore())}
+	response := httptest.NewRecorder()
+	handler.HandleChatBasic(response, httptest.NewRequest(http.MethodPost, "/chat/basic", strings.NewReader(`{"name": "rob", "text": "What is the weather?"}`)))
+
+	// Clients expecting a pb.Message still get the text.
+	msg := &pb.Message{}
+	if err := json.Unmarshal(response.Body.Bytes(), msg); err != nil || msg.Text != "Which city?" {
+		t.Errorf("Expected the text as a message, got %s", response.Body.String())
+	}
+	resp := &kernel.Response{}
+	if err := json.Unmarshal(response.Body.Bytes(), resp); err != nil {
+		t.Fatal(err)
+	}
+	if !resp.FollowUp || resp.Action != "NEEDMORE" || resp.TraceID == "" {
+		t.Errorf("Expected a follow up question, got %#v", resp)
+	}
+}
+
+func TestChatBasicSession(t *testing.T) {
+	client := fake.NewLlmClient("ANSWER: hi")
+	handler := &ChatHandler{kernel: kernel.NewHandRolledKernelWithClients(client, db.NoopEmbeddingsDB{}, session.NewMemoryStore())}
+	tests := []struct {
+		session string
+		want    int
+	}{
+		{"", http.StatusOK},
+		{"basic:rob", http.StatusOK},
+		{"basic:rob:2", http.StatusOK},
+		{"basic:robert", http.StatusBadRequest},
+		{"basic:alice", http.StatusBadRequest},
+		{"chat:AAA:BBB:42", http.StatusBadRequest},
+		{"slack:C123:1700000000.000100:U1", http.StatusBadRequest},
+	}
+	response := httptest.NewRecorder()
+	handler.HandleChatBasic(response, httptest.NewRequest(http.MethodPost, "/chat/basic", strings.NewReader(`{"text": "hello"}`)))
+	if response.Code != http.StatusBadRequest {
+		t.Errorf("Expected a request without a name to be rejected, got %d", response.Code)
+	}
+	for _, tc := range tests {
+		body := fmt.Sprintf(`{"name": "rob", "text": "hello", "session": %q}`, tc.session)
+		response := httptest.NewRecorder()
+		handler.HandleChatBasic(response, httptest.NewRequest(http.MethodPost, "/chat/basic", strings.NewReader(body)))
+		if response.Code != tc.want {
+			t.Errorf("Session '%s': expected %d, got %d %s", tc.session, tc.want, response.Code, response.Body.String())
+		}
+	}
+}
+
+func TestChatSessionID(t *testing.T) {
+	event := func(space *pb.Space, user string) *pb.DeprecatedEvent {
+		return &pb.DeprecatedEvent{
+			Space: space,
+			Message: &pb.Message{
+				Sender: &pb.User{Name: user},
+				Thread: &pb.Thread{Name: "spaces/AAA/threads/BBB"},
+			},
+		}
+	}
+	room := &pb.Space{Name: "spaces/AAA", Type: "ROOM", SpaceType: "SPACE"}
+	if a, b := chatSessionID(event(room, "users/1")), chatSessionID(event(room, "users/2")); a == b {
+		t.Errorf("Expected people in a space to have their own sessions, both got %s", a)
+	}
+	dm := &pb.Space{Name: "spaces/AAA", Type: "DM", SingleUserBotDm: true}
+	if got := chatSessionID(event(dm, "users/1")); got != "chat:AAA:BBB" {
+		t.Errorf("Expected the DM's session, got %s", got)
+	}
+}
@@ -25,6 +25,7 @@ func (handler *FeedbackHandler) HandleFeedback(w http.ResponseWriter, r *http.Re
 	vars := mux.Vars(r)
 	feedbackType := vars["type"]    // 'up' or 'down'
 	feedbackSessionId := vars["id"] // Id to apply feedback
+	slog.Info("feedback", "type", feedbackType, "session", feedbackSessionId, "trace", r.URL.Query().Get("trace"))
 
 	resp := &pb.Message{Text: fmt.Sprintf("Received '%s' feedback on id: '%s'", feedbackType, feedbackSessionId)}
 	server.EncodeAndLogResponse(resp, w)
@@ -15,7 +15,9 @@ import (
 	"github.com/rcleveng/assistant/cmd/server/chat"
 	"github.com/rcleveng/assistant/cmd/server/docs"
 	"github.com/rcleveng/assistant/cmd/server/slack"
+	"github.com/rcleveng/assistant/server/db"
 	"github.com/rcleveng/assistant/server/env"
+	"github.com/rcleveng/assistant/server/llm/kernel"
 
 	"os"
 )
@@ -54,9 +56,22 @@ func main() {
 		env.SetupCloudLogging()
 	}
 
+	if environment.DatabaseMigrateOnStart && db.Backend(environment) == db.PostgresBackend {
+		if err := db.Migrate(ctx, environment); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	router := mux.NewRouter()
 
-	chatHandler, err := chat.NewChatHandler(ctx, environment)
+	// Chat and Slack share the kernel so they share memories.
+	k, err := kernel.NewHandRolledKernel(ctx, environment)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer k.Close()
+
+	chatHandler, err := chat.NewChatHandler(ctx, environment, k)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -67,12 +82,14 @@ func main() {
 	router.HandleFunc("/docs", docs.DocsHandler).Methods(http.MethodPost, http.MethodGet)
 	router.HandleFunc("/authorizeFile", docs.AuthFileHandler).Methods(http.MethodPost, http.MethodGet)
 	router.HandleFunc("/chat", chatHandler.HandleChatApp).Methods(http.MethodPost)
-	router.HandleFunc("/chat/basic", chatHandler.HandleChatBasic).Methods(http.MethodPost)
 	router.HandleFunc("/debug/card", chatHandler.DebugCard).Methods(http.MethodGet)
+	// The basic endpoint takes the caller's name on trust, so it is only for
+	// local development and never served on Cloud Run.
+	if environment.Platform != env.CLOUDRUN {
+		router.HandleFunc("/chat/basic", chatHandler.HandleChatBasic).Methods(http.MethodPost)
+	}
 	router.HandleFunc("/feedback/{type}/{id}", feedbackHandler.HandleFeedback).Methods(http.MethodPost)
-	router.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte{'o', 'k', '\n'})
-	})
+	router.HandleFunc("/health", chatHandler.HandleHealth)
 	router.HandleFunc("/home", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte{'o', 'k', '\n'})
 	})
@@ -83,7 +100,7 @@ func main() {
 	// Add Slack Support
 	slackRouter := router.PathPrefix("/slack").Subrouter()
 
-	slackHandler, err := slack.NewSlackHandler(ctx, environment, slackRouter)
+	slackHandler, err := slack.NewSlackHandler(ctx, environment, slackRouter, k)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -13,11 +13,9 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/rcleveng/assistant/server"
-	"github.com/rcleveng/assistant/server/db"
 	"github.com/rcleveng/assistant/server/env"
-	"github.com/rcleveng/assistant/server/llm"
 	"github.com/rcleveng/assistant/server/llm/kernel"
-	"github.com/rcleveng/assistant/server/llm/palm"
+	"github.com/rcleveng/assistant/server/session"
 
 	"github.com/slack-go/slack"
 	"github.com/slack-go/slack/slackevents"
@@ -29,8 +27,6 @@ const defaultChatAppProject = "1007744422436"
 // const jwtURL = "https://www.googleapis.com/service_accounts/v1/jwk/"
 
 type SlackHandler struct {
-	llm           llm.LlmClient
-	db            db.EmbeddingsDB
 	api           *slack.Client
 	clientId      string
 	clientSecret  string
@@ -39,7 +35,7 @@ type SlackHandler struct {
 	kernel        kernel.Kernel
 }
 
-func NewSlackHandler(ctx context.Context, environment *env.Environment, router *mux.Router) (*SlackHandler, error) {
+func NewSlackHandler(ctx context.Context, environment *env.Environment, router *mux.Router, kernel kernel.Kernel) (*SlackHandler, error) {
 	// TODO: query the metadata server if we're on cloud run.
 	projectID := os.Getenv("GOOGLE_CLOUD_PROJECT")
 	if projectID == "" {
@@ -48,26 +44,9 @@ func NewSlackHandler(ctx context.Context, environment *env.Environment, router *
 
 	slog.Info("NewSlackHandler: Using Cloud", "projectID", projectID)
 
-	llm, err := palm.NewPalmLLMClient(ctx, environment)
-	if err != nil {
-		return nil, err
-	}
-
-	edb, err := db.NewPostgresDatabase(environment)
-	if err != nil {
-		return nil, err
-	}
-
 	api := slack.New(environment.SlackBotOAuthToken, slack.OptionDebug(true))
 
-	kernel, err := kernel.NewHandRolledKernel(ctx, environment)
-	if err != nil {
-		return nil, err
-	}
-
 	handler := &SlackHandler{
-		llm:           llm,
-		db:            edb,
 		projectID:     projectID,
 		api:           api,
 		clientId:      environment.SlackClientID,
@@ -83,7 +62,7 @@ func NewSlackHandler(ctx context.Context, environment *env.Environment, router *
 	// This is jsut here for testing
 	router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("Slack handler is active.\n")) }).Methods(http.MethodGet)
 
-	return handler, err
+	return handler, nil
 }
 
 func (handler *SlackHandler) slashHelp(w http.ResponseWriter, r *http.Request) {
@@ -111,20 +90,60 @@ func (handler *SlackHandler) handleAppMentionEvent(ctx context.Context, ev slack
 		text = rest
 	}
 
-	response, err := handler.kernel.Chat(ctx, ev.User, ev.EventTimeStamp, text)
+	// Reply in the thread so follow up questions from the same user share
+	// the session.
+	threadTs := ev.ThreadTimeStamp
+	if threadTs == "" {
+		threadTs = ev.TimeStamp
+	}
+	sessionId := session.SlackSessionID(ev.Channel, threadTs, ev.User)
+
+	resp, err := handler.kernel.Chat(ctx, kernel.SlackSpeaker(ev.User, ev.Channel), sessionId, text)
 	if err != nil {
 		msg := fmt.Sprintf("Error: %v", err.Error())
-		handler.api.PostMessage(ev.Channel, slack.MsgOptionText(msg, true))
+		handler.api.PostMessage(ev.Channel, slack.MsgOptionText(msg, true), slack.MsgOptionTS(threadTs))
 		return
 	}
-	channel, ts, err := handler.api.PostMessage(ev.Channel, slack.MsgOptionText(response, false))
+	response := formatResponse(resp, ev.User)
+	channel, ts, err := handler.api.PostMessage(ev.Channel, slack.MsgOptionText(response, false), slack.MsgOptionTS(threadTs))
 	if err != nil {
 		slog.ErrorContext(ctx, "error posting message to channel", "err", err)
 		return
 	}
-	slog.InfoContext(ctx, "posted message", "channel", channel, "timestamp", ts, "response", response)
+	slog.InfoContext(ctx, "posted message", "channel", channel, "timestamp", ts, "trace", resp.TraceID, "response", response)
 }
 
+// Returns the reply to post in the thread.  Clarifying questions mention
+// the user so they are notified to answer, and cited sources are listed
+// after the text.
+func formatResponse(resp *kernel.Response, user string) string {
+	text := resp.Text
+	if resp.FollowUp && user != "" {
+		text = fmt.Sprintf("<@%s> %s", user, text)
+	}
+	if len(resp.Citations) > 0 {
+		text += "\n\n*Sources*\n" + citationsText(resp.Citations)
+	}
+	return text
+}
+
+// Returns a line for each citation using Slack's mrkdwn, linked when the
+// source has a link.
+func citationsText(citations []kernel.Citation) string {
+	lines := make([]string, len(citations))
+	for i, c := range citations {
+		label := slackEscape(c.Label())
+		if link := c.Link(); link != "" {
+			label = fmt.Sprintf("<%s|%s>", link, label)
+		}
+		lines[i] = fmt.Sprintf("[%d] %s", c.Number, label)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Escapes the characters Slack treats as control characters.
+var slackEscape = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace
+
 func (handler *SlackHandler) handleURLVerification(ctx context.Context, w http.ResponseWriter, body []byte) {
 	var r *slackevents.ChallengeResponse
 	if err := json.Unmarshal(body, &r); err != nil {
@@ -194,8 +213,6 @@ func (handler *SlackHandler) actionEndpoint(w http.ResponseWriter, r *http.Reque
 	}
 }
 
+// The kernel, and its LLM client, belong to the caller.
 func (handler *SlackHandler) Close() {
-	if handler.llm != nil {
-		handler.llm.Close()
-	}
 }
@@ -0,0 +1,76 @@
+// Package calendar looks up events from iCalendar files and Google Calendar.
+package calendar
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// An event on a calendar.
+type Event struct {
+	Summary     string
+	Description string
+	Location    string
+	Start       time.Time
+	End         time.Time
+	// All day events only use the date of Start and End
+	AllDay bool
+}
+
+func (e Event) String() string {
+	var b strings.Builder
+	if e.AllDay {
+		b.WriteString("All day")
+	} else {
+		fmt.Fprintf(&b, "%s - %s", e.Start.Format("15:04"), e.End.Format("15:04"))
+	}
+	fmt.Fprintf(&b, ": %s", e.Summary)
+	if e.Location != "" {
+		fmt.Fprintf(&b, " (%s)", e.Location)
+	}
+	return b.String()
+}
+
+// Formats events one per line for a prompt.
+func FormatEvents(events []Event) string {
+	if len(events) == 0 {
+		return "No events."
+	}
+	lines := make([]string, len(events))
+	for i, e := range events {
+		lines[i] = e.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Returns the start and end of the day containing t, in t's location.
+func dayBounds(t time.Time) (time.Time, time.Time) {
+	start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	return start, start.AddDate(0, 0, 1)
+}
+
+// Returns the events overlapping [start, end) sorted by start time, with
+// times converted to start's location.
+func eventsBetween(events []Event, start, end time.Time) []Event {
+	found := make([]Event, 0)
+	for _, e := range events {
+		evEnd := e.End
+		if !evEnd.After(e.Start) {
+			// zero length events still count when they start in the range
+			evEnd = e.Start.Add(time.Nanosecond)
+		}
+		if e.Start.Before(end) && evEnd.After(start) {
+			if !e.AllDay {
+				e.Start = e.Start.In(start.Location())
+				e.End = e.End.In(start.Location())
+			}
+			found = append(found, e)
+		}
+	}
+	sort.SliceStable(found, func(i, j int) bool {
+		return found[i].Start.Before(found[j].Start)
+	})
+	return found
+}
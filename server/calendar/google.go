@@ -0,0 +1,73 @@
+package calendar
+
+import (
+	"context"
+	"time"
+
+	gcal "google.golang.org/api/calendar/v3"
+	"google.golang.org/api/option"
+)
+
+// Reads events from a Google Calendar using the default credentials, the
+// calendar must be shared with the service account.
+type GoogleProvider struct {
+	service    *gcal.Service
+	calendarId string
+}
+
+func NewGoogleProvider(ctx context.Context, calendarId string, opts ...option.ClientOption) (*GoogleProvider, error) {
+	allopts := append([]option.ClientOption{option.WithScopes(gcal.CalendarReadonlyScope)}, opts...)
+	service, err := gcal.NewService(ctx, allopts...)
+	if err != nil {
+		return nil, err
+	}
+	return &GoogleProvider{
+		service:    service,
+		calendarId: calendarId,
+	}, nil
+}
+
+func (p *GoogleProvider) Events(ctx context.Context, day time.Time) ([]Event, error) {
+	start, end := dayBounds(day)
+	resp, err := p.service.Events.List(p.calendarId).
+		TimeMin(start.Format(time.RFC3339)).
+		TimeMax(end.Format(time.RFC3339)).
+		SingleEvents(true).
+		OrderBy("startTime").
+		Context(ctx).
+		Do()
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]Event, 0, len(resp.Items))
+	for _, item := range resp.Items {
+		ev := Event{
+			Summary:     item.Summary,
+			Description: item.Description,
+			Location:    item.Location,
+		}
+		if ev.Start, ev.AllDay, err = googleTime(item.Start, day.Location()); err != nil {
+			return nil, err
+		}
+		if ev.End, _, err = googleTime(item.End, day.Location()); err != nil {
+			return nil, err
+		}
+		events = append(events, ev)
+	}
+	return events, nil
+}
+
+// Converts a Google Calendar time which is either a date for all day events
+// or an RFC3339 timestamp.
+func googleTime(t *gcal.EventDateTime, location *time.Location) (time.Time, bool, error) {
+	if t == nil {
+		return time.Time{}, false, nil
+	}
+	if t.DateTime == "" {
+		d, err := time.ParseInLocation(time.DateOnly, t.Date, location)
+		return d, true, err
+	}
+	d, err := time.Parse(time.RFC3339, t.DateTime)
+	return d.In(location), false, err
+}
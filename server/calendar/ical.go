@@ -0,0 +1,402 @@
+package calendar
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Reads events from an iCalendar (.ics) file or http(s) URL.  The source is
+// read on every lookup so changes show up right away.  Daily and weekly
+// recurring events are expanded, see ParseICal for what is supported.
+type ICalProvider struct {
+	source string
+	// Location for floating times and all day events
+	location *time.Location
+	client   *http.Client
+}
+
+func NewICalProvider(source string, location *time.Location) *ICalProvider {
+	if location == nil {
+		location = time.Local
+	}
+	return &ICalProvider{
+		source:   source,
+		location: location,
+		client:   http.DefaultClient,
+	}
+}
+
+func (p *ICalProvider) open(ctx context.Context) (io.ReadCloser, error) {
+	if !strings.HasPrefix(p.source, "http://") && !strings.HasPrefix(p.source, "https://") {
+		return os.Open(p.source)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.source, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("error HTTP %d fetching calendar: %s", resp.StatusCode, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+func (p *ICalProvider) Events(ctx context.Context, day time.Time) ([]Event, error) {
+	r, err := p.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	parsed, err := parseICal(r, p.location)
+	if err != nil {
+		return nil, err
+	}
+	start, end := dayBounds(day)
+	events := make([]Event, 0, len(parsed))
+	for _, ev := range parsed {
+		events = append(events, ev.occurrences(start, end)...)
+	}
+	return eventsBetween(events, start, end), nil
+}
+
+// Most occurrences a recurring event is expanded into.
+const maxOccurrences = 1000
+
+// Parses the VEVENTs from an iCalendar stream.  Floating times and all day
+// dates are interpreted in location.
+//
+// Recurring events are expanded into one event per occurrence, for RRULEs
+// with FREQ=DAILY or WEEKLY and any of INTERVAL, COUNT, UNTIL and (weekly)
+// BYDAY, less the EXDATEs.  Rules without COUNT or UNTIL stop after
+// maxOccurrences, ICalProvider finds their occurrences on any day.  Other
+// rules, such as monthly ones, only give their first occurrence, and
+// occurrences changed with a RECURRENCE-ID show up as extra events rather
+// than replacing the original.
+func ParseICal(r io.Reader, location *time.Location) ([]Event, error) {
+	parsed, err := parseICal(r, location)
+	if err != nil {
+		return nil, err
+	}
+	events := make([]Event, 0, len(parsed))
+	for _, ev := range parsed {
+		events = append(events, ev.occurrences(time.Time{}, time.Time{})...)
+	}
+	return events, nil
+}
+
+// A VEVENT before its recurrence is expanded.
+type icalEvent struct {
+	Event
+	rule    *recurrence
+	exdates []time.Time
+}
+
+func parseICal(r io.Reader, location *time.Location) ([]icalEvent, error) {
+	lines, err := unfoldLines(r)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]icalEvent, 0)
+	// Components being read, properties only apply to the innermost one so
+	// a VALARM's DESCRIPTION doesn't replace its event's.
+	stack := make([]string, 0, 3)
+	var ev *icalEvent
+	var hasEnd bool
+	for n, line := range lines {
+		name, params, value, ok := splitContentLine(line)
+		if !ok {
+			continue
+		}
+		if name == "BEGIN" {
+			stack = append(stack, strings.ToUpper(value))
+			if stack[len(stack)-1] == "VEVENT" {
+				ev = &icalEvent{}
+				hasEnd = false
+			}
+			continue
+		}
+		if name == "END" {
+			if len(stack) == 0 || stack[len(stack)-1] != strings.ToUpper(value) {
+				return nil, fmt.Errorf("line %d: END:%s without BEGIN", n+1, value)
+			}
+			stack = stack[:len(stack)-1]
+			if strings.ToUpper(value) == "VEVENT" {
+				if !hasEnd {
+					if ev.AllDay {
+						ev.End = ev.Start.AddDate(0, 0, 1)
+					} else {
+						ev.End = ev.Start
+					}
+				}
+				events = append(events, *ev)
+				ev = nil
+			}
+			continue
+		}
+		if len(stack) == 0 || stack[len(stack)-1] != "VEVENT" {
+			// properties of the calendar or of components inside an event
+			continue
+		}
+
+		switch name {
+		case "SUMMARY":
+			ev.Summary = unescapeText(value)
+		case "DESCRIPTION":
+			ev.Description = unescapeText(value)
+		case "LOCATION":
+			ev.Location = unescapeText(value)
+		case "DTSTART", "DTEND":
+			t, allDay, err := parseICalTime(value, params, location)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n+1, err)
+			}
+			if name == "DTSTART" {
+				ev.Start = t
+				ev.AllDay = allDay
+			} else {
+				ev.End = t
+				hasEnd = true
+			}
+		case "RRULE":
+			rule, err := parseRecurrence(value, location)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n+1, err)
+			}
+			ev.rule = rule
+		case "EXDATE":
+			for _, v := range strings.Split(value, ",") {
+				t, _, err := parseICalTime(v, params, location)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %w", n+1, err)
+				}
+				ev.exdates = append(ev.exdates, t)
+			}
+		}
+	}
+	return events, nil
+}
+
+// The parts of an RRULE that are supported.
+type recurrence struct {
+	// DAILY or WEEKLY, other frequencies aren't expanded
+	freq     string
+	interval int
+	// 0 when not limited
+	count int
+	// Zero when not limited, inclusive.  A date is the end of that day.
+	until time.Time
+	// Days of the week for weekly rules, empty for DTSTART's day
+	byDay []time.Weekday
+}
+
+var icalWeekdays = map[string]time.Weekday{
+	"MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday, "TH": time.Thursday,
+	"FR": time.Friday, "SA": time.Saturday, "SU": time.Sunday,
+}
+
+func parseRecurrence(value string, location *time.Location) (*recurrence, error) {
+	rule := &recurrence{interval: 1}
+	for _, part := range strings.Split(value, ";") {
+		k, v, _ := strings.Cut(part, "=")
+		var err error
+		switch strings.ToUpper(k) {
+		case "FREQ":
+			rule.freq = strings.ToUpper(v)
+		case "INTERVAL":
+			rule.interval, err = strconv.Atoi(v)
+			if err == nil && rule.interval < 1 {
+				err = fmt.Errorf("interval must be positive")
+			}
+		case "COUNT":
+			rule.count, err = strconv.Atoi(v)
+		case "UNTIL":
+			var date bool
+			rule.until, date, err = parseICalTime(v, nil, location)
+			if date {
+				// Timed occurrences on the UNTIL day are included too.
+				rule.until = rule.until.AddDate(0, 0, 1).Add(-time.Nanosecond)
+			}
+		case "BYDAY":
+			for _, day := range strings.Split(v, ",") {
+				// Days with an ordinal, like 1MO, only mean something for
+				// monthly and yearly rules.
+				if wd, ok := icalWeekdays[strings.ToUpper(day)]; ok {
+					rule.byDay = append(rule.byDay, wd)
+				}
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid RRULE %s: %w", part, err)
+		}
+	}
+	return rule, nil
+}
+
+// Returns the occurrences of the event that end after from and start before
+// before, up to maxOccurrences.  Either may be zero for no limit.
+func (ev icalEvent) occurrences(from, before time.Time) []Event {
+	if ev.rule == nil || (ev.rule.freq != "DAILY" && ev.rule.freq != "WEEKLY") {
+		return []Event{ev.Event}
+	}
+	rule := ev.rule
+
+	// Occurrences are offsets in days from the start of a period, weekly
+	// periods start on the Monday of DTSTART's week.
+	period := rule.interval
+	offsets := []int{0}
+	first := 0
+	if rule.freq == "WEEKLY" {
+		period *= 7
+		if len(rule.byDay) > 0 {
+			offsets = make([]int, 0, len(rule.byDay))
+			for _, d := range rule.byDay {
+				offsets = append(offsets, sinceMonday(d))
+			}
+			sort.Ints(offsets)
+			first = sinceMonday(ev.Start.Weekday())
+		}
+	}
+	// All day events keep their length in days across DST changes.
+	length := int(ev.End.Sub(ev.Start).Round(24*time.Hour) / (24 * time.Hour))
+	duration := ev.End.Sub(ev.Start)
+
+	events := make([]Event, 0)
+	seen := 0
+	// Adds the occurrence days after DTSTART, returns false once the rule
+	// or before ends it.
+	add := func(days int) bool {
+		start := ev.Start.AddDate(0, 0, days)
+		if (rule.count > 0 && seen >= rule.count) ||
+			(!rule.until.IsZero() && start.After(rule.until)) ||
+			(!before.IsZero() && !start.Before(before)) ||
+			len(events) >= maxOccurrences {
+			return false
+		}
+		seen++
+		occurrence := ev.Event
+		occurrence.Start = start
+		if ev.AllDay {
+			occurrence.End = start.AddDate(0, 0, length)
+		} else {
+			occurrence.End = start.Add(duration)
+		}
+		if ev.excluded(start) || (!from.IsZero() && start.Before(from) && !occurrence.End.After(from)) {
+			return true
+		}
+		events = append(events, occurrence)
+		return true
+	}
+
+	// DTSTART is always the first occurrence, even when it isn't on one of
+	// the rule's days.
+	if !add(0) {
+		return events
+	}
+	for p := 0; ; p++ {
+		for _, offset := range offsets {
+			days := p*period + offset - first
+			if days <= 0 {
+				continue
+			}
+			if !add(days) {
+				return events
+			}
+		}
+	}
+}
+
+func (ev icalEvent) excluded(start time.Time) bool {
+	for _, t := range ev.exdates {
+		if t.Equal(start) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the days since Monday, the default start of an iCalendar week.
+func sinceMonday(d time.Weekday) int {
+	return (int(d) + 6) % 7
+}
+
+// Reads the content lines, joining folded lines back together.
+func unfoldLines(r io.Reader) ([]string, error) {
+	lines := make([]string, 0)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if len(lines) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
+
+// Splits "NAME;PARAM=X;PARAM2=Y:VALUE" into its pieces.
+func splitContentLine(line string) (string, map[string]string, string, bool) {
+	// the value starts at the first colon that isn't inside a quoted param
+	inQuote := false
+	colon := -1
+	for i, c := range line {
+		if c == '"' {
+			inQuote = !inQuote
+		} else if c == ':' && !inQuote {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return "", nil, "", false
+	}
+
+	head := strings.Split(line[:colon], ";")
+	params := make(map[string]string, len(head)-1)
+	for _, p := range head[1:] {
+		if k, v, found := strings.Cut(p, "="); found {
+			params[strings.ToUpper(k)] = strings.Trim(v, `"`)
+		}
+	}
+	return strings.ToUpper(head[0]), params, line[colon+1:], true
+}
+
+func parseICalTime(value string, params map[string]string, location *time.Location) (time.Time, bool, error) {
+	if params["VALUE"] == "DATE" || len(value) == len("20060102") {
+		t, err := time.ParseInLocation("20060102", value, location)
+		return t, true, err
+	}
+	if strings.HasSuffix(value, "Z") {
+		t, err := time.Parse("20060102T150405Z", value)
+		return t, false, err
+	}
+	loc := location
+	if tzid, ok := params["TZID"]; ok {
+		if l, err := time.LoadLocation(tzid); err == nil {
+			loc = l
+		}
+	}
+	t, err := time.ParseInLocation("20060102T150405", value, loc)
+	return t, false, err
+}
+
+var textUnescaper = strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`)
+
+func unescapeText(s string) string {
+	return textUnescaper.Replace(s)
+}
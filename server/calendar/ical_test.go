@@ -0,0 +1,160 @@
+package calendar
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseICal(t *testing.T) {
+	events, err := ParseICal(strings.NewReader("BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nSUMMARY:Lunch\r\nDTSTART:20231214T120000Z\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"), time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("Expected 1 event, got %d", len(events))
+	}
+	ev := events[0]
+	if ev.Summary != "Lunch" || !ev.End.Equal(ev.Start) || ev.AllDay {
+		t.Errorf("Unexpected event %#v", ev)
+	}
+
+	if _, err := ParseICal(strings.NewReader("BEGIN:VEVENT\nDTSTART:tomorrow\nEND:VEVENT\n"), time.UTC); err == nil {
+		t.Error("Expected error for invalid DTSTART")
+	}
+}
+
+func TestParseICalNestedComponents(t *testing.T) {
+	ics := `BEGIN:VCALENDAR
+BEGIN:VEVENT
+DTSTART:20231214T120000Z
+SUMMARY:Lunch
+DESCRIPTION:At the usual place
+BEGIN:VALARM
+ACTION:DISPLAY
+DESCRIPTION:Reminder
+TRIGGER:-PT15M
+END:VALARM
+LOCATION:Cafe
+END:VEVENT
+END:VCALENDAR
+`
+	events, err := ParseICal(strings.NewReader(ics), time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Description != "At the usual place" || events[0].Location != "Cafe" {
+		t.Errorf("Expected the alarm's properties to be ignored, got %#v", events)
+	}
+
+	if _, err := ParseICal(strings.NewReader("BEGIN:VEVENT\nBEGIN:VALARM\nEND:VEVENT\n"), time.UTC); err == nil {
+		t.Error("Expected error for mismatched END")
+	}
+}
+
+func TestParseICalRecurrence(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines string
+		want  []string
+	}{
+		{"daily count", "DTSTART:20231214T120000Z\nRRULE:FREQ=DAILY;COUNT=3",
+			[]string{"2023-12-14 12:00", "2023-12-15 12:00", "2023-12-16 12:00"}},
+		{"daily interval exdate", "DTSTART:20231214T120000Z\nRRULE:FREQ=DAILY;INTERVAL=2;COUNT=3\nEXDATE:20231216T120000Z",
+			[]string{"2023-12-14 12:00", "2023-12-18 12:00"}},
+		{"weekly until", "DTSTART:20231214T120000Z\nRRULE:FREQ=WEEKLY;UNTIL=20231228T120000Z",
+			[]string{"2023-12-14 12:00", "2023-12-21 12:00", "2023-12-28 12:00"}},
+		{"weekly by day", "DTSTART:20231213T090000Z\nRRULE:FREQ=WEEKLY;BYDAY=MO,WE;COUNT=4",
+			[]string{"2023-12-13 09:00", "2023-12-18 09:00", "2023-12-20 09:00", "2023-12-25 09:00"}},
+		{"all day", "DTSTART;VALUE=DATE:20231214\nRRULE:FREQ=DAILY;UNTIL=20231215",
+			[]string{"2023-12-14 00:00", "2023-12-15 00:00"}},
+		{"timed until date", "DTSTART:20231214T120000Z\nRRULE:FREQ=DAILY;UNTIL=20231215",
+			[]string{"2023-12-14 12:00", "2023-12-15 12:00"}},
+		{"monthly", "DTSTART:20231214T120000Z\nRRULE:FREQ=MONTHLY;COUNT=3",
+			[]string{"2023-12-14 12:00"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ics := "BEGIN:VEVENT\nSUMMARY:Standup\n" + tc.lines + "\nEND:VEVENT\n"
+			events, err := ParseICal(strings.NewReader(ics), time.UTC)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]string, len(events))
+			for i, ev := range events {
+				got[i] = ev.Start.Format("2006-01-02 15:04")
+			}
+			if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+				t.Errorf("Expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+
+	if _, err := ParseICal(strings.NewReader("BEGIN:VEVENT\nDTSTART:20231214T120000Z\nRRULE:FREQ=DAILY;COUNT=many\nEND:VEVENT\n"), time.UTC); err == nil {
+		t.Error("Expected error for invalid COUNT")
+	}
+}
+
+func TestICalProviderOpenEndedRecurrence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "standup.ics")
+	ics := "BEGIN:VEVENT\nSUMMARY:Standup\nDTSTART:20200106T170000Z\nDTEND:20200106T171500Z\nRRULE:FREQ=WEEKLY;BYDAY=MO,TH\nEND:VEVENT\n"
+	if err := os.WriteFile(path, []byte(ics), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	p := NewICalProvider(path, time.UTC)
+
+	// Years past maxOccurrences.
+	thursday := time.Date(2031, 1, 2, 0, 0, 0, 0, time.UTC)
+	events, err := p.Events(context.Background(), thursday)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].String() != "17:00 - 17:15: Standup" {
+		t.Errorf("Expected the standup, got %v", FormatEvents(events))
+	}
+	if events, _ := p.Events(context.Background(), thursday.AddDate(0, 0, 1)); len(events) != 0 {
+		t.Errorf("Expected nothing on Friday, got %v", FormatEvents(events))
+	}
+}
+
+func TestICalProviderEvents(t *testing.T) {
+	la, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewICalProvider("testdata/test.ics", la)
+
+	day := time.Date(2023, 12, 14, 15, 0, 0, 0, la)
+	events, err := p.Events(context.Background(), day)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"All day: Holiday party",
+		"06:00 - 06:30: Breakfast with a very long title that has been folded onto the next line",
+		"09:00 - 10:00: Team sync (Room 1, Building A)",
+	}
+	if len(events) != len(want) {
+		t.Fatalf("Expected %d events got %d: %v", len(want), len(events), FormatEvents(events))
+	}
+	for i, w := range want {
+		if events[i].String() != w {
+			t.Errorf("Expected '%s' got '%s'", w, events[i].String())
+		}
+	}
+	if events[0].Description != "Bring a dish\nand a friend" {
+		t.Errorf("Expected description to be unescaped, got '%s'", events[0].Description)
+	}
+
+	next, err := p.Events(context.Background(), day.AddDate(0, 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(next) != 1 || next[0].Summary != "Dentist" {
+		t.Errorf("Expected only the dentist the next day, got %v", FormatEvents(next))
+	}
+}
@@ -0,0 +1,25 @@
+package db
+
+import (
+	"math"
+	"testing"
+)
+
+func TestCosineSimilarity(t *testing.T) {
+	tests := []struct {
+		a, b []float32
+		want float32
+	}{
+		{[]float32{1, 0}, []float32{2, 0}, 1},
+		{[]float32{1, 0}, []float32{0, 3}, 0},
+		{[]float32{1, 1}, []float32{-1, -1}, -1},
+		{[]float32{1, 0}, []float32{1, 1}, float32(1 / math.Sqrt2)},
+		{[]float32{0, 0}, []float32{1, 1}, 0},
+		{nil, nil, 0},
+	}
+	for _, tc := range tests {
+		if got := CosineSimilarity(tc.a, tc.b); math.Abs(float64(got-tc.want)) > 1e-6 {
+			t.Errorf("CosineSimilarity(%v, %v) = %v, want %v", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
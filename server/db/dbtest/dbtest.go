@@ -0,0 +1,372 @@
+// Conformance tests that every db.EmbeddingsDB implementation should pass.
+//
+//	func TestMyDatabase(t *testing.T) {
+//		dbtest.Run(t, func(t *testing.T) db.EmbeddingsDB {
+//			return newEmptyDatabase(t)
+//		})
+//	}
+package dbtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rcleveng/assistant/server/db"
+)
+
+// Size of the embeddings used by the tests, matching the postgres schema.
+const Dimensions = 768
+
+// Returns a new, empty database.  The suite closes it.
+type Factory func(t *testing.T) db.EmbeddingsDB
+
+// Runs every conformance test against databases made by factory.
+func Run(t *testing.T, factory Factory) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, ctx context.Context, emb db.EmbeddingsDB)
+	}{
+		{"AddAndFind", testAddAndFind},
+		{"Ordering", testOrdering},
+		{"Count", testCount},
+		{"MinSimilarity", testMinSimilarity},
+		{"Scopes", testScopes},
+		{"Delete", testDelete},
+		{"Update", testUpdate},
+		{"List", testList},
+		{"Concurrent", testConcurrent},
+		{"Hybrid", testHybrid},
+		{"Diversity", testDiversity},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			emb := factory(t)
+			defer emb.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			if err := emb.Ping(ctx); err != nil {
+				t.Fatalf("Ping: %v", err)
+			}
+			tc.test(t, ctx, emb)
+		})
+	}
+}
+
+// Returns a unit vector at angle degrees in the plane of the first two
+// dimensions, so the cosine similarity of two vectors is cos(difference).
+func Vector(degrees float64) []float32 {
+	v := make([]float32, Dimensions)
+	rad := degrees * math.Pi / 180
+	v[0] = float32(math.Cos(rad))
+	v[1] = float32(math.Sin(rad))
+	return v
+}
+
+func add(t *testing.T, ctx context.Context, emb db.EmbeddingsDB, scope db.Scope, text string, degrees float64) int64 {
+	t.Helper()
+	id, err := emb.Add(ctx, 0, "", scope, text, Vector(degrees))
+	if err != nil {
+		t.Fatalf("Add(%s): %v", text, err)
+	}
+	return id
+}
+
+func find(t *testing.T, ctx context.Context, emb db.EmbeddingsDB, degrees float64, opts db.FindOptions) []db.Match {
+	t.Helper()
+	matches, err := emb.Find(ctx, Vector(degrees), opts)
+	if err != nil {
+		t.Fatalf("Find: %v", err)
+	}
+	return matches
+}
+
+func contents(matches []db.Match) []string {
+	return db.Contents(matches)
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func testAddAndFind(t *testing.T, ctx context.Context, emb db.EmbeddingsDB) {
+	before := time.Now().Add(-time.Minute)
+	id, err := emb.Add(ctx, 42, "slack:U1", db.UserScope("slack:U1"), "the cat sat on the mat", Vector(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := add(t, ctx, emb, db.GlobalScope, "something else", 90)
+	if id <= 0 || other <= 0 || id == other {
+		t.Errorf("Expected distinct positive ids, got %d and %d", id, other)
+	}
+
+	matches := find(t, ctx, emb, 0, db.FindOptions{Count: 1})
+	if len(matches) != 1 {
+		t.Fatalf("Expected one match, got %#v", matches)
+	}
+	m := matches[0]
+	if m.ID != id || m.Content != "the cat sat on the mat" || m.Author != 42 || m.Owner != "slack:U1" || m.Scope != db.UserScope("slack:U1") {
+		t.Errorf("Expected the added memory, got %#v", m)
+	}
+	if math.Abs(float64(m.Similarity)-1) > 1e-4 {
+		t.Errorf("Expected similarity 1, got %v", m.Similarity)
+	}
+	if m.Created.Before(before) || m.Created.After(time.Now().Add(time.Minute)) {
+		t.Errorf("Expected created to be about now, got %v", m.Created)
+	}
+
+	if _, err := emb.Add(ctx, 0, "", "", "no scope", Vector(180)); err != nil {
+		t.Fatal(err)
+	}
+	matches = find(t, ctx, emb, 180, db.FindOptions{Count: 1, Scopes: []db.Scope{db.GlobalScope}})
+	if len(matches) != 1 || matches[0].Content != "no scope" {
+		t.Errorf("Expected memories without a scope to be global, got %#v", matches)
+	}
+}
+
+func testOrdering(t *testing.T, ctx context.Context, emb db.EmbeddingsDB) {
+	// Added out of order so insertion order can't pass for similarity.
+	add(t, ctx, emb, db.GlobalScope, "60", 60)
+	add(t, ctx, emb, db.GlobalScope, "10", 10)
+	add(t, ctx, emb, db.GlobalScope, "120", 120)
+	add(t, ctx, emb, db.GlobalScope, "30", 30)
+
+	matches := find(t, ctx, emb, 0, db.FindOptions{Count: 10})
+	want := []string{"10", "30", "60", "120"}
+	if !equal(contents(matches), want) {
+		t.Fatalf("Expected %v, got %v", want, contents(matches))
+	}
+	for i, m := range matches {
+		expected := math.Cos(float64([]int{10, 30, 60, 120}[i]) * math.Pi / 180)
+		if math.Abs(float64(m.Similarity)-expected) > 1e-3 {
+			t.Errorf("Expected similarity %.3f for %s, got %.3f", expected, m.Content, m.Similarity)
+		}
+	}
+}
+
+func testCount(t *testing.T, ctx context.Context, emb db.EmbeddingsDB) {
+	if matches := find(t, ctx, emb, 0, db.FindOptions{Count: 3}); len(matches) != 0 {
+		t.Errorf("Expected no matches in an empty database, got %#v", matches)
+	}
+	for i := 0; i < 5; i++ {
+		add(t, ctx, emb, db.GlobalScope, fmt.Sprint(i), float64(i*10))
+	}
+	if matches := find(t, ctx, emb, 0, db.FindOptions{Count: 3}); !equal(contents(matches), []string{"0", "1", "2"}) {
+		t.Errorf("Expected the 3 closest, got %v", contents(matches))
+	}
+	if matches := find(t, ctx, emb, 0, db.FindOptions{Count: 10}); len(matches) != 5 {
+		t.Errorf("Expected all 5 when asking for more, got %v", contents(matches))
+	}
+}
+
+func testMinSimilarity(t *testing.T, ctx context.Context, emb db.EmbeddingsDB) {
+	add(t, ctx, emb, db.GlobalScope, "close", 10)
+	add(t, ctx, emb, db.GlobalScope, "far", 80)
+	add(t, ctx, emb, db.GlobalScope, "opposite", 180)
+
+	// cos(10) = 0.98, cos(80) = 0.17
+	matches := find(t, ctx, emb, 0, db.FindOptions{Count: 10, MinSimilarity: 0.5})
+	if !equal(contents(matches), []string{"close"}) {
+		t.Errorf("Expected only the close memory, got %v", contents(matches))
+	}
+	matches = find(t, ctx, emb, 0, db.FindOptions{Count: 10})
+	if len(matches) != 3 {
+		t.Errorf("Expected no threshold by default, got %v", contents(matches))
+	}
+}
+
+func testScopes(t *testing.T, ctx context.Context, emb db.EmbeddingsDB) {
+	alice, bob := db.UserScope("slack:alice"), db.UserScope("slack:bob")
+	team := db.ChannelScope("slack:team")
+	add(t, ctx, emb, alice, "alice", 0)
+	add(t, ctx, emb, bob, "bob", 1)
+	add(t, ctx, emb, team, "team", 2)
+	add(t, ctx, emb, db.GlobalScope, "global", 3)
+
+	tests := []struct {
+		scopes []db.Scope
+		want   []string
+	}{
+		{[]db.Scope{db.GlobalScope, team, alice}, []string{"alice", "team", "global"}},
+		{[]db.Scope{db.GlobalScope, bob}, []string{"bob", "global"}},
+		{[]db.Scope{db.GlobalScope}, []string{"global"}},
+		{[]db.Scope{}, []string{}},
+		{nil, []string{"alice", "bob", "team", "global"}},
+	}
+	for _, tc := range tests {
+		matches := find(t, ctx, emb, 0, db.FindOptions{Count: 10, Scopes: tc.scopes})
+		if !equal(contents(matches), tc.want) {
+			t.Errorf("Scopes %v: expected %v, got %v", tc.scopes, tc.want, contents(matches))
+		}
+	}
+}
+
+func testDelete(t *testing.T, ctx context.Context, emb db.EmbeddingsDB) {
+	keep := add(t, ctx, emb, db.GlobalScope, "keep", 10)
+	forget := add(t, ctx, emb, db.GlobalScope, "forget", 0)
+
+	if err := emb.Delete(ctx, forget); err != nil {
+		t.Fatal(err)
+	}
+	matches := find(t, ctx, emb, 0, db.FindOptions{Count: 10})
+	if len(matches) != 1 || matches[0].ID != keep {
+		t.Errorf("Expected only the kept memory, got %#v", matches)
+	}
+	if err := emb.Delete(ctx, forget); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound deleting twice, got %v", err)
+	}
+}
+
+func testUpdate(t *testing.T, ctx context.Context, emb db.EmbeddingsDB) {
+	id, err := emb.Add(ctx, 7, "slack:U1", db.ChannelScope("slack:C1"), "old text", Vector(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	add(t, ctx, emb, db.GlobalScope, "other", 45)
+
+	if err := emb.Update(ctx, id, "new text", Vector(90)); err != nil {
+		t.Fatal(err)
+	}
+	matches := find(t, ctx, emb, 90, db.FindOptions{Count: 1})
+	if len(matches) != 1 {
+		t.Fatalf("Expected the updated memory, got %#v", matches)
+	}
+	m := matches[0]
+	if m.ID != id || m.Content != "new text" || m.Author != 7 || m.Owner != "slack:U1" || m.Scope != db.ChannelScope("slack:C1") {
+		t.Errorf("Expected new text with the old metadata, got %#v", m)
+	}
+	if math.Abs(float64(m.Similarity)-1) > 1e-4 {
+		t.Errorf("Expected the new embedding to be searched, got similarity %v", m.Similarity)
+	}
+	if err := emb.Update(ctx, id+1000, "missing", Vector(0)); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound updating a missing memory, got %v", err)
+	}
+}
+
+func testList(t *testing.T, ctx context.Context, emb db.EmbeddingsDB) {
+	for i := 0; i < 5; i++ {
+		add(t, ctx, emb, db.GlobalScope, fmt.Sprint(i), float64(i))
+	}
+	add(t, ctx, emb, db.UserScope("slack:U1"), "private", 0)
+
+	var pages [][]string
+	var after int64
+	for {
+		page, err := emb.List(ctx, db.ListOptions{AfterID: after, Limit: 2, Scopes: []db.Scope{db.GlobalScope}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		pages = append(pages, contents(page))
+		after = page[len(page)-1].ID
+		if len(pages) > 5 {
+			t.Fatal("List never ran out of pages")
+		}
+	}
+	if len(pages) != 3 || !equal(pages[0], []string{"0", "1"}) || !equal(pages[1], []string{"2", "3"}) || !equal(pages[2], []string{"4"}) {
+		t.Errorf("Expected pages [0 1] [2 3] [4], got %v", pages)
+	}
+
+	all, err := emb.List(ctx, db.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equal(contents(all), []string{"0", "1", "2", "3", "4", "private"}) {
+		t.Errorf("Expected every memory in id order, got %v", contents(all))
+	}
+	if all[5].Owner != "" || all[5].Scope != db.UserScope("slack:U1") || all[5].Created.IsZero() {
+		t.Errorf("Expected the memory's metadata, got %#v", all[5])
+	}
+}
+
+func testConcurrent(t *testing.T, ctx context.Context, emb db.EmbeddingsDB) {
+	const workers, each = 8, 10
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*each*2)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < each; i++ {
+				if _, err := emb.Add(ctx, int64(w), "", db.GlobalScope, fmt.Sprintf("%d-%d", w, i), Vector(float64(w*each+i))); err != nil {
+					errs <- err
+				}
+				if _, err := emb.Find(ctx, Vector(float64(i)), db.FindOptions{Count: 3}); err != nil {
+					errs <- err
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	matches := find(t, ctx, emb, 0, db.FindOptions{Count: workers * each * 2})
+	if len(matches) != workers*each {
+		t.Errorf("Expected %d memories, got %d", workers*each, len(matches))
+	}
+	seen := map[int64]bool{}
+	for _, m := range matches {
+		if seen[m.ID] {
+			t.Errorf("Duplicate id %d", m.ID)
+		}
+		seen[m.ID] = true
+	}
+}
+
+func testHybrid(t *testing.T, ctx context.Context, emb db.EmbeddingsDB) {
+	add(t, ctx, emb, db.GlobalScope, "Deploys happen on Tuesdays", 5)
+	add(t, ctx, emb, db.GlobalScope, "Lunch is served at noon", 10)
+	add(t, ctx, emb, db.GlobalScope, "Parking is in the garage", 15)
+	add(t, ctx, emb, db.GlobalScope, "The runbook for INC-4821 is in the wiki", 80)
+	add(t, ctx, emb, db.ChannelScope("slack:C1"), "INC-4821 was caused by a full disk", 85)
+
+	query := "Any news on INC-4821?"
+	opts := db.FindOptions{Count: 2, Scopes: []db.Scope{db.GlobalScope}, Query: query}
+	if got := contents(find(t, ctx, emb, 0, opts)); !equal(got, []string{"Deploys happen on Tuesdays", "Lunch is served at noon"}) {
+		t.Errorf("Expected vector search to miss the ticket, got %v", got)
+	}
+
+	// The exact ticket number is found even though it isn't similar, and
+	// still only in the visible scopes.
+	opts.Mode = db.HybridSearch
+	if got := contents(find(t, ctx, emb, 0, opts)); !equal(got, []string{"The runbook for INC-4821 is in the wiki", "Deploys happen on Tuesdays"}) {
+		t.Errorf("Expected hybrid search to fuse the keyword match, got %v", got)
+	}
+
+	opts.Query = ""
+	if got := contents(find(t, ctx, emb, 0, opts)); !equal(got, []string{"Deploys happen on Tuesdays", "Lunch is served at noon"}) {
+		t.Errorf("Expected hybrid search without words to rank by similarity, got %v", got)
+	}
+}
+
+func testDiversity(t *testing.T, ctx context.Context, emb db.EmbeddingsDB) {
+	add(t, ctx, emb, db.GlobalScope, "a", 10)
+	add(t, ctx, emb, db.GlobalScope, "almost a", 12)
+	add(t, ctx, emb, db.GlobalScope, "b", -15)
+
+	opts := db.FindOptions{Count: 2}
+	if got := contents(find(t, ctx, emb, 0, opts)); !equal(got, []string{"a", "almost a"}) {
+		t.Errorf("Expected the two closest, got %v", got)
+	}
+	opts.Diversity = 0.5
+	if got := contents(find(t, ctx, emb, 0, opts)); !equal(got, []string{"a", "b"}) {
+		t.Errorf("Expected the near duplicate to be skipped, got %v", got)
+	}
+}
@@ -0,0 +1,142 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	pgx "github.com/jackc/pgx/v5"
+	"github.com/pgvector/pgvector-go"
+)
+
+// A file ingested into the memory, its chunks are stored as memories with the
+// document's URI as their source.
+type Document struct {
+	ID    int64
+	URI   string
+	Title string
+	// Hex SHA-256 of the file's content
+	Hash     string
+	Modified time.Time
+	Ingested time.Time
+}
+
+// Part of a document and its embeddings.
+type Chunk struct {
+	Content   string
+	Embedding []float32
+}
+
+// Embeddings databases that can also store documents.
+type DocumentsDB interface {
+	EmbeddingsDB
+	// Returns the document with uri, or ErrNotFound
+	Document(ctx context.Context, uri string) (*Document, error)
+	// Returns every document ordered by uri
+	Documents(ctx context.Context) ([]Document, error)
+	// Stores the document, replacing it and all of its chunks if the uri
+	// already exists.  Chunks are numbered in order, returns the document id.
+	PutDocument(ctx context.Context, doc Document, author int64, scope Scope, chunks []Chunk) (int64, error)
+	// Returns the document's chunks in order, or none if it doesn't exist
+	Chunks(ctx context.Context, uri string) ([]Chunk, error)
+	// Removes the document and its chunks, or returns ErrNotFound
+	DeleteDocument(ctx context.Context, uri string) error
+}
+
+func (emb *PostgresDatabase) Document(ctx context.Context, uri string) (*Document, error) {
+	sql := `SELECT id, uri, title, hash, modified, ingested FROM documents WHERE uri = $1;`
+	doc := &Document{}
+	err := emb.pool.QueryRow(ctx, sql, uri).Scan(&doc.ID, &doc.URI, &doc.Title, &doc.Hash, &doc.Modified, &doc.Ingested)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func (emb *PostgresDatabase) Documents(ctx context.Context) ([]Document, error) {
+	rows, err := emb.pool.Query(ctx, `SELECT id, uri, title, hash, modified, ingested FROM documents ORDER BY uri;`)
+	if err != nil {
+		return nil, err
+	}
+	docs := make([]Document, 0)
+	var doc Document
+	_, err = pgx.ForEachRow(rows, []any{&doc.ID, &doc.URI, &doc.Title, &doc.Hash, &doc.Modified, &doc.Ingested}, func() error {
+		docs = append(docs, doc)
+		return nil
+	})
+	return docs, err
+}
+
+func (emb *PostgresDatabase) PutDocument(ctx context.Context, doc Document, author int64, scope Scope, chunks []Chunk) (int64, error) {
+	if scope == "" {
+		scope = GlobalScope
+	}
+	var id int64
+	err := pgx.BeginFunc(ctx, emb.pool, func(tx pgx.Tx) error {
+		sql := `
+INSERT INTO documents(
+	uri, title, hash, modified, ingested
+) VALUES(
+	$1, $2, $3, $4, NOW()
+) ON CONFLICT (uri) DO UPDATE SET
+	title = EXCLUDED.title,
+	hash = EXCLUDED.hash,
+	modified = EXCLUDED.modified,
+	ingested = EXCLUDED.ingested
+RETURNING id;`
+		if err := tx.QueryRow(ctx, sql, doc.URI, doc.Title, doc.Hash, doc.Modified).Scan(&id); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `DELETE FROM embeddings WHERE document_id = $1;`, id); err != nil {
+			return err
+		}
+
+		sql = `
+INSERT INTO embeddings(
+	content, tokens, author, scope, created, source, chunk, document_id, embedding
+) VALUES(
+	$1, 0, $2, $3, NOW(), $4, $5, $6, $7
+);`
+		batch := &pgx.Batch{}
+		for i, c := range chunks {
+			batch.Queue(sql, c.Content, author, string(scope), doc.URI, i, id, pgvector.NewVector(c.Embedding))
+		}
+		return tx.SendBatch(ctx, batch).Close()
+	})
+	return id, err
+}
+
+func (emb *PostgresDatabase) Chunks(ctx context.Context, uri string) ([]Chunk, error) {
+	sql := `
+SELECT e.content, e.embedding FROM embeddings e
+JOIN documents d ON e.document_id = d.id
+WHERE d.uri = $1
+ORDER BY e.chunk;`
+	rows, err := emb.pool.Query(ctx, sql, uri)
+	if err != nil {
+		return nil, err
+	}
+	chunks := make([]Chunk, 0)
+	var content string
+	var embedding pgvector.Vector
+	_, err = pgx.ForEachRow(rows, []any{&content, &embedding}, func() error {
+		chunks = append(chunks, Chunk{Content: content, Embedding: embedding.Slice()})
+		return nil
+	})
+	return chunks, err
+}
+
+func (emb *PostgresDatabase) DeleteDocument(ctx context.Context, uri string) error {
+	// Chunks are removed by ON DELETE CASCADE.
+	tag, err := emb.pool.Exec(ctx, `DELETE FROM documents WHERE uri = $1;`, uri)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// How the in-memory database ranks memories.
+type Metric string
+
+const (
+	Cosine     Metric = "cosine"
+	DotProduct Metric = "dot"
+	L2         Metric = "l2"
+)
+
+func ParseMetric(s string) (Metric, error) {
+	switch m := Metric(s); m {
+	case "":
+		return Cosine, nil
+	case Cosine, DotProduct, L2:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown metric '%s', expected cosine, dot or l2", s)
+	}
+}
+
+// Returns a score for b against a query a, higher is closer.
+func (m Metric) score(a, b []float32) float64 {
+	switch m {
+	case DotProduct:
+		var dot float64
+		for i := 0; i < len(a) && i < len(b); i++ {
+			dot += float64(a[i]) * float64(b[i])
+		}
+		return dot
+	case L2:
+		var sum float64
+		for i := 0; i < len(a) && i < len(b); i++ {
+			d := float64(a[i]) - float64(b[i])
+			sum += d * d
+		}
+		return -math.Sqrt(sum)
+	default:
+		return float64(CosineSimilarity(a, b))
+	}
+}
+
+// A memory stored by MemoryDatabase, as saved in the JSON file.
+type memoryRecord struct {
+	ID        int64     `json:"id"`
+	Content   string    `json:"content"`
+	Author    int64     `json:"author"`
+	Owner     string    `json:"owner,omitempty"`
+	Scope     Scope     `json:"scope"`
+	Created   time.Time `json:"created"`
+	Source    string    `json:"source,omitempty"`
+	Chunk     int       `json:"chunk,omitempty"`
+	Embedding []float32 `json:"embedding"`
+}
+
+func (m memoryRecord) match() Match {
+	return Match{
+		ID:      m.ID,
+		Content: m.Content,
+		Author:  m.Author,
+		Owner:   m.Owner,
+		Scope:   m.Scope,
+		Created: m.Created,
+		Source:  m.Source,
+		Chunk:   m.Chunk,
+	}
+}
+
+// Returns the set of scopes, nil if every scope is visible.
+func visibleScopes(scopes []Scope) map[Scope]bool {
+	if scopes == nil {
+		return nil
+	}
+	visible := make(map[Scope]bool, len(scopes))
+	for _, s := range scopes {
+		visible[s] = true
+	}
+	return visible
+}
+
+// Embeddings database held in memory and searched by brute force, for
+// development and tests.  If path is set the memories are loaded from and
+// saved to a JSON file.
+type MemoryDatabase struct {
+	mu       sync.RWMutex
+	metric   Metric
+	path     string
+	nextID   int64
+	memories []memoryRecord
+}
+
+// Creates an in-memory database ranking with metric, loading the memories
+// in path if it exists.  An empty path keeps nothing once closed.
+func NewMemoryDatabase(metric Metric, path string) (*MemoryDatabase, error) {
+	if metric == "" {
+		metric = Cosine
+	}
+	emb := &MemoryDatabase{metric: metric, path: path, nextID: 1}
+	if path == "" {
+		return emb, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return emb, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &emb.memories); err != nil {
+		return nil, fmt.Errorf("unable to load memories from %s: %w", path, err)
+	}
+	for _, m := range emb.memories {
+		if m.ID >= emb.nextID {
+			emb.nextID = m.ID + 1
+		}
+	}
+	return emb, nil
+}
+
+func (emb *MemoryDatabase) Add(ctx context.Context, author int64, owner string, scope Scope, text string, embeddings []float32) (int64, error) {
+	if scope == "" {
+		scope = GlobalScope
+	}
+	emb.mu.Lock()
+	defer emb.mu.Unlock()
+	id := emb.nextID
+	// Appending only writes past the current length, readers don't see the
+	// new memory until it is saved.
+	memories := append(emb.memories, memoryRecord{
+		ID:        id,
+		Content:   text,
+		Author:    author,
+		Owner:     owner,
+		Scope:     scope,
+		Created:   time.Now(),
+		Embedding: append([]float32(nil), embeddings...),
+	})
+	if err := emb.save(memories); err != nil {
+		return 0, err
+	}
+	emb.memories = memories
+	emb.nextID++
+	return id, nil
+}
+
+func (emb *MemoryDatabase) Find(ctx context.Context, embedding []float32, opts FindOptions) ([]Match, error) {
+	visible := visibleScopes(opts.Scopes)
+	emb.mu.RLock()
+	candidates := make([]candidate, 0)
+	for _, m := range emb.memories {
+		if visible != nil && !visible[m.Scope] {
+			continue
+		}
+		match := m.match()
+		match.Similarity = CosineSimilarity(embedding, m.Embedding)
+		candidates = append(candidates, candidate{
+			match:     match,
+			embedding: m.Embedding,
+			score:     emb.metric.score(embedding, m.Embedding),
+		})
+	}
+	emb.mu.RUnlock()
+	return rank(candidates, opts), nil
+}
+
+// Returns the index of the memory with id, callers hold the lock.
+func (emb *MemoryDatabase) index(id int64) int {
+	// Memories are appended with increasing ids.
+	i := sort.Search(len(emb.memories), func(i int) bool {
+		return emb.memories[i].ID >= id
+	})
+	if i < len(emb.memories) && emb.memories[i].ID == id {
+		return i
+	}
+	return -1
+}
+
+func (emb *MemoryDatabase) Delete(ctx context.Context, id int64) error {
+	emb.mu.Lock()
+	defer emb.mu.Unlock()
+	i := emb.index(id)
+	if i < 0 {
+		return ErrNotFound
+	}
+	memories := make([]memoryRecord, 0, len(emb.memories)-1)
+	memories = append(memories, emb.memories[:i]...)
+	memories = append(memories, emb.memories[i+1:]...)
+	if err := emb.save(memories); err != nil {
+		return err
+	}
+	emb.memories = memories
+	return nil
+}
+
+func (emb *MemoryDatabase) Update(ctx context.Context, id int64, text string, embeddings []float32) error {
+	emb.mu.Lock()
+	defer emb.mu.Unlock()
+	i := emb.index(id)
+	if i < 0 {
+		return ErrNotFound
+	}
+	memories := slices.Clone(emb.memories)
+	memories[i].Content = text
+	memories[i].Embedding = append([]float32(nil), embeddings...)
+	if err := emb.save(memories); err != nil {
+		return err
+	}
+	emb.memories = memories
+	return nil
+}
+
+func (emb *MemoryDatabase) List(ctx context.Context, opts ListOptions) ([]Match, error) {
+	visible := visibleScopes(opts.Scopes)
+	emb.mu.RLock()
+	defer emb.mu.RUnlock()
+	results := make([]Match, 0)
+	for _, m := range emb.memories {
+		if opts.Limit > 0 && len(results) == opts.Limit {
+			break
+		}
+		if m.ID <= opts.AfterID || (visible != nil && !visible[m.Scope]) {
+			continue
+		}
+		results = append(results, m.match())
+	}
+	return results, nil
+}
+
+func (emb *MemoryDatabase) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (emb *MemoryDatabase) Close() {}
+
+// Writes memories to path, callers hold the lock and only replace
+// emb.memories once this succeeds so a failed write changes nothing.
+func (emb *MemoryDatabase) save(memories []memoryRecord) error {
+	if emb.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(memories)
+	if err != nil {
+		return err
+	}
+	// Write then rename so a crash never leaves a truncated file.
+	tmp, err := os.CreateTemp(filepath.Dir(emb.path), filepath.Base(emb.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), emb.path)
+}
@@ -0,0 +1,125 @@
+package db
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMemoryDatabase(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		metric Metric
+		// Closest memory to the query {1, 0}
+		want string
+	}{
+		// Cosine and L2 prefer the short vector pointing the same way, dot
+		// product prefers the long one.
+		{Cosine, "east"},
+		{L2, "east"},
+		{DotProduct, "far north east"},
+	}
+	for _, tc := range tests {
+		emb, err := NewMemoryDatabase(tc.metric, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		emb.Add(ctx, 0, "", GlobalScope, "east", []float32{1, 0})
+		emb.Add(ctx, 0, "", GlobalScope, "far north east", []float32{10, 10})
+		emb.Add(ctx, 0, "", GlobalScope, "west", []float32{-1, 0})
+
+		matches, err := emb.Find(ctx, []float32{1, 0}, FindOptions{Count: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(matches) != 2 || matches[0].Content != tc.want {
+			t.Errorf("%s: expected %s first, got %#v", tc.metric, tc.want, matches)
+		}
+	}
+}
+
+func TestMemoryDatabaseFilters(t *testing.T) {
+	ctx := context.Background()
+	emb, _ := NewMemoryDatabase(Cosine, "")
+	emb.Add(ctx, 0, "slack:U1", UserScope("slack:U1"), "private", []float32{1, 0})
+	emb.Add(ctx, 0, "", GlobalScope, "public", []float32{1, 0.1})
+	emb.Add(ctx, 0, "", GlobalScope, "unrelated", []float32{0, 1})
+
+	matches, _ := emb.Find(ctx, []float32{1, 0}, FindOptions{Count: 10, Scopes: []Scope{GlobalScope}, MinSimilarity: 0.5})
+	if len(matches) != 1 || matches[0].Content != "public" {
+		t.Errorf("Expected only the similar public memory, got %#v", matches)
+	}
+
+	matches, _ = emb.Find(ctx, []float32{1, 0}, FindOptions{Count: 10})
+	if len(matches) != 3 || matches[0].Content != "private" || matches[0].Similarity != 1 {
+		t.Errorf("Expected every memory without scopes, got %#v", matches)
+	}
+}
+
+func TestMemoryDatabasePersists(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "memories.json")
+	emb, err := NewMemoryDatabase(Cosine, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := emb.Add(ctx, 7, "", GlobalScope, "remember me", []float32{0, 1}); err != nil {
+		t.Fatal(err)
+	}
+	emb.Close()
+
+	emb, err = NewMemoryDatabase(Cosine, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	matches, _ := emb.Find(ctx, []float32{0, 1}, FindOptions{Count: 1})
+	if len(matches) != 1 || matches[0].Content != "remember me" || matches[0].Author != 7 {
+		t.Fatalf("Expected the saved memory, got %#v", matches)
+	}
+	id, _ := emb.Add(ctx, 0, "", GlobalScope, "another", []float32{1, 0})
+	if id != matches[0].ID+1 {
+		t.Errorf("Expected ids to carry on from the file, got %d after %d", id, matches[0].ID)
+	}
+}
+
+func TestMemoryDatabaseFailedSave(t *testing.T) {
+	ctx := context.Background()
+	dir := filepath.Join(t.TempDir(), "memories")
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	emb, err := NewMemoryDatabase(Cosine, filepath.Join(dir, "memories.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := emb.Add(ctx, 0, "", GlobalScope, "kept", []float32{1, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Saving fails once the directory is gone.
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := emb.Add(ctx, 0, "", GlobalScope, "lost", []float32{0, 1}); err == nil {
+		t.Error("Expected Add to fail")
+	}
+	if err := emb.Update(ctx, id, "changed", []float32{0, 1}); err == nil {
+		t.Error("Expected Update to fail")
+	}
+	if err := emb.Delete(ctx, id); err == nil {
+		t.Error("Expected Delete to fail")
+	}
+
+	matches, _ := emb.List(ctx, ListOptions{})
+	if len(matches) != 1 || matches[0].ID != id || matches[0].Content != "kept" {
+		t.Errorf("Expected failed saves to leave the memories alone, got %#v", matches)
+	}
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if next, err := emb.Add(ctx, 0, "", GlobalScope, "next", []float32{0, 1}); err != nil || next != id+1 {
+		t.Errorf("Expected the failed add not to use up an id, got %d %v", next, err)
+	}
+}
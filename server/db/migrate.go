@@ -0,0 +1,49 @@
+package db
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rcleveng/assistant/server/db/migrations"
+	"github.com/rcleveng/assistant/server/env"
+)
+
+// Returns a migrator for the environment's database backend, call close when
+// done with it.
+func NewMigrator(ctx context.Context, env *env.Environment) (migrator *migrations.Migrator, close func(), err error) {
+	switch backend := Backend(env); backend {
+	case PostgresBackend:
+		all, err := migrations.Postgres()
+		if err != nil {
+			return nil, nil, err
+		}
+		pool, err := NewPostgresPool(ctx, env)
+		if err != nil {
+			return nil, nil, err
+		}
+		return migrations.NewMigrator(migrations.NewPostgresDriver(pool), all), pool.Close, nil
+	case SQLiteBackend:
+		all, err := migrations.SQLite()
+		if err != nil {
+			return nil, nil, err
+		}
+		sqldb, err := openSQLite(SQLitePath(env))
+		if err != nil {
+			return nil, nil, err
+		}
+		return migrations.NewMigrator(migrations.NewSQLiteDriver(sqldb), all), func() { sqldb.Close() }, nil
+	default:
+		return nil, nil, fmt.Errorf("the %s backend has no schema to migrate", backend)
+	}
+}
+
+// Applies any outstanding migrations to the environment's database.
+func Migrate(ctx context.Context, env *env.Environment) error {
+	migrator, close, err := NewMigrator(ctx, env)
+	if err != nil {
+		return err
+	}
+	defer close()
+	_, err = migrator.Up(ctx)
+	return err
+}
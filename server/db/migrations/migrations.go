@@ -0,0 +1,184 @@
+// Versioned SQL migrations embedded in the binary.
+//
+// Migrations live in a directory per database as NNNN_name.up.sql and
+// NNNN_name.down.sql, and the versions applied so far are recorded in the
+// schema_migrations table.  A migration without a down file can't be
+// reverted, such as one that adopts a table created before migrations.
+package migrations
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+//go:embed postgres/*.sql
+var postgres embed.FS
+
+//go:embed sqlite/*.sql
+var sqlite embed.FS
+
+// Returns the migrations for postgres.
+func Postgres() ([]Migration, error) {
+	return Load(postgres, "postgres")
+}
+
+// Returns the migrations for SQLite.
+func SQLite() ([]Migration, error) {
+	return Load(sqlite, "sqlite")
+}
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Database specific parts of running migrations.
+type Driver interface {
+	// Creates the schema_migrations table if it doesn't exist
+	Init(ctx context.Context) error
+	// Returns when each applied version was applied
+	Applied(ctx context.Context) (map[int]time.Time, error)
+	// Runs the up or down SQL for the migration and records or removes its
+	// version, in a single transaction.
+	Apply(ctx context.Context, m Migration, up bool) error
+}
+
+// Whether a migration has been applied.
+type Status struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+var migrationFile = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+// Loads the migrations in dir, sorted by version.  Every migration needs an
+// up file, down files are optional.
+func Load(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int]*Migration{}
+	for _, e := range entries {
+		match := migrationFile.FindStringSubmatch(e.Name())
+		if e.IsDir() || match == nil {
+			continue
+		}
+		version, err := strconv.Atoi(match[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version '%s': %w", e.Name(), err)
+		}
+		sql, err := fs.ReadFile(fsys, path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		m, found := byVersion[version]
+		if !found {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has two names: '%s' and '%s'", version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.Up = string(sql)
+		} else {
+			m.Down = string(sql)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+type Migrator struct {
+	driver     Driver
+	migrations []Migration
+}
+
+func NewMigrator(driver Driver, migrations []Migration) *Migrator {
+	return &Migrator{driver: driver, migrations: migrations}
+}
+
+// Returns the status of every known migration, in version order.
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	if err := m.driver.Init(ctx); err != nil {
+		return nil, err
+	}
+	applied, err := m.driver.Applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	status := make([]Status, 0, len(m.migrations))
+	for _, mig := range m.migrations {
+		at, found := applied[mig.Version]
+		status = append(status, Status{Migration: mig, Applied: found, AppliedAt: at})
+	}
+	return status, nil
+}
+
+// Applies every migration that hasn't been applied yet, returns the ones
+// that were applied.
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	status, err := m.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+	done := make([]Migration, 0)
+	for _, s := range status {
+		if s.Applied {
+			continue
+		}
+		slog.InfoContext(ctx, "applying migration", "version", s.Version, "name", s.Name)
+		if err := m.driver.Apply(ctx, s.Migration, true); err != nil {
+			return done, fmt.Errorf("migration %d_%s failed: %w", s.Version, s.Name, err)
+		}
+		done = append(done, s.Migration)
+	}
+	return done, nil
+}
+
+// Reverts the newest steps applied migrations, returns the ones that were
+// reverted.
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	status, err := m.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+	done := make([]Migration, 0)
+	for i := len(status) - 1; i >= 0 && len(done) < steps; i-- {
+		s := status[i]
+		if !s.Applied {
+			continue
+		}
+		if s.Down == "" {
+			return done, fmt.Errorf("migration %d_%s can't be reverted, it has no down file", s.Version, s.Name)
+		}
+		slog.InfoContext(ctx, "reverting migration", "version", s.Version, "name", s.Name)
+		if err := m.driver.Apply(ctx, s.Migration, false); err != nil {
+			return done, fmt.Errorf("reverting migration %d_%s failed: %w", s.Version, s.Name, err)
+		}
+		done = append(done, s.Migration)
+	}
+	return done, nil
+}
@@ -0,0 +1,158 @@
+package migrations
+
+import (
+	"context"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// Records applied versions in memory.
+type testDriver struct {
+	applied map[int]time.Time
+	ran     []string
+}
+
+func (d *testDriver) Init(ctx context.Context) error {
+	if d.applied == nil {
+		d.applied = map[int]time.Time{}
+	}
+	return nil
+}
+
+func (d *testDriver) Applied(ctx context.Context) (map[int]time.Time, error) {
+	return d.applied, nil
+}
+
+func (d *testDriver) Apply(ctx context.Context, m Migration, up bool) error {
+	if up {
+		d.ran = append(d.ran, m.Up)
+		d.applied[m.Version] = time.Now()
+	} else {
+		d.ran = append(d.ran, m.Down)
+		delete(d.applied, m.Version)
+	}
+	return nil
+}
+
+func TestLoadEmbedded(t *testing.T) {
+	// Versions adopting tables from before migrations, which mustn't be
+	// dropped.
+	irreversible := map[string]map[int]bool{"postgres": {1: true}}
+	for name, load := range map[string]func() ([]Migration, error){
+		"postgres": Postgres,
+		"sqlite":   SQLite,
+	} {
+		migrations, err := load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(migrations) == 0 {
+			t.Fatalf("Expected embedded %s migrations", name)
+		}
+		for i, m := range migrations {
+			if m.Version != i+1 {
+				t.Errorf("%s: expected version %d, got %d_%s", name, i+1, m.Version, m.Name)
+			}
+			if m.Up == "" || (m.Down == "") != irreversible[name][m.Version] {
+				t.Errorf("%s: expected up SQL and down SQL unless irreversible for %d_%s", name, m.Version, m.Name)
+			}
+		}
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := map[string]fstest.MapFS{
+		"missing up": {
+			"m/0001_a.down.sql": {Data: []byte("DROP TABLE a;")},
+		},
+		"two names": {
+			"m/0001_a.up.sql":   {Data: []byte("CREATE TABLE a();")},
+			"m/0001_b.down.sql": {Data: []byte("DROP TABLE a;")},
+		},
+	}
+	for name, fsys := range tests {
+		if _, err := Load(fsys, "m"); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestMigrator(t *testing.T) {
+	ctx := context.Background()
+	fsys := fstest.MapFS{
+		"m/0002_b.up.sql":   {Data: []byte("up b")},
+		"m/0002_b.down.sql": {Data: []byte("down b")},
+		"m/0001_a.up.sql":   {Data: []byte("up a")},
+		"m/0001_a.down.sql": {Data: []byte("down a")},
+		"m/README.md":       {Data: []byte("ignored")},
+	}
+	migrations, err := Load(fsys, "m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	driver := &testDriver{}
+	migrator := NewMigrator(driver, migrations)
+
+	done, err := migrator.Up(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != 2 || done[0].Name != "a" || done[1].Name != "b" {
+		t.Errorf("Expected a and b to be applied in order, got %#v", done)
+	}
+	if done, _ := migrator.Up(ctx); len(done) != 0 {
+		t.Errorf("Expected nothing left to apply, got %#v", done)
+	}
+
+	done, err = migrator.Down(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != 1 || done[0].Name != "b" {
+		t.Errorf("Expected b to be reverted, got %#v", done)
+	}
+
+	status, err := migrator.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status) != 2 || !status[0].Applied || status[1].Applied {
+		t.Errorf("Expected only a to be applied, got %#v", status)
+	}
+
+	want := []string{"up a", "up b", "down b"}
+	if len(driver.ran) != len(want) {
+		t.Fatalf("Expected %v to run, got %v", want, driver.ran)
+	}
+	for i := range want {
+		if driver.ran[i] != want[i] {
+			t.Errorf("Expected %v to run, got %v", want, driver.ran)
+		}
+	}
+}
+
+func TestMigratorIrreversible(t *testing.T) {
+	ctx := context.Background()
+	migrations, err := Load(fstest.MapFS{
+		"m/0001_a.up.sql":   {Data: []byte("up a")},
+		"m/0002_b.up.sql":   {Data: []byte("up b")},
+		"m/0002_b.down.sql": {Data: []byte("down b")},
+	}, "m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	driver := &testDriver{}
+	migrator := NewMigrator(driver, migrations)
+	if _, err := migrator.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	done, err := migrator.Down(ctx, 2)
+	if err == nil || len(done) != 1 || done[0].Name != "b" {
+		t.Errorf("Expected only b to be reverted, got %#v and %v", done, err)
+	}
+	if _, ok := driver.applied[1]; !ok {
+		t.Error("Expected a to stay applied")
+	}
+}
@@ -0,0 +1,80 @@
+package migrations
+
+import (
+	"context"
+	"time"
+
+	pgx "github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Arbitrary key for the advisory lock that stops two servers starting at the
+// same time from applying the same migration.
+const postgresLockKey = 7242914160118571
+
+type PostgresDriver struct {
+	pool *pgxpool.Pool
+}
+
+func NewPostgresDriver(pool *pgxpool.Pool) *PostgresDriver {
+	return &PostgresDriver{pool: pool}
+}
+
+func (d *PostgresDriver) Init(ctx context.Context) error {
+	sql := `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+	version integer PRIMARY KEY,
+	name text NOT NULL,
+	applied timestamptz NOT NULL DEFAULT NOW()
+);`
+	_, err := d.pool.Exec(ctx, sql)
+	return err
+}
+
+func (d *PostgresDriver) Applied(ctx context.Context) (map[int]time.Time, error) {
+	rows, err := d.pool.Query(ctx, `SELECT version, applied FROM schema_migrations;`)
+	if err != nil {
+		return nil, err
+	}
+	applied := map[int]time.Time{}
+	var version int
+	var at time.Time
+	_, err = pgx.ForEachRow(rows, []any{&version, &at}, func() error {
+		applied[version] = at
+		return nil
+	})
+	return applied, err
+}
+
+func (d *PostgresDriver) Apply(ctx context.Context, m Migration, up bool) error {
+	return pgx.BeginFunc(ctx, d.pool, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1);`, postgresLockKey); err != nil {
+			return err
+		}
+		// Another server may have got here first while we waited on the lock.
+		var applied bool
+		err := tx.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM schema_migrations WHERE version = $1);`, m.Version).Scan(&applied)
+		if err != nil {
+			return err
+		}
+		if applied == up {
+			return nil
+		}
+
+		sql := m.Down
+		if up {
+			sql = m.Up
+		}
+		// Without arguments pgx uses the simple protocol, which allows
+		// several statements in one file.
+		if _, err := tx.Exec(ctx, sql); err != nil {
+			return err
+		}
+		if up {
+			_, err = tx.Exec(ctx, `INSERT INTO schema_migrations(version, name) VALUES($1, $2);`, m.Version, m.Name)
+		} else {
+			_, err = tx.Exec(ctx, `DELETE FROM schema_migrations WHERE version = $1;`, m.Version)
+		}
+		return err
+	})
+}
@@ -0,0 +1,12 @@
+CREATE EXTENSION IF NOT EXISTS vector;
+
+-- Databases created before migrations existed already have this table, so
+-- there is no down migration, reverting it would drop their memories.
+CREATE TABLE IF NOT EXISTS embeddings (
+	id bigserial PRIMARY KEY,
+	content text NOT NULL,
+	tokens integer NOT NULL DEFAULT 0,
+	author bigint,
+	created timestamptz NOT NULL DEFAULT NOW(),
+	embedding vector(768) NOT NULL
+);
@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS embeddings_scope_idx;
+
+ALTER TABLE embeddings
+	DROP COLUMN IF EXISTS owner,
+	DROP COLUMN IF EXISTS scope,
+	DROP COLUMN IF EXISTS source,
+	DROP COLUMN IF EXISTS chunk;
@@ -0,0 +1,7 @@
+ALTER TABLE embeddings
+	ADD COLUMN IF NOT EXISTS owner text,
+	ADD COLUMN IF NOT EXISTS scope text NOT NULL DEFAULT 'global',
+	ADD COLUMN IF NOT EXISTS source text,
+	ADD COLUMN IF NOT EXISTS chunk integer;
+
+CREATE INDEX IF NOT EXISTS embeddings_scope_idx ON embeddings (scope);
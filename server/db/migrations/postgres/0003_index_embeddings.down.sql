@@ -0,0 +1 @@
+DROP INDEX IF EXISTS embeddings_embedding_idx;
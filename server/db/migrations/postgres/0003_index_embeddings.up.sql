@@ -0,0 +1,3 @@
+-- Approximate nearest neighbour index for cosine distance (<=>).
+CREATE INDEX IF NOT EXISTS embeddings_embedding_idx ON embeddings
+	USING hnsw (embedding vector_cosine_ops);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS session_pending;
+DROP TABLE IF EXISTS session_turns;
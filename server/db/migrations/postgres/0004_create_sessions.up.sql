@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS session_turns (
+	id bigserial PRIMARY KEY,
+	session_id text NOT NULL,
+	role text NOT NULL,
+	text text NOT NULL,
+	created timestamptz NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS session_turns_session_idx ON session_turns (session_id, id);
+
+CREATE TABLE IF NOT EXISTS session_pending (
+	session_id text PRIMARY KEY,
+	question text NOT NULL,
+	answers text[] NOT NULL DEFAULT '{}',
+	rounds integer NOT NULL DEFAULT 0,
+	updated timestamptz NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS embeddings_document_idx;
+
+ALTER TABLE embeddings DROP COLUMN IF EXISTS document_id;
+
+DROP TABLE IF EXISTS documents;
@@ -0,0 +1,14 @@
+-- Files ingested with embed ingest, their chunks are rows in embeddings.
+CREATE TABLE IF NOT EXISTS documents (
+	id bigserial PRIMARY KEY,
+	uri text NOT NULL UNIQUE,
+	title text NOT NULL DEFAULT '',
+	hash text NOT NULL,
+	modified timestamptz NOT NULL,
+	ingested timestamptz NOT NULL DEFAULT NOW()
+);
+
+ALTER TABLE embeddings
+	ADD COLUMN IF NOT EXISTS document_id bigint REFERENCES documents(id) ON DELETE CASCADE;
+
+CREATE INDEX IF NOT EXISTS embeddings_document_idx ON embeddings (document_id);
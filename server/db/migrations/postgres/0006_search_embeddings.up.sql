@@ -0,0 +1,6 @@
+-- Full text search over memories for hybrid retrieval.
+ALTER TABLE embeddings
+	ADD COLUMN IF NOT EXISTS content_tsv tsvector
+	GENERATED ALWAYS AS (to_tsvector('english', content)) STORED;
+
+CREATE INDEX IF NOT EXISTS embeddings_content_tsv_idx ON embeddings USING gin (content_tsv);
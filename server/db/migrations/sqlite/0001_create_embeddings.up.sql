@@ -0,0 +1,15 @@
+-- Embeddings are little endian float32 blobs, created is unix milliseconds.
+CREATE TABLE IF NOT EXISTS embeddings (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	content TEXT NOT NULL,
+	tokens INTEGER NOT NULL DEFAULT 0,
+	author INTEGER,
+	owner TEXT,
+	scope TEXT NOT NULL DEFAULT 'global',
+	created INTEGER NOT NULL,
+	source TEXT,
+	chunk INTEGER,
+	embedding BLOB NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS embeddings_scope_idx ON embeddings (scope);
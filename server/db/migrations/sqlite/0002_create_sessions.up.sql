@@ -0,0 +1,18 @@
+-- created and updated are unix milliseconds, answers is a JSON array.
+CREATE TABLE IF NOT EXISTS session_turns (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	session_id TEXT NOT NULL,
+	role TEXT NOT NULL,
+	text TEXT NOT NULL,
+	created INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS session_turns_session_idx ON session_turns (session_id, id);
+
+CREATE TABLE IF NOT EXISTS session_pending (
+	session_id TEXT PRIMARY KEY,
+	question TEXT NOT NULL,
+	answers TEXT NOT NULL DEFAULT '[]',
+	rounds INTEGER NOT NULL DEFAULT 0,
+	updated INTEGER NOT NULL
+);
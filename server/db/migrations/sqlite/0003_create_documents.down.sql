@@ -0,0 +1,25 @@
+-- SQLite can't drop a column used in a foreign key, so rebuild embeddings
+-- without document_id.
+CREATE TABLE embeddings_new (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	content TEXT NOT NULL,
+	tokens INTEGER NOT NULL DEFAULT 0,
+	author INTEGER,
+	owner TEXT,
+	scope TEXT NOT NULL DEFAULT 'global',
+	created INTEGER NOT NULL,
+	source TEXT,
+	chunk INTEGER,
+	embedding BLOB NOT NULL
+);
+
+INSERT INTO embeddings_new (id, content, tokens, author, owner, scope, created, source, chunk, embedding)
+	SELECT id, content, tokens, author, owner, scope, created, source, chunk, embedding FROM embeddings;
+
+DROP TABLE embeddings;
+
+ALTER TABLE embeddings_new RENAME TO embeddings;
+
+CREATE INDEX IF NOT EXISTS embeddings_scope_idx ON embeddings (scope);
+
+DROP TABLE IF EXISTS documents;
@@ -0,0 +1,14 @@
+-- Files ingested with embed ingest, their chunks are rows in embeddings.
+-- modified and ingested are unix milliseconds.
+CREATE TABLE IF NOT EXISTS documents (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	uri TEXT NOT NULL UNIQUE,
+	title TEXT NOT NULL DEFAULT '',
+	hash TEXT NOT NULL,
+	modified INTEGER NOT NULL,
+	ingested INTEGER NOT NULL
+);
+
+ALTER TABLE embeddings ADD COLUMN document_id INTEGER REFERENCES documents(id) ON DELETE CASCADE;
+
+CREATE INDEX IF NOT EXISTS embeddings_document_idx ON embeddings (document_id);
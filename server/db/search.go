@@ -0,0 +1,261 @@
+package db
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// How Find ranks memories.
+type SearchMode string
+
+const (
+	// Ranks by embedding similarity alone, the default
+	VectorSearch SearchMode = "vector"
+	// Fuses the similarity ranking with a keyword ranking of the query text,
+	// so exact terms like ticket numbers, names and acronyms are found even
+	// when their embeddings aren't close.
+	HybridSearch SearchMode = "hybrid"
+)
+
+func ParseSearchMode(s string) (SearchMode, error) {
+	switch m := SearchMode(strings.ToLower(s)); m {
+	case "":
+		return VectorSearch, nil
+	case VectorSearch, HybridSearch:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown search mode '%s', expected vector or hybrid", s)
+	}
+}
+
+// Constant k of reciprocal rank fusion, a match scores 1/(k + rank) in each
+// ranking.  60 is the value from the original paper and damps the
+// difference between the first few ranks.
+const rrfK = 60
+
+// Each ranking considers this many times Count matches, so fusion and the
+// MMR rerank have something to choose from.
+const (
+	candidatesPerMatch = 4
+	minCandidates      = 20
+)
+
+// Returns the number of matches each ranking should consider, 0 for all.
+func candidateCount(opts FindOptions) int {
+	if opts.Count <= 0 {
+		return 0
+	}
+	if opts.Mode != HybridSearch && opts.Diversity <= 0 {
+		return opts.Count
+	}
+	return max(opts.Count*candidatesPerMatch, minCandidates)
+}
+
+// A memory Find is considering.
+type candidate struct {
+	match     Match
+	embedding []float32
+	// Higher is better, what the memory is ranked by
+	score float64
+}
+
+// Returns the candidates with the highest score first.
+func byScore(candidates []candidate) []candidate {
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].score > candidates[j].score
+	})
+	return candidates
+}
+
+// Returns at most n candidates, all of them if n is 0.
+func limit(candidates []candidate, n int) []candidate {
+	if n > 0 && len(candidates) > n {
+		return candidates[:n]
+	}
+	return candidates
+}
+
+// Ranks every visible memory for opts, for databases that search by brute
+// force.  Candidates are scored by the database's metric and have their
+// similarity set.
+func rank(candidates []candidate, opts FindOptions) []Match {
+	pool := candidateCount(opts)
+	vector := make([]candidate, 0, len(candidates))
+	for _, c := range candidates {
+		if opts.MinSimilarity == 0 || c.match.Similarity >= opts.MinSimilarity {
+			vector = append(vector, c)
+		}
+	}
+	ranked := limit(byScore(vector), pool)
+	if opts.Mode == HybridSearch {
+		// MinSimilarity only applies to the vector ranking, finding exact
+		// terms in dissimilar memories is the point of keyword search.
+		keyword := limit(byScore(keywordRanking(candidates, opts.Query)), pool)
+		ranked = fuse(ranked, keyword)
+	}
+	return finish(ranked, opts)
+}
+
+// Applies the MMR rerank if asked for and returns the best opts.Count
+// matches from ranked.
+func finish(ranked []candidate, opts FindOptions) []Match {
+	if opts.Diversity > 0 {
+		relevance := func(c candidate) float64 { return float64(c.match.Similarity) }
+		if opts.Mode == HybridSearch && len(ranked) > 0 && ranked[0].score > 0 {
+			// Fused scores are tiny, scale them so the best is 1 like an
+			// identical embedding.
+			best := ranked[0].score
+			relevance = func(c candidate) float64 { return c.score / best }
+		}
+		ranked = diversify(ranked, opts.Count, opts.Diversity, relevance)
+	}
+	ranked = limit(ranked, opts.Count)
+	matches := make([]Match, 0, len(ranked))
+	for _, c := range ranked {
+		matches = append(matches, c.match)
+	}
+	return matches
+}
+
+// Combines rankings with reciprocal rank fusion, a memory's score is the
+// sum of 1/(rrfK + rank) over the rankings it appears in.
+func fuse(rankings ...[]candidate) []candidate {
+	scores := map[int64]*candidate{}
+	fused := make([]*candidate, 0)
+	for _, ranking := range rankings {
+		for i, c := range ranking {
+			f, found := scores[c.match.ID]
+			if !found {
+				f = &candidate{match: c.match, embedding: c.embedding}
+				scores[c.match.ID] = f
+				fused = append(fused, f)
+			}
+			f.score += 1.0 / float64(rrfK+i+1)
+		}
+	}
+	result := make([]candidate, len(fused))
+	for i, f := range fused {
+		result[i] = *f
+	}
+	return byScore(result)
+}
+
+// Reranks with maximal marginal relevance, each pick maximizes
+//
+//	(1 - diversity) * relevance - diversity * max similarity to earlier picks
+//
+// Returns up to count candidates, all of them reordered if count is 0.
+func diversify(candidates []candidate, count int, diversity float32, relevance func(candidate) float64) []candidate {
+	if count <= 0 || count > len(candidates) {
+		count = len(candidates)
+	}
+	lambda := 1 - float64(diversity)
+	remaining := append([]candidate(nil), candidates...)
+	// Highest similarity of each remaining candidate to anything picked.
+	redundancy := make([]float64, len(remaining))
+	for i := range redundancy {
+		redundancy[i] = math.Inf(-1)
+	}
+	picked := make([]candidate, 0, count)
+	for len(picked) < count {
+		best, bestScore := 0, math.Inf(-1)
+		for i, c := range remaining {
+			score := lambda * relevance(c)
+			if len(picked) > 0 {
+				score -= (1 - lambda) * redundancy[i]
+			}
+			if score > bestScore {
+				best, bestScore = i, score
+			}
+		}
+		choice := remaining[best]
+		picked = append(picked, choice)
+		remaining = append(remaining[:best], remaining[best+1:]...)
+		redundancy = append(redundancy[:best], redundancy[best+1:]...)
+		for i, c := range remaining {
+			redundancy[i] = math.Max(redundancy[i], float64(CosineSimilarity(c.embedding, choice.embedding)))
+		}
+	}
+	return picked
+}
+
+// Words too common to say anything about a memory, as dropped by Postgres'
+// english text search configuration.
+var stopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true, "be": true,
+	"but": true, "by": true, "do": true, "does": true, "for": true, "from": true, "how": true,
+	"i": true, "if": true, "in": true, "is": true, "it": true, "its": true, "me": true,
+	"my": true, "of": true, "on": true, "or": true, "our": true, "so": true, "that": true,
+	"the": true, "their": true, "there": true, "this": true, "to": true, "was": true,
+	"we": true, "what": true, "when": true, "where": true, "which": true, "who": true,
+	"why": true, "will": true, "with": true, "you": true, "your": true,
+}
+
+// Returns the lower case words of text that aren't stop words.  Dashes and
+// underscores are kept within words so ids like INC-1234 stay whole.
+func searchTerms(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '-' && r != '_'
+	})
+	terms := make([]string, 0, len(words))
+	for _, w := range words {
+		w = strings.Trim(w, "-_")
+		if w != "" && !stopWords[w] {
+			terms = append(terms, w)
+		}
+	}
+	return terms
+}
+
+// Returns the candidates containing words of the query, scored by TF-IDF so
+// rare terms such as names count for more than common ones.
+func keywordRanking(candidates []candidate, query string) []candidate {
+	terms := unique(searchTerms(query))
+	if len(terms) == 0 {
+		return nil
+	}
+	counts := make([]map[string]int, len(candidates))
+	frequency := map[string]int{}
+	for i, c := range candidates {
+		counts[i] = map[string]int{}
+		for _, w := range searchTerms(c.match.Content) {
+			counts[i][w]++
+		}
+		for _, t := range terms {
+			if counts[i][t] > 0 {
+				frequency[t]++
+			}
+		}
+	}
+
+	ranked := make([]candidate, 0)
+	n := float64(len(candidates))
+	for i, c := range candidates {
+		var score float64
+		for _, t := range terms {
+			if tf := counts[i][t]; tf > 0 {
+				score += (1 + math.Log(float64(tf))) * math.Log(1+n/float64(frequency[t]))
+			}
+		}
+		if score > 0 {
+			c.score = score
+			ranked = append(ranked, c)
+		}
+	}
+	return ranked
+}
+
+func unique(words []string) []string {
+	seen := map[string]bool{}
+	result := make([]string, 0, len(words))
+	for _, w := range words {
+		if !seen[w] {
+			seen[w] = true
+			result = append(result, w)
+		}
+	}
+	return result
+}
@@ -0,0 +1,66 @@
+package db
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSearchTerms(t *testing.T) {
+	tests := map[string]string{
+		"What is the status of INC-4821?": "status,inc-4821",
+		"Who owns the_build -- Alice?":    "owns,the_build,alice",
+		"is it on":                        "",
+	}
+	for text, want := range tests {
+		if got := strings.Join(searchTerms(text), ","); got != want {
+			t.Errorf("searchTerms(%q) = %q, want %q", text, got, want)
+		}
+	}
+}
+
+func TestParseSearchMode(t *testing.T) {
+	for s, want := range map[string]SearchMode{"": VectorSearch, "vector": VectorSearch, "Hybrid": HybridSearch} {
+		if got, err := ParseSearchMode(s); err != nil || got != want {
+			t.Errorf("ParseSearchMode(%q) = %q, %v, want %q", s, got, err, want)
+		}
+	}
+	if _, err := ParseSearchMode("fuzzy"); err == nil {
+		t.Error("Expected an error for an unknown mode")
+	}
+}
+
+func TestFuse(t *testing.T) {
+	c := func(id int64) candidate { return candidate{match: Match{ID: id}} }
+	fused := fuse([]candidate{c(1), c(2), c(3)}, []candidate{c(3), c(4)})
+	ids := make([]int64, len(fused))
+	for i, f := range fused {
+		ids[i] = f.match.ID
+	}
+	// 3 is in both rankings so it beats 1, which is first in only one.
+	want := []int64{3, 1, 2, 4}
+	for i := range want {
+		if ids[i] != want[i] {
+			t.Fatalf("Expected %v, got %v", want, ids)
+		}
+	}
+	if score := fused[0].score; score != 1.0/63+1.0/61 {
+		t.Errorf("Expected the reciprocal ranks to be summed, got %v", score)
+	}
+}
+
+func TestKeywordRanking(t *testing.T) {
+	c := func(id int64, content string) candidate { return candidate{match: Match{ID: id, Content: content}} }
+	candidates := []candidate{
+		c(1, "The build is broken"),
+		c(2, "Alice fixed the build"),
+		c(3, "Nothing to see here"),
+		c(4, "The build, the build, the build"),
+	}
+	ranked := byScore(keywordRanking(candidates, "Did Alice fix the build?"))
+	if len(ranked) != 3 || ranked[0].match.ID != 2 {
+		t.Errorf("Expected the rare name to rank first and unmatched memories to be left out, got %#v", ranked)
+	}
+	if keywordRanking(candidates, "the") != nil {
+		t.Error("Expected no ranking for a query of stop words")
+	}
+}
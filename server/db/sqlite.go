@@ -0,0 +1,376 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/rcleveng/assistant/server/db/migrations"
+	"github.com/rcleveng/assistant/server/env"
+
+	// Pure Go SQLite driver registered as "sqlite"
+	_ "modernc.org/sqlite"
+)
+
+// Database file used when DB_FILE isn't set.
+const defaultSQLiteFile = "assistant.db"
+
+// Returns the SQLite database file for the environment.
+func SQLitePath(env *env.Environment) string {
+	if env.DatabaseFile == "" {
+		return defaultSQLiteFile
+	}
+	return env.DatabaseFile
+}
+
+// Opens the SQLite database at path.  WAL and a busy timeout let the
+// embeddings and session stores share the file.
+func openSQLite(path string) (*sql.DB, error) {
+	dsn := "file:" + path + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)"
+	if path == ":memory:" {
+		dsn = ":memory:?_pragma=foreign_keys(1)"
+	}
+	sqldb, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if path == ":memory:" {
+		// Every connection to :memory: is a different database.
+		sqldb.SetMaxOpenConns(1)
+	}
+	return sqldb, nil
+}
+
+// Opens the SQLite database at path and applies any outstanding migrations,
+// personal installs have no one to run them by hand.
+func OpenSQLite(ctx context.Context, path string) (*sql.DB, error) {
+	sqldb, err := openSQLite(path)
+	if err != nil {
+		return nil, err
+	}
+	all, err := migrations.SQLite()
+	if err == nil {
+		_, err = migrations.NewMigrator(migrations.NewSQLiteDriver(sqldb), all).Up(ctx)
+	}
+	if err != nil {
+		sqldb.Close()
+		return nil, fmt.Errorf("unable to migrate %s: %w", path, err)
+	}
+	return sqldb, nil
+}
+
+// Embeddings database in a SQLite file for single user installs.  Vectors
+// are stored as blobs and searched by brute force, which is fast enough for
+// tens of thousands of memories.
+type SQLiteDatabase struct {
+	db *sql.DB
+}
+
+func NewSQLiteDatabase(ctx context.Context, path string) (*SQLiteDatabase, error) {
+	sqldb, err := OpenSQLite(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLiteDatabase{db: sqldb}, nil
+}
+
+// Encodes an embedding as little endian float32s.
+func encodeVector(v []float32) []byte {
+	b := make([]byte, 4*len(v))
+	for i, f := range v {
+		binary.LittleEndian.PutUint32(b[4*i:], math.Float32bits(f))
+	}
+	return b
+}
+
+func decodeVector(b []byte) ([]float32, error) {
+	if len(b)%4 != 0 {
+		return nil, errors.New("embedding blob is not a multiple of 4 bytes")
+	}
+	v := make([]float32, len(b)/4)
+	for i := range v {
+		v[i] = math.Float32frombits(binary.LittleEndian.Uint32(b[4*i:]))
+	}
+	return v, nil
+}
+
+func (emb *SQLiteDatabase) Add(ctx context.Context, author int64, owner string, scope Scope, text string, embeddings []float32) (int64, error) {
+	if scope == "" {
+		scope = GlobalScope
+	}
+	sql := `
+INSERT INTO embeddings(
+	content, tokens, author, owner, scope, created, embedding
+) VALUES(
+	?, ?, ?, ?, ?, ?, ?
+);`
+	result, err := emb.db.ExecContext(ctx, sql, text, 0, author, owner, string(scope), time.Now().UnixMilli(), encodeVector(embeddings))
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+func (emb *SQLiteDatabase) Find(ctx context.Context, embedding []float32, opts FindOptions) ([]Match, error) {
+	where, args := scopeCondition(opts.Scopes)
+	sql := `SELECT id, content, COALESCE(author, 0), COALESCE(owner, ''), scope, created,
+		COALESCE(source, ''), COALESCE(chunk, 0), embedding
+	FROM embeddings
+	WHERE ` + where + `;`
+
+	rows, err := emb.db.QueryContext(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	candidates := make([]candidate, 0)
+	for rows.Next() {
+		var m Match
+		var scope string
+		var created int64
+		var blob []byte
+		if err := rows.Scan(&m.ID, &m.Content, &m.Author, &m.Owner, &scope, &created, &m.Source, &m.Chunk, &blob); err != nil {
+			return nil, err
+		}
+		v, err := decodeVector(blob)
+		if err != nil {
+			return nil, fmt.Errorf("memory %d: %w", m.ID, err)
+		}
+		m.Similarity = CosineSimilarity(embedding, v)
+		m.Scope = Scope(scope)
+		m.Created = time.UnixMilli(created)
+		candidates = append(candidates, candidate{match: m, embedding: v, score: float64(m.Similarity)})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return rank(candidates, opts), nil
+}
+
+// Returns a condition limiting rows to scopes and its arguments.
+func scopeCondition(scopes []Scope) (string, []any) {
+	if scopes == nil {
+		return "1", nil
+	}
+	if len(scopes) == 0 {
+		return "0", nil
+	}
+	args := make([]any, 0, len(scopes))
+	for _, s := range scopes {
+		args = append(args, string(s))
+	}
+	return "scope IN (?" + strings.Repeat(", ?", len(scopes)-1) + ")", args
+}
+
+func (emb *SQLiteDatabase) Delete(ctx context.Context, id int64) error {
+	result, err := emb.db.ExecContext(ctx, `DELETE FROM embeddings WHERE id = ?;`, id)
+	if err != nil {
+		return err
+	}
+	return affected(result)
+}
+
+func (emb *SQLiteDatabase) Update(ctx context.Context, id int64, text string, embeddings []float32) error {
+	sql := `UPDATE embeddings SET content = ?, embedding = ? WHERE id = ?;`
+	result, err := emb.db.ExecContext(ctx, sql, text, encodeVector(embeddings), id)
+	if err != nil {
+		return err
+	}
+	return affected(result)
+}
+
+// Returns ErrNotFound if the statement changed nothing.
+func affected(result sql.Result) error {
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (emb *SQLiteDatabase) List(ctx context.Context, opts ListOptions) ([]Match, error) {
+	where, args := scopeCondition(opts.Scopes)
+	// LIMIT -1 returns every row
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = -1
+	}
+	sql := `SELECT id, content, COALESCE(author, 0), COALESCE(owner, ''), scope, created,
+		COALESCE(source, ''), COALESCE(chunk, 0)
+	FROM embeddings
+	WHERE id > ? AND ` + where + `
+	ORDER BY id
+	LIMIT ?;`
+	args = append([]any{opts.AfterID}, args...)
+	rows, err := emb.db.QueryContext(ctx, sql, append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	results := make([]Match, 0)
+	for rows.Next() {
+		var m Match
+		var scope string
+		var created int64
+		if err := rows.Scan(&m.ID, &m.Content, &m.Author, &m.Owner, &scope, &created, &m.Source, &m.Chunk); err != nil {
+			return nil, err
+		}
+		m.Scope = Scope(scope)
+		m.Created = time.UnixMilli(created)
+		results = append(results, m)
+	}
+	return results, rows.Err()
+}
+
+func (emb *SQLiteDatabase) Document(ctx context.Context, uri string) (*Document, error) {
+	query := `SELECT id, uri, title, hash, modified, ingested FROM documents WHERE uri = ?;`
+	doc, err := scanDocument(emb.db.QueryRowContext(ctx, query, uri))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// Scans a row of id, uri, title, hash, modified, ingested.
+func scanDocument(row interface{ Scan(dest ...any) error }) (*Document, error) {
+	doc := &Document{}
+	var modified, ingested int64
+	if err := row.Scan(&doc.ID, &doc.URI, &doc.Title, &doc.Hash, &modified, &ingested); err != nil {
+		return nil, err
+	}
+	doc.Modified = time.UnixMilli(modified)
+	doc.Ingested = time.UnixMilli(ingested)
+	return doc, nil
+}
+
+func (emb *SQLiteDatabase) Documents(ctx context.Context) ([]Document, error) {
+	rows, err := emb.db.QueryContext(ctx, `SELECT id, uri, title, hash, modified, ingested FROM documents ORDER BY uri;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	docs := make([]Document, 0)
+	for rows.Next() {
+		doc, err := scanDocument(rows)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, *doc)
+	}
+	return docs, rows.Err()
+}
+
+func (emb *SQLiteDatabase) PutDocument(ctx context.Context, doc Document, author int64, scope Scope, chunks []Chunk) (int64, error) {
+	if scope == "" {
+		scope = GlobalScope
+	}
+	tx, err := emb.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	query := `
+INSERT INTO documents(
+	uri, title, hash, modified, ingested
+) VALUES(
+	?, ?, ?, ?, ?
+) ON CONFLICT (uri) DO UPDATE SET
+	title = excluded.title,
+	hash = excluded.hash,
+	modified = excluded.modified,
+	ingested = excluded.ingested
+RETURNING id;`
+	now := time.Now().UnixMilli()
+	var id int64
+	if err := tx.QueryRowContext(ctx, query, doc.URI, doc.Title, doc.Hash, doc.Modified.UnixMilli(), now).Scan(&id); err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM embeddings WHERE document_id = ?;`, id); err != nil {
+		return 0, err
+	}
+
+	query = `
+INSERT INTO embeddings(
+	content, tokens, author, scope, created, source, chunk, document_id, embedding
+) VALUES(
+	?, 0, ?, ?, ?, ?, ?, ?, ?
+);`
+	for i, c := range chunks {
+		if _, err := tx.ExecContext(ctx, query, c.Content, author, string(scope), now, doc.URI, i, id, encodeVector(c.Embedding)); err != nil {
+			return 0, err
+		}
+	}
+	return id, tx.Commit()
+}
+
+func (emb *SQLiteDatabase) Chunks(ctx context.Context, uri string) ([]Chunk, error) {
+	query := `
+SELECT e.content, e.embedding FROM embeddings e
+JOIN documents d ON e.document_id = d.id
+WHERE d.uri = ?
+ORDER BY e.chunk;`
+	rows, err := emb.db.QueryContext(ctx, query, uri)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	chunks := make([]Chunk, 0)
+	for rows.Next() {
+		var c Chunk
+		var blob []byte
+		if err := rows.Scan(&c.Content, &blob); err != nil {
+			return nil, err
+		}
+		if c.Embedding, err = decodeVector(blob); err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, c)
+	}
+	return chunks, rows.Err()
+}
+
+func (emb *SQLiteDatabase) DeleteDocument(ctx context.Context, uri string) error {
+	tx, err := emb.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	query := `DELETE FROM embeddings WHERE document_id IN (SELECT id FROM documents WHERE uri = ?);`
+	if _, err := tx.ExecContext(ctx, query, uri); err != nil {
+		return err
+	}
+	result, err := tx.ExecContext(ctx, `DELETE FROM documents WHERE uri = ?;`, uri)
+	if err != nil {
+		return err
+	}
+	if err := affected(result); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Returns the database's handle so other stores can share it, it is closed
+// with the database.
+func (emb *SQLiteDatabase) DB() *sql.DB {
+	return emb.db
+}
+
+func (emb *SQLiteDatabase) Ping(ctx context.Context) error {
+	return emb.db.PingContext(ctx)
+}
+
+func (emb *SQLiteDatabase) Close() {
+	emb.db.Close()
+}
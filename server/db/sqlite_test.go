@@ -0,0 +1,121 @@
+package db
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/rcleveng/assistant/server/db/migrations"
+)
+
+func TestVectorEncoding(t *testing.T) {
+	v := []float32{0, 1.5, -2.25, 3e-8}
+	got, err := decodeVector(encodeVector(v))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range v {
+		if got[i] != v[i] {
+			t.Fatalf("Expected %v, got %v", v, got)
+		}
+	}
+	if _, err := decodeVector([]byte{1, 2, 3}); err == nil {
+		t.Error("Expected an error for a truncated blob")
+	}
+}
+
+func TestSQLiteDatabase(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "assistant.db")
+	emb, err := NewSQLiteDatabase(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := emb.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+	emb.Add(ctx, 3, "slack:U1", UserScope("slack:U1"), "private", []float32{1, 0})
+	emb.Add(ctx, 0, "", GlobalScope, "public", []float32{1, 0.1})
+	emb.Add(ctx, 0, "", GlobalScope, "unrelated", []float32{0, 1})
+	emb.Close()
+
+	// Reopening runs the migrations again, which must be a no-op.
+	emb, err = NewSQLiteDatabase(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer emb.Close()
+
+	matches, err := emb.Find(ctx, []float32{1, 0}, FindOptions{Count: 10, Scopes: []Scope{GlobalScope}, MinSimilarity: 0.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 || matches[0].Content != "public" {
+		t.Errorf("Expected only the similar public memory, got %#v", matches)
+	}
+
+	matches, err = emb.Find(ctx, []float32{1, 0}, FindOptions{Count: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 2 || matches[0].Content != "private" || matches[1].Content != "public" {
+		t.Fatalf("Expected the two closest memories, got %#v", matches)
+	}
+	m := matches[0]
+	if m.Author != 3 || m.Owner != "slack:U1" || m.Scope != "user:slack:U1" || m.Similarity != 1 || m.Created.IsZero() {
+		t.Errorf("Expected the memory's metadata, got %#v", m)
+	}
+}
+
+func TestSQLiteMigrationsUpAndDown(t *testing.T) {
+	ctx := context.Background()
+	sqldb, err := openSQLite(filepath.Join(t.TempDir(), "assistant.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqldb.Close()
+	all, err := migrations.SQLite()
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrator := migrations.NewMigrator(migrations.NewSQLiteDriver(sqldb), all)
+
+	if _, err := migrator.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// Rows referencing a document must not stop the rollback.
+	if _, err := sqldb.ExecContext(ctx, `INSERT INTO documents(uri, hash, modified, ingested) VALUES('file:///a.md', 'h', 0, 0);`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sqldb.ExecContext(ctx, `INSERT INTO embeddings(content, created, embedding, document_id) VALUES('chunk', 0, x'00', 1);`); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := migrator.Down(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	var content string
+	if err := sqldb.QueryRowContext(ctx, `SELECT content FROM embeddings;`).Scan(&content); err != nil || content != "chunk" {
+		t.Fatalf("Expected the embeddings to survive dropping documents, got '%s' %v", content, err)
+	}
+	var documentColumns int
+	if err := sqldb.QueryRowContext(ctx, `SELECT count(*) FROM pragma_table_info('embeddings') WHERE name = 'document_id';`).Scan(&documentColumns); err != nil || documentColumns != 0 {
+		t.Errorf("Expected document_id to be dropped, got %d %v", documentColumns, err)
+	}
+
+	if _, err := migrator.Down(ctx, len(all)); err != nil {
+		t.Fatal(err)
+	}
+	var tables int
+	if err := sqldb.QueryRowContext(ctx, `SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name IN ('embeddings', 'documents', 'session_turns', 'session_pending');`).Scan(&tables); err != nil {
+		t.Fatal(err)
+	}
+	if tables != 0 {
+		t.Errorf("Expected every table dropped, %d left", tables)
+	}
+
+	// And back up again.
+	if _, err := migrator.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -4,6 +4,9 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Platform int
@@ -26,17 +29,54 @@ const (
 
 type Environment struct {
 	PalmApiKey string
+	// Where memories and sessions are stored: postgres (the default),
+	// sqlite, memory or noop
+	DatabaseBackend string
+	// The sqlite database file, or the file the memory backend is saved to
+	DatabaseFile string
+	// How the memory backend ranks memories: cosine (the default), dot or l2
+	DatabaseMetric string
 	// Databse hostname
 	DatabaseHostname string
 	DatabaseUserName string
 	DatabasePassword string
 	DatabaseDatabase string
+	// Connection pool size, 0 uses the pgxpool defaults
+	DatabaseMaxConns int32
+	DatabaseMinConns int32
+	// Apply outstanding schema migrations when the server starts
+	DatabaseMigrateOnStart bool
+	// How the assistant finds memories for context: vector (the default) or
+	// hybrid, which also matches the words of the question
+	SearchMode string
+	// Between 0 and 1, how much to prefer context unlike the memories already
+	// found, 0 disables the diversity rerank
+	SearchDiversity float32
+
+	// Generative model to use, defaults to gemini-pro
+	LlmModel string
+	// Comma separated models to try in order when LlmModel fails
+	LlmFallbackModels []string
+	// Retries of model calls that fail with a transient error, 0 uses the
+	// default and -1 disables retries
+	LlmMaxRetries int32
+	// Most model calls per second, 0 for no limit
+	LlmRateLimit float32
+	// Longest a single model call may take, 0 uses the default
+	LlmTimeout time.Duration
 
 	SlackBotOAuthToken string
 	SlackClientID      string
 	SlackClientSecret  string
 	SlackSigningSecret string
 
+	// iCalendar file or URL used to answer calendar questions
+	CalendarICalSource string
+	// Google Calendar to use when there is no iCalendar source
+	GoogleCalendarID string
+	// IANA time zone for calendar lookups, defaults to the local time zone
+	TimeZone string
+
 	Platform Platform
 }
 
@@ -59,6 +99,12 @@ func NewEnvironment() (*Environment, error) {
 func NewEnvironmentForPlatform(platform Platform) (*Environment, error) {
 	environment := &Environment{
 		PalmApiKey:         os.Getenv("PALM_KEY"),
+		DatabaseBackend:    os.Getenv("DB_BACKEND"),
+		DatabaseFile:       os.Getenv("DB_FILE"),
+		DatabaseMetric:     os.Getenv("DB_METRIC"),
+		SearchMode:         os.Getenv("SEARCH_MODE"),
+		LlmModel:           os.Getenv("LLM_MODEL"),
+		LlmFallbackModels:  listEnv("LLM_FALLBACK_MODELS"),
 		DatabaseHostname:   os.Getenv("PG_HOSTNAME"),
 		DatabaseUserName:   os.Getenv("PG_USERNAME"),
 		DatabasePassword:   os.Getenv("PG_PASSWORD"),
@@ -67,9 +113,35 @@ func NewEnvironmentForPlatform(platform Platform) (*Environment, error) {
 		SlackClientID:      os.Getenv("SLACK_CLIENT_ID"),
 		SlackClientSecret:  os.Getenv("SLACK_CLIENT_SECRET"),
 		SlackSigningSecret: os.Getenv("SLACK_SIGNING_SECRET"),
+		CalendarICalSource: os.Getenv("CALENDAR_ICS"),
+		GoogleCalendarID:   os.Getenv("GOOGLE_CALENDAR_ID"),
+		TimeZone:           os.Getenv("ASSISTANT_TIMEZONE"),
 		Platform:           platform,
 	}
 
+	var err error
+	if environment.DatabaseMaxConns, err = int32Env("PG_MAX_CONNS"); err != nil {
+		return nil, err
+	}
+	if environment.DatabaseMinConns, err = int32Env("PG_MIN_CONNS"); err != nil {
+		return nil, err
+	}
+	if environment.DatabaseMigrateOnStart, err = boolEnv("PG_MIGRATE_ON_START"); err != nil {
+		return nil, err
+	}
+	if environment.SearchDiversity, err = float32Env("SEARCH_DIVERSITY"); err != nil {
+		return nil, err
+	}
+	if environment.LlmMaxRetries, err = int32Env("LLM_MAX_RETRIES"); err != nil {
+		return nil, err
+	}
+	if environment.LlmRateLimit, err = float32Env("LLM_RATE_LIMIT"); err != nil {
+		return nil, err
+	}
+	if environment.LlmTimeout, err = durationEnv("LLM_TIMEOUT"); err != nil {
+		return nil, err
+	}
+
 	switch platform {
 	case COMMANDLINE, GOTEST, CLOUDRUN, IDE:
 		return environment, nil
@@ -79,6 +151,82 @@ func NewEnvironmentForPlatform(platform Platform) (*Environment, error) {
 	}
 }
 
+// Returns the comma separated values of the environment variable, or nil if
+// unset.
+func listEnv(name string) []string {
+	values := make([]string, 0)
+	for _, v := range strings.Split(os.Getenv(name), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	return values
+}
+
+// Returns the integer value of the environment variable, or 0 if unset.
+func int32Env(name string) (int32, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0, nil
+	}
+	i, err := strconv.ParseInt(value, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s '%s': %w", name, value, err)
+	}
+	return int32(i), nil
+}
+
+// Returns the float value of the environment variable, or 0 if unset.
+func float32Env(name string) (float32, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0, nil
+	}
+	f, err := strconv.ParseFloat(value, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s '%s': %w", name, value, err)
+	}
+	return float32(f), nil
+}
+
+// Returns the duration value of the environment variable, such as 30s, or 0
+// if unset.
+func durationEnv(name string) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s '%s': %w", name, value, err)
+	}
+	return d, nil
+}
+
+// Returns the boolean value of the environment variable, or false if unset.
+func boolEnv(name string) (bool, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s '%s': %w", name, value, err)
+	}
+	return b, nil
+}
+
+// Returns the location for TimeZone, or the local time zone if unset.
+func (e *Environment) Location() (*time.Location, error) {
+	if e.TimeZone == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(e.TimeZone)
+}
+
 func FromContext(ctx context.Context) (*Environment, bool) {
 	o := ctx.Value(EnvironmentKey)
 	e, ok := o.(*Environment)
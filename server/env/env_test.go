@@ -3,6 +3,7 @@ package env
 import (
 	"context"
 	"testing"
+	"time"
 )
 
 func TestEmptyContext(t *testing.T) {
@@ -40,3 +41,68 @@ func TestNewServerEnv(t *testing.T) {
 		t.Error("got error for test env")
 	}
 }
+
+func TestPoolSize(t *testing.T) {
+	t.Setenv("PG_MAX_CONNS", "8")
+	t.Setenv("PG_MIN_CONNS", "")
+	environ, err := NewEnvironmentForPlatform(GOTEST)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if environ.DatabaseMaxConns != 8 || environ.DatabaseMinConns != 0 {
+		t.Errorf("expected pool size 0-8, got %d-%d", environ.DatabaseMinConns, environ.DatabaseMaxConns)
+	}
+
+	t.Setenv("PG_MAX_CONNS", "lots")
+	if _, err := NewEnvironmentForPlatform(GOTEST); err == nil {
+		t.Error("expected error for invalid PG_MAX_CONNS")
+	}
+}
+
+func TestSearchDiversity(t *testing.T) {
+	t.Setenv("SEARCH_DIVERSITY", "0.3")
+	environ, err := NewEnvironmentForPlatform(GOTEST)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if environ.SearchDiversity != 0.3 {
+		t.Errorf("expected diversity 0.3, got %v", environ.SearchDiversity)
+	}
+
+	t.Setenv("SEARCH_DIVERSITY", "some")
+	if _, err := NewEnvironmentForPlatform(GOTEST); err == nil {
+		t.Error("expected error for invalid SEARCH_DIVERSITY")
+	}
+}
+
+func TestLlmTimeout(t *testing.T) {
+	t.Setenv("LLM_TIMEOUT", "45s")
+	environ, err := NewEnvironmentForPlatform(GOTEST)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if environ.LlmTimeout != 45*time.Second {
+		t.Errorf("expected timeout 45s, got %v", environ.LlmTimeout)
+	}
+
+	t.Setenv("LLM_TIMEOUT", "45")
+	if _, err := NewEnvironmentForPlatform(GOTEST); err == nil {
+		t.Error("expected error for invalid LLM_TIMEOUT")
+	}
+}
+
+func TestLlmFallbackModels(t *testing.T) {
+	t.Setenv("LLM_FALLBACK_MODELS", " gemini-1.0-pro, ,models/gemini-pro-vision ")
+	environ, err := NewEnvironmentForPlatform(GOTEST)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(environ.LlmFallbackModels) != 2 || environ.LlmFallbackModels[0] != "gemini-1.0-pro" || environ.LlmFallbackModels[1] != "models/gemini-pro-vision" {
+		t.Errorf("expected two fallback models, got %q", environ.LlmFallbackModels)
+	}
+
+	t.Setenv("LLM_FALLBACK_MODELS", "")
+	if environ, _ = NewEnvironmentForPlatform(GOTEST); environ.LlmFallbackModels != nil {
+		t.Errorf("expected no fallback models, got %q", environ.LlmFallbackModels)
+	}
+}
@@ -0,0 +1,179 @@
+// Ingests files into the memory so the assistant can answer questions
+// about them.
+package ingest
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rcleveng/assistant/server/db"
+	"github.com/rcleveng/assistant/server/llm"
+)
+
+type Splitter interface {
+	SplitText(text string) ([]string, error)
+}
+
+// What happened to a file.
+type Result struct {
+	Path     string
+	Document *db.Document
+	// Unchanged since it was last ingested
+	Skipped bool
+	Chunks  int
+	// Chunks that weren't already stored and had to be embedded
+	Embedded int
+}
+
+type Ingester struct {
+	llm      llm.LlmClient
+	db       db.DocumentsDB
+	splitter Splitter
+	// Author and scope given to every chunk
+	Author int64
+	Scope  db.Scope
+}
+
+func NewIngester(lm llm.LlmClient, docs db.DocumentsDB, splitter Splitter) *Ingester {
+	return &Ingester{llm: lm, db: docs, splitter: splitter, Scope: db.GlobalScope}
+}
+
+// Returns the URI documents are stored under for a path.
+func URI(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	return "file://" + filepath.ToSlash(abs), nil
+}
+
+// Returns the hex SHA-256 of data.
+func Hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Ingests the file at path, skipping it if it hasn't changed since it was
+// last ingested.
+func (i *Ingester) Ingest(ctx context.Context, path string) (*Result, error) {
+	reader, found := ReaderFor(path)
+	if !found {
+		return nil, fmt.Errorf("unsupported file type '%s'", path)
+	}
+	uri, err := URI(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := i.db.Document(ctx, uri)
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		return nil, err
+	}
+	// The databases keep milliseconds at best.
+	modified := info.ModTime().Truncate(time.Millisecond)
+	// Unchanged modification time, don't bother reading the file.
+	if existing != nil && existing.Modified.Equal(modified) {
+		return &Result{Path: path, Document: existing, Skipped: true}, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	hash := Hash(data)
+	if existing != nil && existing.Hash == hash {
+		return &Result{Path: path, Document: existing, Skipped: true}, nil
+	}
+
+	content, err := reader(path, data)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s: %w", path, err)
+	}
+	splits, err := i.split(content.Text)
+	if err != nil {
+		return nil, err
+	}
+	var stored []db.Chunk
+	if existing != nil {
+		if stored, err = i.db.Chunks(ctx, uri); err != nil {
+			return nil, err
+		}
+	}
+	chunks, embedded, err := i.embed(ctx, splits, stored, content.Title)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := db.Document{URI: uri, Title: content.Title, Hash: hash, Modified: modified}
+	if doc.ID, err = i.db.PutDocument(ctx, doc, i.Author, i.Scope, chunks); err != nil {
+		return nil, err
+	}
+	slog.InfoContext(ctx, "ingested document", "uri", uri, "chunks", len(chunks), "embedded", embedded)
+	return &Result{Path: path, Document: &doc, Chunks: len(chunks), Embedded: embedded}, nil
+}
+
+// Splits text into chunks, dropping empty ones.
+func (i *Ingester) split(text string) ([]string, error) {
+	splits, err := i.splitter.SplitText(text)
+	if err != nil {
+		return nil, err
+	}
+	kept := make([]string, 0, len(splits))
+	for _, s := range splits {
+		if strings.TrimSpace(s) != "" {
+			kept = append(kept, s)
+		}
+	}
+	return kept, nil
+}
+
+// Returns the chunks for splits and how many were embedded, as parts of a
+// document with the title.  Splits with the same content as a stored chunk
+// reuse its embedding, so editing part of a document only embeds the parts
+// that changed.
+func (i *Ingester) embed(ctx context.Context, splits []string, stored []db.Chunk, title string) ([]db.Chunk, int, error) {
+	known := make(map[string][]float32, len(stored))
+	for _, c := range stored {
+		known[c.Content] = c.Embedding
+	}
+
+	chunks := make([]db.Chunk, len(splits))
+	missing := make([]string, 0)
+	for n, s := range splits {
+		chunks[n] = db.Chunk{Content: s, Embedding: known[s]}
+		if chunks[n].Embedding == nil {
+			missing = append(missing, s)
+		}
+	}
+	if len(missing) == 0 {
+		return chunks, 0, nil
+	}
+
+	embeddings, err := i.llm.BatchEmbedText(ctx, missing, llm.DocumentEmbedding(title))
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(embeddings) != len(missing) {
+		return nil, 0, fmt.Errorf("expected %d embeddings, got %d", len(missing), len(embeddings))
+	}
+	next := 0
+	for n := range chunks {
+		if chunks[n].Embedding == nil {
+			chunks[n].Embedding = embeddings[next]
+			next++
+		}
+	}
+	return chunks, len(missing), nil
+}
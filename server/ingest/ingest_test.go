@@ -0,0 +1,110 @@
+package ingest
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rcleveng/assistant/server/db"
+	"github.com/rcleveng/assistant/server/llm"
+	"github.com/rcleveng/assistant/server/llm/fake"
+)
+
+// Splits on blank lines.
+type paragraphSplitter struct{}
+
+func (paragraphSplitter) SplitText(text string) ([]string, error) {
+	return strings.Split(text, "\n\n"), nil
+}
+
+func newTestIngester(t *testing.T) (*Ingester, *db.SQLiteDatabase) {
+	t.Helper()
+	docs, err := db.NewSQLiteDatabase(context.Background(), filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { docs.Close() })
+	return NewIngester(fake.NewLlmClient(), docs, paragraphSplitter{}), docs
+}
+
+func TestIngest(t *testing.T) {
+	ctx := context.Background()
+	ingester, docs := newTestIngester(t)
+	path := filepath.Join(t.TempDir(), "guide.md")
+	if err := os.WriteFile(path, []byte("# Guide\n\nThe office opens at 8am.\n\nParking is in the basement."), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := ingester.Ingest(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Skipped || result.Chunks != 3 || result.Document.Title != "Guide" {
+		t.Fatalf("Expected 3 chunks titled Guide, got %#v", result)
+	}
+	if got := ingester.llm.(*fake.LlmClient).LastEmbed(); got != llm.DocumentEmbedding("Guide") {
+		t.Errorf("Expected chunks embedded as documents titled Guide, got %+v", got)
+	}
+
+	uri, _ := URI(path)
+	matches, err := docs.Find(ctx, fake.HashEmbedding("parking basement"), db.FindOptions{Count: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 || matches[0].Source != uri || matches[0].Chunk != 2 {
+		t.Errorf("Expected the parking chunk of %s, got %#v", uri, matches)
+	}
+
+	// Unchanged files aren't embedded again.
+	if result, err = ingester.Ingest(ctx, path); err != nil {
+		t.Fatal(err)
+	}
+	if !result.Skipped {
+		t.Error("Expected an unchanged file to be skipped")
+	}
+
+	// Touching a file without changing it is caught by the hash.
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if result, err = ingester.Ingest(ctx, path); err != nil {
+		t.Fatal(err)
+	}
+	if !result.Skipped {
+		t.Error("Expected a file with the same content to be skipped")
+	}
+
+	// Changed files replace their chunks.
+	if err := os.WriteFile(path, []byte("# Guide\n\nThe office is closed."), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if result, err = ingester.Ingest(ctx, path); err != nil {
+		t.Fatal(err)
+	}
+	if result.Skipped || result.Chunks != 2 {
+		t.Errorf("Expected the changed file to be ingested as 2 chunks, got %#v", result)
+	}
+	all, err := docs.List(ctx, db.ListOptions{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 {
+		t.Errorf("Expected the old chunks to be replaced, got %#v", all)
+	}
+
+	documents, err := docs.Documents(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(documents) != 1 || documents[0].URI != uri || documents[0].Hash != Hash([]byte("# Guide\n\nThe office is closed.")) {
+		t.Errorf("Expected one document for %s, got %#v", uri, documents)
+	}
+
+	if _, err := ingester.Ingest(ctx, filepath.Join(t.TempDir(), "image.png")); err == nil {
+		t.Error("Expected an error for an unsupported file")
+	}
+}
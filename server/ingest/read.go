@@ -0,0 +1,227 @@
+package ingest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Text extracted from a file.
+type Content struct {
+	Title string
+	Text  string
+}
+
+// Returns the text of a file's contents, name decides the format.
+type Reader func(name string, data []byte) (*Content, error)
+
+var readers = map[string]Reader{
+	".md":       readMarkdown,
+	".markdown": readMarkdown,
+	".txt":      readText,
+	".text":     readText,
+	".html":     readHTML,
+	".htm":      readHTML,
+	".jsonl":    readJSONL,
+}
+
+// Returns the reader for the file name, or false if the format isn't
+// supported.
+func ReaderFor(name string) (Reader, bool) {
+	r, found := readers[strings.ToLower(filepath.Ext(name))]
+	return r, found
+}
+
+// Returns true if files like name can be ingested.
+func Supported(name string) bool {
+	_, found := ReaderFor(name)
+	return found
+}
+
+// The file name without its extension.
+func baseTitle(name string) string {
+	base := filepath.Base(name)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+func readText(name string, data []byte) (*Content, error) {
+	return &Content{Title: baseTitle(name), Text: string(data)}, nil
+}
+
+// Markdown is kept as is since the model reads it well, the title is the
+// first heading.
+func readMarkdown(name string, data []byte) (*Content, error) {
+	content := &Content{Title: baseTitle(name), Text: string(data)}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") {
+			content.Title = strings.TrimSpace(strings.TrimLeft(line, "#"))
+			break
+		}
+	}
+	return content, nil
+}
+
+// Elements whose text isn't part of the document.
+var skippedElements = map[string]bool{
+	"script":   true,
+	"style":    true,
+	"noscript": true,
+	"template": true,
+	"head":     true,
+}
+
+// Elements that start a new line of text.
+var blockElements = map[string]bool{
+	"p": true, "div": true, "br": true, "li": true, "tr": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"section": true, "article": true, "blockquote": true, "pre": true, "table": true,
+}
+
+func readHTML(name string, data []byte) (*Content, error) {
+	doc, err := html.Parse(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	content := &Content{Title: baseTitle(name)}
+	var text strings.Builder
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			if skippedElements[n.Data] {
+				return
+			}
+			if blockElements[n.Data] {
+				text.WriteString("\n")
+			}
+		}
+		if n.Type == html.TextNode {
+			if t := strings.Join(strings.Fields(n.Data), " "); t != "" {
+				text.WriteString(t)
+				text.WriteString(" ")
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+	// The head is skipped for text, so look for the title separately.
+	var findTitle func(n *html.Node)
+	findTitle = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.Data == "title" && n.FirstChild != nil {
+			if title := strings.TrimSpace(n.FirstChild.Data); title != "" {
+				content.Title = title
+			}
+			return
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			findTitle(c)
+		}
+	}
+	findTitle(doc)
+
+	lines := strings.Split(text.String(), "\n")
+	kept := make([]string, 0, len(lines))
+	for _, l := range lines {
+		if l = strings.TrimSpace(l); l != "" {
+			kept = append(kept, l)
+		}
+	}
+	content.Text = strings.Join(kept, "\n")
+	return content, nil
+}
+
+// Fields holding the text of a JSONL record, in order of preference.
+var jsonlTextFields = []string{"text", "content", "body"}
+
+// Each line is a JSON object, the text of every record is joined with blank
+// lines.  Records may have a title, the first one is the document's title.
+func readJSONL(name string, data []byte) (*Content, error) {
+	content := &Content{Title: baseTitle(name)}
+	texts := make([]string, 0)
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	titled := false
+	for line := 1; ; line++ {
+		var record map[string]any
+		err := decoder.Decode(&record)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s record %d: %w", name, line, err)
+		}
+		if title, ok := record["title"].(string); ok && title != "" && !titled {
+			content.Title = title
+			titled = true
+		}
+		for _, field := range jsonlTextFields {
+			if text, ok := record[field].(string); ok && text != "" {
+				texts = append(texts, text)
+				break
+			}
+		}
+	}
+	content.Text = strings.Join(texts, "\n\n")
+	return content, nil
+}
+
+// Returns the supported files matched by an argument, which is a file, a
+// directory that is searched recursively, or a glob pattern.
+func Expand(arg string) ([]string, error) {
+	info, err := os.Stat(arg)
+	if err == nil && !info.IsDir() {
+		return []string{arg}, nil
+	}
+	if err == nil {
+		files := make([]string, 0)
+		err := filepath.WalkDir(arg, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			// Skip hidden directories such as .git
+			if d.IsDir() && path != arg && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			if !d.IsDir() && Supported(path) {
+				files = append(files, path)
+			}
+			return nil
+		})
+		return files, err
+	}
+
+	matches, globErr := filepath.Glob(arg)
+	if globErr != nil {
+		return nil, globErr
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("no files match '%s'", arg)
+	}
+	files := make([]string, 0, len(matches))
+	for _, m := range matches {
+		// Unlike the shell, Glob's * matches hidden files too.
+		if strings.HasPrefix(filepath.Base(m), ".") {
+			continue
+		}
+		if info, err := os.Stat(m); err == nil && info.IsDir() {
+			expanded, err := Expand(m)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, expanded...)
+		} else if Supported(m) {
+			files = append(files, m)
+		}
+	}
+	return files, nil
+}
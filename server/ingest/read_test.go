@@ -0,0 +1,92 @@
+package ingest
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func read(t *testing.T, path string) *Content {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, found := ReaderFor(path)
+	if !found {
+		t.Fatalf("No reader for %s", path)
+	}
+	content, err := reader(path, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func TestReaders(t *testing.T) {
+	tests := []struct {
+		path     string
+		title    string
+		contains []string
+		excludes []string
+	}{
+		{"testdata/docs/guide.md", "Office Guide", []string{"# Office Guide", "Parking is in the basement."}, nil},
+		{"testdata/docs/notes.txt", "notes", []string{"water the plants"}, nil},
+		{"testdata/docs/sub/page.html", "Lunch Menu", []string{"Lunch\nSoup on Monday.\nTacos on Tuesday."}, []string{"script text", "color: red", "<p>"}},
+		{"testdata/docs/sub/faq.jsonl", "FAQ", []string{"Room 12.\n\nQ: Who do I ask about badges?"}, []string{"ignored"}},
+	}
+	for _, tc := range tests {
+		content := read(t, tc.path)
+		if content.Title != tc.title {
+			t.Errorf("%s: expected title '%s', got '%s'", tc.path, tc.title, content.Title)
+		}
+		for _, want := range tc.contains {
+			if !strings.Contains(content.Text, want) {
+				t.Errorf("%s: expected text to contain %q, got %q", tc.path, want, content.Text)
+			}
+		}
+		for _, unwanted := range tc.excludes {
+			if strings.Contains(content.Text, unwanted) {
+				t.Errorf("%s: expected text to not contain %q, got %q", tc.path, unwanted, content.Text)
+			}
+		}
+	}
+
+	if _, err := readJSONL("bad.jsonl", []byte("{\"text\": \"ok\"}\nnot json\n")); err == nil {
+		t.Error("Expected an error for an invalid JSONL record")
+	}
+}
+
+func TestExpand(t *testing.T) {
+	all := []string{"guide.md", "notes.txt", "sub/faq.jsonl", "sub/page.html"}
+	tests := []struct {
+		arg  string
+		want []string
+	}{
+		{"testdata/docs", all},
+		{"testdata/docs/notes.txt", []string{"notes.txt"}},
+		{"testdata/docs/*", all},
+		{"testdata/docs/sub/*.html", []string{"sub/page.html"}},
+	}
+	for _, tc := range tests {
+		files, err := Expand(tc.arg)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.arg, err)
+		}
+		got := make([]string, 0, len(files))
+		for _, f := range files {
+			rel, _ := filepath.Rel("testdata/docs", f)
+			got = append(got, filepath.ToSlash(rel))
+		}
+		sort.Strings(got)
+		if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+			t.Errorf("%s: expected %v, got %v", tc.arg, tc.want, got)
+		}
+	}
+
+	if _, err := Expand("testdata/docs/*.pdf"); err == nil {
+		t.Error("Expected an error when nothing matches")
+	}
+}
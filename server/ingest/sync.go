@@ -0,0 +1,170 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// What changed when a directory was synced.
+type SyncResult struct {
+	// Every file found, including unchanged ones
+	Files []*Result
+	// URIs of documents whose files were deleted
+	Removed []string
+}
+
+// Returns the number of files that were ingested because they changed.
+func (r *SyncResult) Changed() int {
+	changed := 0
+	for _, f := range r.Files {
+		if !f.Skipped {
+			changed++
+		}
+	}
+	return changed
+}
+
+// Brings the documents under dir up to date with its files.  New and changed
+// files are ingested, and documents for files that no longer exist are
+// removed.  A file that can't be ingested doesn't stop the others, its error
+// is returned with the rest once everything has been synced.
+func (i *Ingester) Sync(ctx context.Context, dir string) (*SyncResult, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("'%s' is not a directory", dir)
+	}
+	paths, err := Expand(dir)
+	if err != nil {
+		return nil, err
+	}
+	prefix, err := URI(dir)
+	if err != nil {
+		return nil, err
+	}
+	prefix = strings.TrimSuffix(prefix, "/") + "/"
+
+	result := &SyncResult{Files: make([]*Result, 0, len(paths)), Removed: make([]string, 0)}
+	var errs []error
+	found := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		uri, err := URI(path)
+		if err != nil {
+			return nil, err
+		}
+		found[uri] = true
+		file, err := i.Ingest(ctx, path)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", path, err))
+			continue
+		}
+		result.Files = append(result.Files, file)
+	}
+
+	docs, err := i.db.Documents(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, doc := range docs {
+		if !strings.HasPrefix(doc.URI, prefix) || found[doc.URI] {
+			continue
+		}
+		if err := i.db.DeleteDocument(ctx, doc.URI); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", doc.URI, err))
+			continue
+		}
+		slog.InfoContext(ctx, "removed document", "uri", doc.URI)
+		result.Removed = append(result.Removed, doc.URI)
+	}
+	return result, errors.Join(errs...)
+}
+
+// Syncs dir, then syncs it again whenever files under it change until ctx
+// is done.  Changes are batched until nothing has changed for debounce, so
+// an editor saving several files only causes one sync.  synced is called
+// with the result of every sync.
+func (i *Ingester) Watch(ctx context.Context, dir string, debounce time.Duration, synced func(*SyncResult, error)) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	if err := watchTree(watcher, dir); err != nil {
+		return err
+	}
+
+	synced(i.Sync(ctx, dir))
+
+	var pending <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if event.Has(fsnotify.Create) {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					if err := watchTree(watcher, event.Name); err != nil {
+						slog.WarnContext(ctx, "unable to watch directory", "dir", event.Name, "error", err)
+					}
+				}
+			}
+			if event.Has(fsnotify.Chmod) || hidden(dir, event.Name) {
+				continue
+			}
+			pending = time.After(debounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			slog.WarnContext(ctx, "watch error", "dir", dir, "error", err)
+		case <-pending:
+			pending = nil
+			synced(i.Sync(ctx, dir))
+		}
+	}
+}
+
+// Watches dir and the directories under it, skipping hidden ones like Expand.
+func watchTree(watcher *fsnotify.Watcher, dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if path != dir && strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		return watcher.Add(path)
+	})
+}
+
+// Returns true if path is in a hidden file or directory under dir, editors
+// write swap files there that aren't worth syncing for.
+func hidden(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	for _, part := range strings.Split(filepath.ToSlash(rel), "/") {
+		if strings.HasPrefix(part, ".") && part != "." && part != ".." {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,163 @@
+package ingest
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rcleveng/assistant/server/llm"
+	"github.com/rcleveng/assistant/server/llm/fake"
+)
+
+// Counts the texts that are embedded.
+type countingClient struct {
+	*fake.LlmClient
+	mu       sync.Mutex
+	embedded []string
+}
+
+func (c *countingClient) BatchEmbedText(ctx context.Context, texts []string, opts llm.EmbedOptions) ([][]float32, error) {
+	c.mu.Lock()
+	c.embedded = append(c.embedded, texts...)
+	c.mu.Unlock()
+	return c.LlmClient.BatchEmbedText(ctx, texts, opts)
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// Make sure the change is seen even if the mtime resolution is coarse.
+	later := time.Now().Add(time.Duration(len(content)) * time.Second)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSync(t *testing.T) {
+	ctx := context.Background()
+	ingester, docs := newTestIngester(t)
+	lm := &countingClient{LlmClient: fake.NewLlmClient()}
+	ingester.llm = lm
+
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.md"), "# A\n\nFirst paragraph.\n\nSecond paragraph.")
+	writeFile(t, filepath.Join(dir, "sub", "b.txt"), "Bees make honey.")
+	// Outside of the directory, so never removed by syncing it.
+	other := filepath.Join(t.TempDir(), "other.txt")
+	writeFile(t, other, "Somewhere else.")
+	if _, err := ingester.Ingest(ctx, other); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := ingester.Sync(ctx, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Files) != 2 || result.Changed() != 2 || len(result.Removed) != 0 {
+		t.Fatalf("Expected 2 files to be ingested, got %#v", result)
+	}
+
+	// Only the edited paragraph is embedded again.
+	lm.embedded = nil
+	writeFile(t, filepath.Join(dir, "a.md"), "# A\n\nFirst paragraph.\n\nSecond paragraph, edited.")
+	if result, err = ingester.Sync(ctx, dir); err != nil {
+		t.Fatal(err)
+	}
+	if result.Changed() != 1 {
+		t.Errorf("Expected only a.md to change, got %#v", result)
+	}
+	if len(lm.embedded) != 1 || lm.embedded[0] != "Second paragraph, edited." {
+		t.Errorf("Expected only the edited paragraph to be embedded, got %q", lm.embedded)
+	}
+	aURI, _ := URI(filepath.Join(dir, "a.md"))
+	chunks, err := docs.Chunks(ctx, aURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 3 || chunks[2].Content != "Second paragraph, edited." || len(chunks[0].Embedding) != fake.EmbeddingDimensions {
+		t.Errorf("Expected the 3 current chunks, got %#v", chunks)
+	}
+
+	// Deleted files are removed.
+	if err := os.RemoveAll(filepath.Join(dir, "sub")); err != nil {
+		t.Fatal(err)
+	}
+	if result, err = ingester.Sync(ctx, dir); err != nil {
+		t.Fatal(err)
+	}
+	bURI, _ := URI(filepath.Join(dir, "sub", "b.txt"))
+	if len(result.Removed) != 1 || result.Removed[0] != bURI {
+		t.Errorf("Expected %s to be removed, got %#v", bURI, result.Removed)
+	}
+	all, err := docs.Documents(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 {
+		t.Errorf("Expected a.md and other.txt to remain, got %#v", all)
+	}
+
+	if _, err := ingester.Sync(ctx, other); err == nil {
+		t.Error("Expected an error syncing a file")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ingester, _ := newTestIngester(t)
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.md"), "# A\n\nAlpha.")
+
+	results := make(chan *SyncResult, 10)
+	done := make(chan error)
+	go func() {
+		done <- ingester.Watch(ctx, dir, 50*time.Millisecond, func(r *SyncResult, err error) {
+			if err != nil {
+				t.Error(err)
+			}
+			results <- r
+		})
+	}()
+
+	next := func() *SyncResult {
+		t.Helper()
+		select {
+		case r := <-results:
+			return r
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for a sync")
+			return nil
+		}
+	}
+
+	if r := next(); r.Changed() != 1 {
+		t.Errorf("Expected the initial sync to ingest a.md, got %#v", r)
+	}
+
+	// Files in new directories are picked up.
+	writeFile(t, filepath.Join(dir, "sub", "b.md"), "# B\n\nBeta.")
+	for r := next(); r.Changed() == 0; r = next() {
+		// The directory can be synced before b.md is written.
+	}
+
+	if err := os.Remove(filepath.Join(dir, "a.md")); err != nil {
+		t.Fatal(err)
+	}
+	if r := next(); len(r.Removed) != 1 {
+		t.Errorf("Expected a.md to be removed, got %#v", r)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,128 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// Limits on how BatchEmbedText splits texts into provider requests.
+type BatchLimits struct {
+	// Most texts in one request
+	MaxTexts int
+	// Most bytes of text in one request, 0 for no limit.  A text larger than
+	// this is sent on its own.
+	MaxBytes int
+	// Most requests in flight at once
+	Concurrency int
+}
+
+// Embeds texts with a single provider request, returning one embedding per
+// text.
+type EmbedBatchFunc func(ctx context.Context, texts []string) ([][]float32, error)
+
+// Returned by BatchEmbedText when some of the texts couldn't be embedded.
+// Their embeddings are nil, the others are still returned.
+type BatchError struct {
+	// One per text, nil for texts that were embedded
+	Errors []error
+}
+
+// Returns the indexes of the texts that weren't embedded.
+func (e *BatchError) Failed() []int {
+	failed := make([]int, 0)
+	for i, err := range e.Errors {
+		if err != nil {
+			failed = append(failed, i)
+		}
+	}
+	return failed
+}
+
+func (e *BatchError) Error() string {
+	failed := e.Failed()
+	if len(failed) == 0 {
+		return "no embedding errors"
+	}
+	return fmt.Sprintf("unable to embed %d of %d texts: %v", len(failed), len(e.Errors), e.Errors[failed[0]])
+}
+
+func (e *BatchError) Unwrap() []error {
+	errs := make([]error, 0)
+	for _, err := range e.Errors {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// Returns the [start, end) ranges of texts for each request.
+func batches(texts []string, limits BatchLimits) [][2]int {
+	ranges := make([][2]int, 0)
+	start, size := 0, 0
+	for i, text := range texts {
+		full := limits.MaxTexts > 0 && i-start >= limits.MaxTexts
+		if limits.MaxBytes > 0 && i > start && size+len(text) > limits.MaxBytes {
+			full = true
+		}
+		if full {
+			ranges = append(ranges, [2]int{start, i})
+			start, size = i, 0
+		}
+		size += len(text)
+	}
+	if start < len(texts) {
+		ranges = append(ranges, [2]int{start, len(texts)})
+	}
+	return ranges
+}
+
+// Embeds texts in batches within limits, running up to limits.Concurrency
+// batches at once.  Embeddings are returned in the order of texts.  A batch
+// that fails doesn't stop the others, its texts are reported in a
+// *BatchError.
+func EmbedInBatches(ctx context.Context, texts []string, limits BatchLimits, embed EmbedBatchFunc) ([][]float32, error) {
+	embeddings := make([][]float32, len(texts))
+	errs := make([]error, len(texts))
+	var g errgroup.Group
+	g.SetLimit(max(limits.Concurrency, 1))
+	for _, r := range batches(texts, limits) {
+		start, end := r[0], r[1]
+		// Each batch only writes its own range, so no locking is needed.
+		g.Go(func() error {
+			if err := embedBatch(ctx, texts[start:end], embeddings[start:end], embed); err != nil {
+				for i := start; i < end; i++ {
+					errs[i] = err
+				}
+			}
+			return nil
+		})
+	}
+	g.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return embeddings, &BatchError{Errors: errs}
+		}
+	}
+	return embeddings, nil
+}
+
+// Embeds texts into embeddings, which has the same length.
+func embedBatch(ctx context.Context, texts []string, embeddings [][]float32, embed EmbedBatchFunc) error {
+	// Batches still waiting when ctx is done aren't sent.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	batch, err := embed(ctx, texts)
+	if err != nil {
+		return err
+	}
+	if len(batch) != len(texts) {
+		return fmt.Errorf("expected %d embeddings, got %d", len(texts), len(batch))
+	}
+	copy(embeddings, batch)
+	return nil
+}
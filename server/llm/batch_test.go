@@ -0,0 +1,141 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBatches(t *testing.T) {
+	tests := []struct {
+		name   string
+		texts  []string
+		limits BatchLimits
+		want   string
+	}{
+		{"empty", nil, BatchLimits{MaxTexts: 2}, "[]"},
+		{"by count", []string{"a", "b", "c", "d", "e"}, BatchLimits{MaxTexts: 2}, "[[0 2] [2 4] [4 5]]"},
+		{"by size", []string{"aaa", "bb", "c", "dddd"}, BatchLimits{MaxTexts: 10, MaxBytes: 5}, "[[0 2] [2 4]]"},
+		{"oversized text alone", []string{"a", "bbbbbbbb", "c"}, BatchLimits{MaxTexts: 10, MaxBytes: 4}, "[[0 1] [1 2] [2 3]]"},
+		{"no limits", []string{"a", "b", "c"}, BatchLimits{}, "[[0 3]]"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := fmt.Sprint(batches(tc.texts, tc.limits)); got != tc.want {
+				t.Errorf("batches() = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+// Embeds each text as its number, failing batches containing a text in fail.
+func numberEmbedder(fail map[string]bool) EmbedBatchFunc {
+	return func(ctx context.Context, texts []string) ([][]float32, error) {
+		embeddings := make([][]float32, len(texts))
+		for i, text := range texts {
+			if fail[text] {
+				return nil, fmt.Errorf("bad text %s", text)
+			}
+			n, _ := strconv.Atoi(text)
+			embeddings[i] = []float32{float32(n)}
+		}
+		return embeddings, nil
+	}
+}
+
+func numberTexts(n int) []string {
+	texts := make([]string, n)
+	for i := range texts {
+		texts[i] = strconv.Itoa(i)
+	}
+	return texts
+}
+
+func TestEmbedInBatches(t *testing.T) {
+	ctx := context.Background()
+	texts := numberTexts(25)
+	limits := BatchLimits{MaxTexts: 4, Concurrency: 3}
+
+	var mu sync.Mutex
+	inFlight, most := 0, 0
+	embed := numberEmbedder(nil)
+	embeddings, err := EmbedInBatches(ctx, texts, limits, func(ctx context.Context, texts []string) ([][]float32, error) {
+		mu.Lock()
+		inFlight++
+		most = max(most, inFlight)
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+		}()
+		time.Sleep(time.Millisecond)
+		return embed(ctx, texts)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, e := range embeddings {
+		if len(e) != 1 || e[0] != float32(i) {
+			t.Fatalf("Expected embeddings in order, got %v at %d", e, i)
+		}
+	}
+	if most > 3 {
+		t.Errorf("Expected at most 3 batches at once, got %d", most)
+	}
+}
+
+func TestEmbedInBatchesErrors(t *testing.T) {
+	ctx := context.Background()
+	texts := numberTexts(10)
+	embeddings, err := EmbedInBatches(ctx, texts, BatchLimits{MaxTexts: 3, Concurrency: 2}, numberEmbedder(map[string]bool{"4": true}))
+
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("Expected a BatchError, got %v", err)
+	}
+	if got := fmt.Sprint(batchErr.Failed()); got != "[3 4 5]" {
+		t.Errorf("Expected the batch with 4 to fail, got %s", got)
+	}
+	if !strings.Contains(err.Error(), "3 of 10") || !strings.Contains(err.Error(), "bad text 4") {
+		t.Errorf("Unexpected error message: %v", err)
+	}
+	for i, e := range embeddings {
+		failed := i >= 3 && i <= 5
+		if failed != (e == nil) {
+			t.Errorf("Embedding %d = %v, failed %v", i, e, failed)
+		}
+	}
+
+	// Short responses fail their batch.
+	_, err = EmbedInBatches(ctx, texts, BatchLimits{MaxTexts: 5}, func(ctx context.Context, texts []string) ([][]float32, error) {
+		return make([][]float32, 1), nil
+	})
+	if !errors.As(err, &batchErr) || len(batchErr.Failed()) != 10 {
+		t.Errorf("Expected every text to fail, got %v", err)
+	}
+}
+
+func TestEmbedInBatchesCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var mu sync.Mutex
+	calls := 0
+	_, err := EmbedInBatches(ctx, numberTexts(10), BatchLimits{MaxTexts: 2, Concurrency: 1}, func(ctx context.Context, texts []string) ([][]float32, error) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		cancel()
+		return numberEmbedder(nil)(ctx, texts)
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("Expected no batches sent after cancel, got %d calls", calls)
+	}
+}
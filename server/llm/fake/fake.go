@@ -0,0 +1,187 @@
+// Package fake provides an in-memory llm.LlmClient for tests and for running
+// the server without calling a real model.
+package fake
+
+import (
+	"context"
+	"hash/fnv"
+	"math"
+	"strings"
+	"sync"
+
+	"github.com/rcleveng/assistant/server/llm"
+)
+
+// Number of dimensions produced by HashEmbedding.
+const EmbeddingDimensions = 64
+
+// Fake LLM client.  Responses are returned in order, once they are exhausted
+// the prompt is echoed back.  Every prompt is recorded in Prompts, and the
+// options of every embedding call in Embeds.
+type LlmClient struct {
+	mu sync.Mutex
+
+	Responses []string
+	Prompts   []string
+	Embeds    []llm.EmbedOptions
+	Closed    bool
+}
+
+func NewLlmClient(responses ...string) *LlmClient {
+	return &LlmClient{Responses: responses}
+}
+
+func (c *LlmClient) next(prompt string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Prompts = append(c.Prompts, prompt)
+	if len(c.Responses) == 0 {
+		return prompt
+	}
+	resp := c.Responses[0]
+	c.Responses = c.Responses[1:]
+	return resp
+}
+
+// Returns the most recent prompt, or "" if nothing has been generated.
+func (c *LlmClient) LastPrompt() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.Prompts) == 0 {
+		return ""
+	}
+	return c.Prompts[len(c.Prompts)-1]
+}
+
+func (c *LlmClient) GenerateText(ctx context.Context, prompt string) (string, error) {
+	return c.next(prompt), nil
+}
+
+// Records the flattened conversation as the prompt.
+func (c *LlmClient) GenerateMessages(ctx context.Context, messages []llm.Message) (*llm.Generation, error) {
+	return &llm.Generation{
+		Text:         c.next(llm.MessagesText(messages)),
+		FinishReason: "STOP",
+		Usage:        &llm.Usage{},
+	}, nil
+}
+
+// Streams the response one word at a time.
+func (c *LlmClient) GenerateTextStream(ctx context.Context, prompt string) (<-chan llm.StreamChunk, error) {
+	text := c.next(prompt)
+	sender, stream := llm.NewStreamSender(ctx)
+	go func() {
+		defer sender.Close()
+		words := strings.SplitAfter(text, " ")
+		for _, w := range words {
+			if !sender.Send(llm.StreamChunk{Text: w}) {
+				return
+			}
+		}
+		tokens := int32(len(words))
+		sender.Send(llm.StreamChunk{
+			Done:         true,
+			FinishReason: "STOP",
+			Usage:        &llm.Usage{CandidateTokens: tokens, TotalTokens: tokens},
+		})
+	}()
+	return stream, nil
+}
+
+func (c *LlmClient) recordEmbed(opts llm.EmbedOptions) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Embeds = append(c.Embeds, opts)
+}
+
+// Returns the options of the most recent embedding call.
+func (c *LlmClient) LastEmbed() llm.EmbedOptions {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.Embeds) == 0 {
+		return llm.EmbedOptions{}
+	}
+	return c.Embeds[len(c.Embeds)-1]
+}
+
+// The task type doesn't change the embedding, callers can check it with
+// LastEmbed.
+func (c *LlmClient) EmbedText(ctx context.Context, text string, opts llm.EmbedOptions) ([]float32, error) {
+	c.recordEmbed(opts)
+	return HashEmbedding(text), nil
+}
+
+func (c *LlmClient) BatchEmbedText(ctx context.Context, texts []string, opts llm.EmbedOptions) ([][]float32, error) {
+	c.recordEmbed(opts)
+	embeddings := make([][]float32, len(texts))
+	for i, text := range texts {
+		embeddings[i] = HashEmbedding(text)
+	}
+	return embeddings, nil
+}
+
+func (c *LlmClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Closed = true
+	return nil
+}
+
+// Deterministic bag of words embedding, texts sharing words end up close to
+// each other which is enough to exercise similarity search.
+func HashEmbedding(text string) []float32 {
+	v := make([]float32, EmbeddingDimensions)
+	for _, word := range strings.Fields(strings.ToLower(text)) {
+		word = strings.Trim(word, ".,!?;:'\"()")
+		if word == "" {
+			continue
+		}
+		h := fnv.New32a()
+		h.Write([]byte(word))
+		v[h.Sum32()%EmbeddingDimensions] += 1
+	}
+
+	var norm float64
+	for _, x := range v {
+		norm += float64(x * x)
+	}
+	if norm == 0 {
+		return v
+	}
+	norm = math.Sqrt(norm)
+	for i := range v {
+		v[i] = float32(float64(v[i]) / norm)
+	}
+	return v
+}
+
+// Fake client with native function calling.  Generations are returned in
+// order, once they are exhausted it falls back to LlmClient.
+type FunctionCallingClient struct {
+	*LlmClient
+
+	Generations []*llm.Generation
+	// Functions declared on the most recent call
+	Functions []llm.FunctionDeclaration
+	// Messages sent on the most recent call
+	Messages []llm.Message
+}
+
+func NewFunctionCallingClient(generations ...*llm.Generation) *FunctionCallingClient {
+	return &FunctionCallingClient{LlmClient: NewLlmClient(), Generations: generations}
+}
+
+func (c *FunctionCallingClient) GenerateWithFunctions(ctx context.Context, messages []llm.Message, functions []llm.FunctionDeclaration) (*llm.Generation, error) {
+	c.mu.Lock()
+	c.Functions = functions
+	c.Messages = messages
+	if len(c.Generations) == 0 {
+		c.mu.Unlock()
+		return c.GenerateMessages(ctx, messages)
+	}
+	gen := c.Generations[0]
+	c.Generations = c.Generations[1:]
+	c.Prompts = append(c.Prompts, llm.MessagesText(messages))
+	c.mu.Unlock()
+	return gen, nil
+}
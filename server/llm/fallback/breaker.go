@@ -0,0 +1,90 @@
+package fallback
+
+import (
+	"sync"
+	"time"
+)
+
+// State of a circuit breaker.
+type State string
+
+const (
+	// Calls go to the provider
+	Closed State = "closed"
+	// The provider failed too often, calls skip it until the cooldown ends
+	Open State = "open"
+	// The cooldown ended, one trial call decides whether to close again
+	HalfOpen State = "half-open"
+)
+
+// Stops calling a provider after threshold consecutive failures, then lets a
+// single call through every cooldown to see if it has recovered.
+type breaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	failures int
+	// When the next trial call is allowed while open
+	retryAt time.Time
+	// A trial call is in flight
+	trial bool
+}
+
+func newBreaker(threshold int, cooldown time.Duration, now func() time.Time) *breaker {
+	return &breaker{threshold: max(threshold, 1), cooldown: cooldown, now: now}
+}
+
+func (b *breaker) state() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.failures < b.threshold:
+		return Closed
+	case b.trial || !b.now().Before(b.retryAt):
+		return HalfOpen
+	default:
+		return Open
+	}
+}
+
+// Returns true if a call may go to the provider.  Once the cooldown ends only
+// one trial call is allowed until it succeeds or fails.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return true
+	}
+	if b.trial || b.now().Before(b.retryAt) {
+		return false
+	}
+	b.trial = true
+	return true
+}
+
+func (b *breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.trial = false
+}
+
+func (b *breaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.trial = false
+	if b.failures >= b.threshold {
+		b.retryAt = b.now().Add(b.cooldown)
+	}
+}
+
+// Gives back a trial call that didn't reach the provider, such as one the
+// caller canceled.
+func (b *breaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+}
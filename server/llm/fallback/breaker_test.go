@@ -0,0 +1,49 @@
+package fallback
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := newBreaker(2, time.Minute, func() time.Time { return now })
+
+	b.failure()
+	if !b.allow() || b.state() != Closed {
+		t.Fatalf("Expected closed after one failure, got %s", b.state())
+	}
+	b.success()
+	b.failure()
+	if b.state() != Closed {
+		t.Fatalf("Expected a success to reset the failures, got %s", b.state())
+	}
+	b.failure()
+	if b.allow() || b.state() != Open {
+		t.Fatalf("Expected open after two failures in a row, got %s", b.state())
+	}
+
+	now = now.Add(time.Minute)
+	if b.state() != HalfOpen {
+		t.Fatalf("Expected half-open after the cooldown, got %s", b.state())
+	}
+	if !b.allow() {
+		t.Fatal("Expected a trial call after the cooldown")
+	}
+	if b.allow() {
+		t.Fatal("Expected only one trial call at a time")
+	}
+	b.failure()
+	if b.allow() || b.state() != Open {
+		t.Fatalf("Expected a failed trial to open the breaker again, got %s", b.state())
+	}
+
+	now = now.Add(time.Minute)
+	if !b.allow() {
+		t.Fatal("Expected another trial call after the cooldown")
+	}
+	b.success()
+	if !b.allow() || b.state() != Closed {
+		t.Fatalf("Expected a successful trial to close the breaker, got %s", b.state())
+	}
+}
@@ -0,0 +1,265 @@
+// Package fallback combines several llm.LlmClients into one that tries them
+// in order, so the assistant keeps answering when a provider is down.
+package fallback
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/rcleveng/assistant/server/llm"
+	"github.com/rcleveng/assistant/server/llm/retry"
+)
+
+// Returned, wrapped, for providers skipped because their circuit breaker is
+// open.
+var ErrOpen = errors.New("circuit breaker open")
+
+// A client to try, in the order given to NewClient.
+type Provider struct {
+	// Reported as the provider that served a call, such as the model name
+	Name   string
+	Client llm.LlmClient
+	// Set when the provider's embeddings can be compared with the first
+	// provider's, such as another model of the same API.  Embedding calls
+	// only fall back to these, stored embeddings can't be searched with
+	// another model's.
+	SharedEmbeddings bool
+}
+
+type Options struct {
+	// Consecutive failures that open a provider's circuit breaker
+	FailureThreshold int
+	// How long an open breaker skips its provider before trying it again
+	Cooldown time.Duration
+	// Returns true if an error says the provider is having trouble, defaults
+	// to retry.Retryable.  Other errors, such as a bad request, are returned
+	// as is since every provider would fail them too.
+	Transient func(error) bool
+}
+
+func DefaultOptions() Options {
+	return Options{FailureThreshold: 5, Cooldown: 30 * time.Second, Transient: retry.Retryable}
+}
+
+type provider struct {
+	Provider
+	breaker *breaker
+}
+
+// An llm.LlmClient that calls the first provider that works.
+type Client struct {
+	providers []*provider
+	transient func(error) bool
+}
+
+// Adds GenerateWithFunctions when every provider supports it, so callers
+// checking for llm.FunctionCaller get the same kind of response whichever
+// provider serves them.
+type functionClient struct {
+	*Client
+}
+
+// Creates a client that tries providers in order.  Closing it closes every
+// provider.
+func NewClient(providers []Provider, opts Options) (llm.LlmClient, error) {
+	c, err := newClient(providers, opts, time.Now)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range providers {
+		if _, ok := p.Client.(llm.FunctionCaller); !ok {
+			return c, nil
+		}
+	}
+	return &functionClient{Client: c}, nil
+}
+
+func newClient(providers []Provider, opts Options, now func() time.Time) (*Client, error) {
+	if len(providers) == 0 {
+		return nil, errors.New("no llm providers")
+	}
+	if opts.Transient == nil {
+		opts.Transient = retry.Retryable
+	}
+	c := &Client{providers: make([]*provider, len(providers)), transient: opts.Transient}
+	for i, p := range providers {
+		c.providers[i] = &provider{Provider: p, breaker: newBreaker(opts.FailureThreshold, opts.Cooldown, now)}
+	}
+	return c, nil
+}
+
+// Returns the state of each provider's circuit breaker by name.
+func (c *Client) States() map[string]State {
+	states := make(map[string]State, len(c.providers))
+	for _, p := range c.providers {
+		states[p.Name] = p.breaker.state()
+	}
+	return states
+}
+
+// Returns true if err says some texts of a batch were embedded, so the
+// provider is working.
+func partial(err error) bool {
+	var batchErr *llm.BatchError
+	return errors.As(err, &batchErr) && len(batchErr.Failed()) < len(batchErr.Errors)
+}
+
+// Calls f with each provider in turn until one succeeds, skipping those with
+// an open breaker.  Only transient errors count against a provider and move
+// on to the next one.  Only providers sharing the first one's embeddings are
+// used for embedding calls.  Returns the name of the provider that served
+// the call, which is also logged for calls such as GenerateText that have
+// nowhere else to report it.
+func (c *Client) call(ctx context.Context, call string, embedding bool, f func(ctx context.Context, client llm.LlmClient) error) (string, error) {
+	errs := make([]error, 0, len(c.providers))
+	for i, p := range c.providers {
+		if embedding && i > 0 && !p.SharedEmbeddings {
+			continue
+		}
+		if !p.breaker.allow() {
+			errs = append(errs, fmt.Errorf("%s: %w", p.Name, ErrOpen))
+			continue
+		}
+		err := f(ctx, p.Client)
+		if err == nil || partial(err) {
+			p.breaker.success()
+			if i > 0 {
+				slog.WarnContext(ctx, "llm call served by fallback provider", "call", call, "provider", p.Name, "skipped", len(errs))
+			} else {
+				slog.DebugContext(ctx, "llm call served", "call", call, "provider", p.Name)
+			}
+			return p.Name, err
+		}
+		if ctx.Err() != nil || !c.isTransient(err) {
+			// The caller gave up or the request itself is bad, neither says
+			// anything about the provider.
+			p.breaker.release()
+			return "", err
+		}
+		p.breaker.failure()
+		slog.WarnContext(ctx, "llm provider failed", "call", call, "provider", p.Name, "breaker", p.breaker.state(), "error", err)
+		errs = append(errs, fmt.Errorf("%s: %w", p.Name, err))
+	}
+	return "", fmt.Errorf("all llm providers failed: %w", errors.Join(errs...))
+}
+
+// Returns true if err is worth trying the next provider for.
+func (c *Client) isTransient(err error) bool {
+	// An attempt that timed out while the caller still had time.
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	return c.transient(err)
+}
+
+func (c *Client) GenerateText(ctx context.Context, prompt string) (string, error) {
+	var text string
+	_, err := c.call(ctx, "GenerateText", false, func(ctx context.Context, client llm.LlmClient) error {
+		var err error
+		text, err = client.GenerateText(ctx, prompt)
+		return err
+	})
+	return text, err
+}
+
+// Falls back only if the stream can't be opened, once chunks have been sent
+// a failure is reported on the stream as usual.  Each chunk's Provider is set
+// to the provider streaming it, unless the provider set it already.
+func (c *Client) GenerateTextStream(ctx context.Context, prompt string) (<-chan llm.StreamChunk, error) {
+	var stream <-chan llm.StreamChunk
+	name, err := c.call(ctx, "GenerateTextStream", false, func(ctx context.Context, client llm.LlmClient) error {
+		var err error
+		stream, err = client.GenerateTextStream(ctx, prompt)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sender, forwarded := llm.NewStreamSender(ctx)
+	go func() {
+		defer sender.Close()
+		for chunk := range stream {
+			if chunk.Provider == "" {
+				chunk.Provider = name
+			}
+			if !sender.Send(chunk) {
+				return
+			}
+		}
+	}()
+	return forwarded, nil
+}
+
+// The generation's Provider is set to the provider that served it, unless
+// the provider set it already.
+func (c *Client) GenerateMessages(ctx context.Context, messages []llm.Message) (*llm.Generation, error) {
+	var gen *llm.Generation
+	name, err := c.call(ctx, "GenerateMessages", false, func(ctx context.Context, client llm.LlmClient) error {
+		var err error
+		gen, err = client.GenerateMessages(ctx, messages)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return served(gen, name), nil
+}
+
+func (c *functionClient) GenerateWithFunctions(ctx context.Context, messages []llm.Message, functions []llm.FunctionDeclaration) (*llm.Generation, error) {
+	var gen *llm.Generation
+	name, err := c.call(ctx, "GenerateWithFunctions", false, func(ctx context.Context, client llm.LlmClient) error {
+		var err error
+		gen, err = client.(llm.FunctionCaller).GenerateWithFunctions(ctx, messages, functions)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return served(gen, name), nil
+}
+
+func served(gen *llm.Generation, provider string) *llm.Generation {
+	if gen.Provider == "" {
+		gen.Provider = provider
+	}
+	return gen
+}
+
+func (c *Client) EmbedText(ctx context.Context, text string, opts llm.EmbedOptions) ([]float32, error) {
+	var embedding []float32
+	_, err := c.call(ctx, "EmbedText", true, func(ctx context.Context, client llm.LlmClient) error {
+		var err error
+		embedding, err = client.EmbedText(ctx, text, opts)
+		return err
+	})
+	return embedding, err
+}
+
+// A provider that embeds some of the texts is used, the rest are reported
+// in its *llm.BatchError.
+func (c *Client) BatchEmbedText(ctx context.Context, texts []string, opts llm.EmbedOptions) ([][]float32, error) {
+	var embeddings [][]float32
+	name, err := c.call(ctx, "BatchEmbedText", true, func(ctx context.Context, client llm.LlmClient) error {
+		var err error
+		embeddings, err = client.BatchEmbedText(ctx, texts, opts)
+		return err
+	})
+	if name == "" {
+		return nil, err
+	}
+	return embeddings, err
+}
+
+func (c *Client) Close() error {
+	errs := make([]error, 0)
+	for _, p := range c.providers {
+		if err := p.Client.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", p.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,242 @@
+package fallback
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rcleveng/assistant/server/llm"
+	"github.com/rcleveng/assistant/server/llm/fake"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// A fake client that fails while down is set.
+type downClient struct {
+	*fake.LlmClient
+	mu    sync.Mutex
+	down  bool
+	calls int
+}
+
+func newDownClient(down bool, responses ...string) *downClient {
+	return &downClient{LlmClient: fake.NewLlmClient(responses...), down: down}
+}
+
+func (c *downClient) fail() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+	if c.down {
+		return &googleapi.Error{Code: http.StatusServiceUnavailable, Message: "provider down"}
+	}
+	return nil
+}
+
+func (c *downClient) GenerateMessages(ctx context.Context, messages []llm.Message) (*llm.Generation, error) {
+	if err := c.fail(); err != nil {
+		return nil, err
+	}
+	return c.LlmClient.GenerateMessages(ctx, messages)
+}
+
+func (c *downClient) EmbedText(ctx context.Context, text string, opts llm.EmbedOptions) ([]float32, error) {
+	if err := c.fail(); err != nil {
+		return nil, err
+	}
+	return c.LlmClient.EmbedText(ctx, text, opts)
+}
+
+var hello = []llm.Message{llm.NewMessage(llm.RoleUser, "hello")}
+
+func TestFallback(t *testing.T) {
+	ctx := context.Background()
+	primary := newDownClient(true)
+	secondary := newDownClient(false, "from secondary")
+	c, err := newClient([]Provider{
+		{Name: "primary", Client: primary},
+		{Name: "secondary", Client: secondary},
+	}, DefaultOptions(), time.Now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gen, err := c.GenerateMessages(ctx, hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gen.Text != "from secondary" || gen.Provider != "secondary" {
+		t.Errorf("Expected the secondary to serve the call, got %+v", gen)
+	}
+
+	primary.down = false
+	if gen, err = c.GenerateMessages(ctx, hello); err != nil {
+		t.Fatal(err)
+	}
+	if gen.Provider != "primary" {
+		t.Errorf("Expected the primary to serve the call once it's up, got %s", gen.Provider)
+	}
+
+	secondary.down = true
+	primary.down = true
+	_, err = c.GenerateMessages(ctx, hello)
+	if err == nil || !strings.Contains(err.Error(), "primary: googleapi: Error 503: provider down") || !strings.Contains(err.Error(), "secondary: googleapi: Error 503: provider down") {
+		t.Errorf("Expected every provider's error, got %v", err)
+	}
+}
+
+func TestFallbackStream(t *testing.T) {
+	ctx := context.Background()
+	c, _ := newClient([]Provider{
+		{Name: "primary", Client: fake.NewLlmClient("Hello world")},
+	}, DefaultOptions(), time.Now)
+
+	stream, err := c.GenerateTextStream(ctx, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for chunk := range stream {
+		if chunk.Provider != "primary" {
+			t.Errorf("Expected every chunk from primary, got %+v", chunk)
+		}
+	}
+}
+
+func TestFallbackBreaker(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(0, 0)
+	primary := newDownClient(true)
+	secondary := newDownClient(false)
+	c, _ := newClient([]Provider{
+		{Name: "primary", Client: primary},
+		{Name: "secondary", Client: secondary},
+	}, Options{FailureThreshold: 2, Cooldown: time.Minute}, func() time.Time { return now })
+
+	for i := 0; i < 5; i++ {
+		if _, err := c.GenerateMessages(ctx, hello); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if primary.calls != 2 {
+		t.Errorf("Expected the breaker to stop calls after 2 failures, got %d calls", primary.calls)
+	}
+	if c.States()["primary"] != Open || c.States()["secondary"] != Closed {
+		t.Errorf("Unexpected breaker states %v", c.States())
+	}
+
+	// After the cooldown a trial call finds the primary is back.
+	primary.down = false
+	now = now.Add(time.Minute)
+	gen, err := c.GenerateMessages(ctx, hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gen.Provider != "primary" || c.States()["primary"] != Closed {
+		t.Errorf("Expected the primary to recover, got %s and %v", gen.Provider, c.States())
+	}
+
+	// Every breaker open fails fast.
+	primary.down, secondary.down = true, true
+	for i := 0; i < 2; i++ {
+		c.GenerateMessages(ctx, hello)
+	}
+	calls := primary.calls + secondary.calls
+	if _, err := c.GenerateMessages(ctx, hello); !errors.Is(err, ErrOpen) {
+		t.Errorf("Expected ErrOpen, got %v", err)
+	}
+	if primary.calls+secondary.calls != calls {
+		t.Error("Expected no calls while every breaker is open")
+	}
+}
+
+func TestFallbackCanceled(t *testing.T) {
+	primary := newDownClient(true)
+	secondary := newDownClient(false)
+	c, _ := newClient([]Provider{
+		{Name: "primary", Client: primary},
+		{Name: "secondary", Client: secondary},
+	}, Options{FailureThreshold: 1, Cooldown: time.Minute}, time.Now)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.GenerateMessages(ctx, hello); err == nil {
+		t.Fatal("Expected an error")
+	}
+	if secondary.calls != 0 || c.States()["primary"] != Closed {
+		t.Errorf("Expected a canceled call not to fall back or trip the breaker, got %v", c.States())
+	}
+}
+
+// Fails every call as a bad request.
+type invalidClient struct {
+	*downClient
+}
+
+func (c *invalidClient) GenerateMessages(ctx context.Context, messages []llm.Message) (*llm.Generation, error) {
+	c.fail()
+	return nil, status.Error(codes.InvalidArgument, "bad prompt")
+}
+
+func TestFallbackInvalidRequest(t *testing.T) {
+	ctx := context.Background()
+	primary := &invalidClient{newDownClient(false)}
+	secondary := newDownClient(false)
+	c, _ := newClient([]Provider{
+		{Name: "primary", Client: primary},
+		{Name: "secondary", Client: secondary},
+	}, Options{FailureThreshold: 2, Cooldown: time.Minute}, time.Now)
+
+	for i := 0; i < 3; i++ {
+		_, err := c.GenerateMessages(ctx, hello)
+		if status.Code(err) != codes.InvalidArgument {
+			t.Fatalf("Expected the invalid argument error as is, got %v", err)
+		}
+	}
+	if primary.calls != 3 || secondary.calls != 0 {
+		t.Errorf("Expected bad requests not to fall back, got %d and %d calls", primary.calls, secondary.calls)
+	}
+	if c.States()["primary"] != Closed {
+		t.Errorf("Expected bad requests not to open the breaker, got %s", c.States()["primary"])
+	}
+}
+
+func TestFallbackEmbeddings(t *testing.T) {
+	ctx := context.Background()
+	primary := newDownClient(true)
+	other := newDownClient(false)
+	same := newDownClient(false)
+	c, _ := newClient([]Provider{
+		{Name: "primary", Client: primary},
+		{Name: "other", Client: other},
+		{Name: "same", Client: same, SharedEmbeddings: true},
+	}, DefaultOptions(), time.Now)
+
+	if _, err := c.EmbedText(ctx, "hello", llm.QueryEmbedding()); err != nil {
+		t.Fatal(err)
+	}
+	if other.calls != 0 || same.calls != 1 {
+		t.Errorf("Expected embeddings only from providers sharing the primary's, got %d and %d calls", other.calls, same.calls)
+	}
+}
+
+func TestFunctionCaller(t *testing.T) {
+	caller, _ := NewClient([]Provider{{Name: "a", Client: fake.NewFunctionCallingClient()}}, DefaultOptions())
+	if _, ok := caller.(llm.FunctionCaller); !ok {
+		t.Error("Expected function calling when every provider can")
+	}
+	mixed, _ := NewClient([]Provider{
+		{Name: "a", Client: fake.NewFunctionCallingClient()},
+		{Name: "b", Client: fake.NewLlmClient()},
+	}, DefaultOptions())
+	if _, ok := mixed.(llm.FunctionCaller); ok {
+		t.Error("Expected no function calling when a provider can't")
+	}
+	if _, err := NewClient(nil, DefaultOptions()); err == nil {
+		t.Error("Expected an error without providers")
+	}
+}
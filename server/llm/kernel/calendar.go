@@ -0,0 +1,64 @@
+package kernel
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"time"
+
+	"github.com/rcleveng/assistant/server/calendar"
+	"github.com/rcleveng/assistant/server/env"
+)
+
+// Looks up events for the CALENDAR command.
+type CalendarProvider interface {
+	// Returns the events on the day containing day, in day's location.
+	Events(ctx context.Context, day time.Time) ([]calendar.Event, error)
+}
+
+// Creates the calendar provider configured in the environment, returns nil
+// if there isn't one.
+func NewCalendarProvider(ctx context.Context, environment *env.Environment) (CalendarProvider, error) {
+	location, err := environment.Location()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case environment.CalendarICalSource != "":
+		return calendar.NewICalProvider(environment.CalendarICalSource, location), nil
+	case environment.GoogleCalendarID != "":
+		provider, err := calendar.NewGoogleProvider(ctx, environment.GoogleCalendarID)
+		if err != nil {
+			return nil, err
+		}
+		return provider, nil
+	default:
+		return nil, nil
+	}
+}
+
+var isoDate = regexp.MustCompile(`\d{4}-\d{2}-\d{2}`)
+
+// CALENDAR tool, observes the events on the requested day so the model can
+// answer from them.
+func (k *HandRolledKernel) lookupCalendar(ctx context.Context, turn *Turn, args map[string]string) (ToolResult, error) {
+	request := args["date"]
+	if k.calendar == nil {
+		return ToolResult{Text: fmt.Sprintf("I would use the calendar to look up '%s', but no calendar is configured", request), Final: true}, nil
+	}
+
+	date := isoDate.FindString(request)
+	day, err := time.ParseInLocation(time.DateOnly, date, k.location)
+	if err != nil {
+		return ToolResult{Text: fmt.Sprintf("'%s' is not a date in ISO-8601 format (YYYY-MM-DD)", request)}, nil
+	}
+
+	events, err := k.calendar.Events(ctx, day)
+	if err != nil {
+		return ToolResult{}, fmt.Errorf("error looking up calendar for %s: %w", date, err)
+	}
+	slog.InfoContext(ctx, "found calendar events", "day", date, "count", len(events))
+
+	return ToolResult{Text: fmt.Sprintf("Calendar for %s:\n%s", day.Format("Monday January 2, 2006"), calendar.FormatEvents(events))}, nil
+}
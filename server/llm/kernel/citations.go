@@ -0,0 +1,128 @@
+package kernel
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/rcleveng/assistant/server/db"
+)
+
+// Longest snippet of a source kept on a citation.
+const maxSnippetLength = 120
+
+// A numbered source the answer was based on.
+type Citation struct {
+	// The number the answer refers to it by, as in [1]
+	Number int `json:"number"`
+	// The memory or document chunk
+	ID int64 `json:"id"`
+	// Title of the document, empty for memories
+	Title string `json:"title,omitempty"`
+	// URI of the document, empty for memories
+	Source  string `json:"source,omitempty"`
+	Chunk   int    `json:"chunk,omitempty"`
+	Snippet string `json:"snippet,omitempty"`
+}
+
+// Returns the name to show for the citation.
+func (c Citation) Label() string {
+	switch {
+	case c.Title != "":
+		return c.Title
+	case c.Source != "":
+		return c.Source
+	default:
+		return c.Snippet
+	}
+}
+
+// Returns the source if it can be opened in a browser, otherwise "".
+func (c Citation) Link() string {
+	if strings.HasPrefix(c.Source, "https://") || strings.HasPrefix(c.Source, "http://") {
+		return c.Source
+	}
+	return ""
+}
+
+// Returns "[1] Label" for each citation, one per line.
+func FormatCitations(citations []Citation) string {
+	lines := make([]string, len(citations))
+	for i, c := range citations {
+		lines[i] = fmt.Sprintf("[%d] %s", c.Number, c.Label())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Returns the context given to the model, each match is numbered so the
+// answer can cite it.
+func numberedContext(matches []db.Match, citations []Citation) []string {
+	context := make([]string, len(matches))
+	for i, m := range matches {
+		if citations[i].Title != "" {
+			context[i] = fmt.Sprintf("[%d] (from %s) %s", citations[i].Number, citations[i].Title, m.Content)
+		} else {
+			context[i] = fmt.Sprintf("[%d] %s", citations[i].Number, m.Content)
+		}
+	}
+	return context
+}
+
+// Returns a citation for each match, numbered from 1.  Titles are looked up
+// when the database stores documents.
+func (k *HandRolledKernel) citations(ctx context.Context, matches []db.Match) []Citation {
+	docs, _ := k.db.(db.DocumentsDB)
+	titles := map[string]string{}
+	citations := make([]Citation, len(matches))
+	for i, m := range matches {
+		c := Citation{Number: i + 1, ID: m.ID, Source: m.Source, Chunk: m.Chunk, Snippet: snippet(m.Content)}
+		if docs != nil && m.Source != "" {
+			title, found := titles[m.Source]
+			if !found {
+				if doc, err := docs.Document(ctx, m.Source); err == nil {
+					title = doc.Title
+				}
+				titles[m.Source] = title
+			}
+			c.Title = title
+		}
+		citations[i] = c
+	}
+	return citations
+}
+
+// Matches [1] and [1, 2] in an answer.
+var citationPattern = regexp.MustCompile(`\[(\d+(?:\s*,\s*\d+)*)\]`)
+
+// Returns the citations the answer refers to, in the order they are first
+// cited.  Numbers the model made up are ignored.
+func cited(answer string, citations []Citation) []Citation {
+	result := make([]Citation, 0)
+	seen := map[int]bool{}
+	for _, match := range citationPattern.FindAllStringSubmatch(answer, -1) {
+		for _, s := range strings.Split(match[1], ",") {
+			n, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil || n < 1 || n > len(citations) || seen[n] {
+				continue
+			}
+			seen[n] = true
+			result = append(result, citations[n-1])
+		}
+	}
+	return result
+}
+
+// Returns the start of text on one line.
+func snippet(text string) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if len(text) <= maxSnippetLength {
+		return text
+	}
+	cut := strings.LastIndex(text[:maxSnippetLength], " ")
+	if cut <= 0 {
+		cut = maxSnippetLength
+	}
+	return text[:cut] + "..."
+}
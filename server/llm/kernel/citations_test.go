@@ -0,0 +1,93 @@
+package kernel
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rcleveng/assistant/server/db"
+	"github.com/rcleveng/assistant/server/llm/fake"
+	"github.com/rcleveng/assistant/server/session"
+)
+
+func TestCited(t *testing.T) {
+	citations := []Citation{{Number: 1, Snippet: "one"}, {Number: 2, Snippet: "two"}, {Number: 3, Snippet: "three"}}
+	tests := []struct {
+		answer string
+		want   []int
+	}{
+		{"No sources.", nil},
+		{"It is blue [2].", []int{2}},
+		{"See [3] and [1], also [3] again.", []int{3, 1}},
+		{"Both [1, 2].", []int{1, 2}},
+		{"Made up [0] [4] [x].", nil},
+	}
+	for _, tc := range tests {
+		got := cited(tc.answer, citations)
+		numbers := make([]int, len(got))
+		for i, c := range got {
+			numbers[i] = c.Number
+		}
+		if len(numbers) != len(tc.want) {
+			t.Errorf("cited(%q) = %v, want %v", tc.answer, numbers, tc.want)
+			continue
+		}
+		for i := range numbers {
+			if numbers[i] != tc.want[i] {
+				t.Errorf("cited(%q) = %v, want %v", tc.answer, numbers, tc.want)
+			}
+		}
+	}
+}
+
+func TestSnippet(t *testing.T) {
+	long := strings.Repeat("word ", 50)
+	if got := snippet(long); len(got) > maxSnippetLength+3 || !strings.HasSuffix(got, "word...") {
+		t.Errorf("Expected a snippet cut at a word, got %q", got)
+	}
+	if got := snippet("  short\n text "); got != "short text" {
+		t.Errorf("Expected whitespace to be collapsed, got %q", got)
+	}
+}
+
+func TestChatCitations(t *testing.T) {
+	ctx := context.Background()
+	edb, err := db.NewSQLiteDatabase(ctx, filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := "The office opens at 8am on weekdays"
+	doc := db.Document{URI: "https://example.com/handbook", Title: "Handbook", Hash: "abc"}
+	if _, err := edb.PutDocument(ctx, doc, 0, db.GlobalScope, []db.Chunk{{Content: text, Embedding: fake.HashEmbedding(text)}}); err != nil {
+		t.Fatal(err)
+	}
+	memory := "The office wifi is slow on weekdays"
+	if _, err := edb.Add(ctx, 0, "", db.GlobalScope, memory, fake.HashEmbedding(memory)); err != nil {
+		t.Fatal(err)
+	}
+
+	client := fake.NewLlmClient("ANSWER: It opens at 8am [1].")
+	k := NewHandRolledKernelWithClients(client, edb, session.NewMemoryStore())
+	k.SetMinSimilarity(0.1)
+
+	resp, err := k.Chat(ctx, BasicSpeaker("rob"), "s1", "When does the office open on weekdays?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Text != "It opens at 8am [1]." {
+		t.Errorf("Expected the answer, got %q", resp.Text)
+	}
+	citations := resp.Citations
+	prompt := client.LastPrompt()
+	if !strings.Contains(prompt, "[1] (from Handbook) "+text) || !strings.Contains(prompt, "[2] "+memory) {
+		t.Errorf("Expected numbered context in the prompt, got %s", prompt)
+	}
+	if len(citations) != 1 {
+		t.Fatalf("Expected only the cited source, got %#v", citations)
+	}
+	c := citations[0]
+	if c.Number != 1 || c.Title != "Handbook" || c.Link() != "https://example.com/handbook" || c.Snippet != text {
+		t.Errorf("Expected the handbook citation, got %#v", c)
+	}
+}
@@ -2,100 +2,534 @@ package kernel
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"strings"
+	"time"
 
 	"github.com/rcleveng/assistant/server/db"
 	"github.com/rcleveng/assistant/server/env"
 	"github.com/rcleveng/assistant/server/llm"
 	"github.com/rcleveng/assistant/server/llm/palm"
+	"github.com/rcleveng/assistant/server/session"
+)
+
+// Number of previous turns sent along with each question.
+const maxHistoryTurns = 20
+
+// Number of clarifying questions asked before giving up on a question.
+const maxClarifyingQuestions = 3
+
+// Default budget for answering a single question.
+const (
+	defaultMaxSteps    = 5
+	defaultMaxDuration = 60 * time.Second
+)
+
+// Memories added to the prompt as context, less similar memories are
+// unlikely to help and only distract the model.
+const (
+	maxContextMatches    = 2
+	defaultMinSimilarity = 0.5
+)
+
+// Memories considered by FORGET, which must be a close match so the wrong
+// memory isn't deleted.
+const (
+	maxForgetCandidates = 5
+	forgetMinSimilarity = 0.7
 )
 
 type HandRolledKernel struct {
-	llm llm.LlmClient
-	db  db.EmbeddingsDB
+	llm      llm.LlmClient
+	db       db.EmbeddingsDB
+	sessions session.Store
+	calendar CalendarProvider
+	// Location used to interpret calendar dates
+	location *time.Location
+	tools    *ToolRegistry
+
+	maxSteps    int
+	maxDuration time.Duration
+	// Minimum cosine similarity for a memory to be used as context
+	minSimilarity float32
+	// How memories are found for context
+	searchMode db.SearchMode
+	diversity  float32
 }
 
 func NewHandRolledKernel(ctx context.Context, environment *env.Environment) (*HandRolledKernel, error) {
-	llm, err := palm.NewPalmLLMClient(ctx, environment)
+	llm, err := palm.NewClientForEnvironment(ctx, environment)
+	if err != nil {
+		return nil, err
+	}
+
+	edb, err := db.NewEmbeddingsDB(ctx, environment)
 	if err != nil {
 		return nil, err
 	}
 
-	edb, err := db.NewPostgresDatabase(environment)
+	sessions, err := session.NewStore(ctx, environment, edb)
 	if err != nil {
 		return nil, err
 	}
 
-	return &HandRolledKernel{
-		llm: llm,
-		db:  edb,
-	}, nil
+	calendar, err := NewCalendarProvider(ctx, environment)
+	if err != nil {
+		return nil, err
+	}
+	location, err := environment.Location()
+	if err != nil {
+		return nil, err
+	}
+
+	mode, err := db.ParseSearchMode(environment.SearchMode)
+	if err != nil {
+		return nil, err
+	}
+
+	k := NewHandRolledKernelWithClients(llm, edb, sessions)
+	k.SetCalendar(calendar, location)
+	k.SetSearch(mode, environment.SearchDiversity)
+	return k, nil
+}
+
+// Creates a kernel from existing clients, the kernel takes ownership of them.
+func NewHandRolledKernelWithClients(llm llm.LlmClient, edb db.EmbeddingsDB, sessions session.Store) *HandRolledKernel {
+	k := &HandRolledKernel{
+		llm:           llm,
+		db:            edb,
+		sessions:      sessions,
+		location:      time.Local,
+		tools:         NewToolRegistry(),
+		maxSteps:      defaultMaxSteps,
+		maxDuration:   defaultMaxDuration,
+		minSimilarity: defaultMinSimilarity,
+		searchMode:    db.VectorSearch,
+	}
+	for _, t := range k.builtinTools() {
+		if err := k.tools.Register(t); err != nil {
+			panic(err)
+		}
+	}
+	return k
+}
+
+// Sets the calendar used to answer CALENDAR requests, dates are interpreted
+// in location.
+func (k *HandRolledKernel) SetCalendar(calendar CalendarProvider, location *time.Location) {
+	k.calendar = calendar
+	if location != nil {
+		k.location = location
+	}
+}
+
+// Limits the number of model calls and the time spent answering a question.
+func (k *HandRolledKernel) SetBudget(maxSteps int, maxDuration time.Duration) {
+	k.maxSteps = maxSteps
+	k.maxDuration = maxDuration
+}
+
+// Sets how similar a memory must be to the question to be used as context.
+func (k *HandRolledKernel) SetMinSimilarity(minSimilarity float32) {
+	k.minSimilarity = minSimilarity
+}
+
+// Sets how memories are found for context, see db.FindOptions.
+func (k *HandRolledKernel) SetSearch(mode db.SearchMode, diversity float32) {
+	k.searchMode = mode
+	k.diversity = diversity
+}
+
+// The tools offered to the model, register more before the first Chat.
+func (k *HandRolledKernel) Tools() *ToolRegistry {
+	return k.tools
+}
+
+func (k *HandRolledKernel) builtinTools() []Tool {
+	return []Tool{{
+		Name:        "ANSWER",
+		Description: "If you can answer the question please respond with the answer.",
+		Args: []ToolArg{
+			{Name: "answer", Type: "string", Description: "The answer to the question", Required: true},
+		},
+		Run: func(ctx context.Context, turn *Turn, args map[string]string) (ToolResult, error) {
+			return ToolResult{Text: args["answer"], Final: true}, nil
+		},
+	}, {
+		Name:        "REMEMBER",
+		Description: "If you are asked to remember something, respond with the text to remember.",
+		Args: []ToolArg{
+			{Name: "text", Type: "string", Description: "The text you are asked to remember", Required: true},
+			{Name: "scope", Type: "string", Description: "Who can see it: user (the default), channel or global"},
+		},
+		Run: k.remember,
+	}, {
+		Name:        "FORGET",
+		Description: "If you are asked to forget something, respond with the text to forget.",
+		Args: []ToolArg{
+			{Name: "text", Type: "string", Description: "The text you are asked to forget", Required: true},
+		},
+		Run: k.forget,
+	}, {
+		Name:        "CALENDAR",
+		Description: "If you need to know what is on the calendar to answer the question, respond with the day to look up.",
+		Args: []ToolArg{
+			{Name: "date", Type: "string", Description: "The day to look up in ISO-8601 format (YYYY-MM-DD)", Required: true},
+		},
+		Run: k.lookupCalendar,
+	}, {
+		Name:        "NEEDMORE",
+		Description: "If you still need more information from the user to answer the question, respond with the question to ask the user.",
+		Args: []ToolArg{
+			{Name: "question", Type: "string", Description: "The question to ask the user", Required: true},
+		},
+		Run: k.needMore,
+	}}
 }
 
+func (k *HandRolledKernel) remember(ctx context.Context, turn *Turn, args map[string]string) (ToolResult, error) {
+	text := args["text"]
+	scope, err := turn.Speaker.Scope(args["scope"])
+	if err != nil {
+		return ToolResult{}, fmt.Errorf("error trying to remember: %w", err)
+	}
+	emb, err := k.llm.EmbedText(ctx, text, llm.DocumentEmbedding(""))
+	if err != nil {
+		return ToolResult{}, fmt.Errorf("error trying to remember (emb) '%s': %w", text, err)
+	}
+	_, err = k.db.Add(ctx, 0, turn.Speaker.ID, scope, text, emb)
+	if err != nil {
+		return ToolResult{}, fmt.Errorf("error trying to remember (db) '%s': %w", text, err)
+	}
+	return ToolResult{Text: fmt.Sprintf("I will remember that '%s'", text), Final: true}, nil
+}
+
+// Deletes the speaker's memory closest to the text.  Only memories the
+// speaker asked to remember can be forgotten.
+func (k *HandRolledKernel) forget(ctx context.Context, turn *Turn, args map[string]string) (ToolResult, error) {
+	text := args["text"]
+	emb, err := k.llm.EmbedText(ctx, text, llm.QueryEmbedding())
+	if err != nil {
+		return ToolResult{}, fmt.Errorf("error trying to forget (emb) '%s': %w", text, err)
+	}
+	matches, err := k.db.Find(ctx, emb, db.FindOptions{
+		Count:         maxForgetCandidates,
+		MinSimilarity: forgetMinSimilarity,
+		Scopes:        turn.Speaker.Scopes(),
+	})
+	if err != nil {
+		return ToolResult{}, fmt.Errorf("error trying to forget (db) '%s': %w", text, err)
+	}
+	for _, m := range matches {
+		if turn.Speaker.ID == "" || m.Owner != turn.Speaker.ID {
+			continue
+		}
+		if err := k.db.Delete(ctx, m.ID); err != nil {
+			return ToolResult{}, fmt.Errorf("error trying to forget (db) '%s': %w", text, err)
+		}
+		slog.InfoContext(ctx, "forgot memory", "id", m.ID, "owner", m.Owner, "similarity", m.Similarity)
+		return ToolResult{Text: fmt.Sprintf("I have forgotten that '%s'", m.Content), Final: true}, nil
+	}
+	return ToolResult{Text: fmt.Sprintf("I couldn't find anything you asked me to remember about '%s'", text), Final: true}, nil
+}
+
+// Parks the question on the session and returns the clarifying question to
+// ask the user, or gives up after maxClarifyingQuestions.
+func (k *HandRolledKernel) needMore(ctx context.Context, turn *Turn, args map[string]string) (ToolResult, error) {
+	clarifying := args["question"]
+	if turn.SessionId == "" {
+		return ToolResult{Text: clarifying, Final: true, FollowUp: true}, nil
+	}
+	pending := turn.Pending
+	turn.Pending = nil
+	if pending == nil {
+		pending = &session.Pending{Question: turn.Question}
+	}
+	pending.Rounds++
+	if pending.Rounds > maxClarifyingQuestions {
+		slog.InfoContext(ctx, "giving up on clarifying question", "session", turn.SessionId, "question", pending.Question)
+		if err := k.sessions.SetPending(ctx, turn.SessionId, nil); err != nil {
+			return ToolResult{}, err
+		}
+		return ToolResult{Text: fmt.Sprintf("Sorry, I still don't have enough information to answer '%s'.", pending.Question), Final: true}, nil
+	}
+	if err := k.sessions.SetPending(ctx, turn.SessionId, pending); err != nil {
+		return ToolResult{}, err
+	}
+	return ToolResult{Text: clarifying, Final: true, FollowUp: true}, nil
+}
+
+// Runs a single tool outside of the agent loop.
 func (k *HandRolledKernel) RunChain(ctx context.Context, cmd, rest, name string) (string, error) {
-	switch cmd {
-	case "ANSWER":
-		return rest, nil
-	case "NEEDMORE":
-		// TODO - ask this as a follow up, then add the next answer to the context and
-		// retry the original question
-		return rest, nil
-	case "CALENDAR":
-		return fmt.Sprintf("I would use the calendar to look up '%s'", rest), nil
-	case "REMEMBER":
-		emb, err := k.llm.EmbedText(ctx, rest)
-		if err != nil {
-			return rest, fmt.Errorf("error trying to remember (emb): '%s'", rest)
+	tool, found := k.tools.Lookup(cmd)
+	if !found {
+		return cmd + " " + rest, nil
+	}
+	result, err := tool.Run(ctx, &Turn{Speaker: BasicSpeaker(name), Question: rest}, textArgs(tool, rest))
+	if err != nil {
+		return rest, err
+	}
+	return result.Text, nil
+}
+
+// Loads the question parked on the session, if any, and merges text into it
+// as the answer to the clarifying question.
+func (k *HandRolledKernel) pendingQuestion(ctx context.Context, sessionId, text string) *session.Pending {
+	if sessionId == "" {
+		return nil
+	}
+	pending, err := k.sessions.Pending(ctx, sessionId)
+	if err != nil {
+		slog.WarnContext(ctx, "unable to load pending question", "session", sessionId, "error", err)
+		return nil
+	}
+	if pending != nil {
+		pending.Answers = append(pending.Answers, text)
+	}
+	return pending
+}
+
+// A tool the model asked to run.
+type invocation struct {
+	name string
+	// nil if the model asked for a function that doesn't exist
+	tool *Tool
+	args map[string]string
+	// Set when the model used native function calling
+	call *llm.FunctionCall
+}
+
+// Returns the tools the model asked to run, from function calls if there are
+// any, otherwise from commands in the text.
+func (k *HandRolledKernel) invocations(generation *llm.Generation, parser *ResponseParser) []invocation {
+	invocations := make([]invocation, 0)
+	for i := range generation.FunctionCalls {
+		call := &generation.FunctionCalls[i]
+		tool, _ := k.tools.Lookup(call.Name)
+		invocations = append(invocations, invocation{name: call.Name, tool: tool, args: callArgs(*call), call: call})
+	}
+	if len(invocations) > 0 {
+		return invocations
+	}
+
+	for _, action := range parser.Parse(generation.Text) {
+		if tool, found := k.tools.Lookup(action.Command); found {
+			invocations = append(invocations, invocation{name: tool.Name, tool: tool, args: textArgs(tool, action.Argument)})
+		}
+	}
+	return invocations
+}
+
+// Runs the agent loop, model → tool → observation → model, until a tool
+// gives the final answer or the step or time budget runs out.
+func (k *HandRolledKernel) run(ctx context.Context, turn *Turn, messages []llm.Message) (*Trace, error) {
+	start := time.Now()
+	trace := newTrace(turn.SessionId, turn.Question)
+	defer func() {
+		trace.Duration = time.Since(start)
+		trace.log(ctx)
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, k.maxDuration)
+	defer cancel()
+
+	// Use structured function calls when the provider supports them,
+	// otherwise parse commands from the text.
+	caller, native := k.llm.(llm.FunctionCaller)
+	var functions []llm.FunctionDeclaration
+	if native {
+		functions = k.tools.Declarations()
+	}
+
+	parser := NewResponseParser(k.tools.Names(), "ANSWER", FallbackAnswer)
+
+	for i := 0; i < k.maxSteps; i++ {
+		stepStart := time.Now()
+		var generation *llm.Generation
+		var err error
+		if native {
+			generation, err = caller.GenerateWithFunctions(ctx, messages, functions)
+		} else {
+			generation, err = k.llm.GenerateMessages(ctx, messages)
+		}
+		if errors.Is(err, context.DeadlineExceeded) && i > 0 {
+			break
 		}
-		_, err = k.db.Add(0, rest, emb)
 		if err != nil {
-			return rest, fmt.Errorf("error trying to remember (db): '%s'", rest)
+			return trace, err
+		}
+		trace.addGeneration(generation)
+
+		invocations := k.invocations(generation, parser)
+		if len(invocations) == 0 {
+			// Nothing to run, so take the response as the answer.
+			trace.record(ctx, Step{Response: generation.Text, Result: generation.Text, Final: true, Duration: time.Since(stepStart)})
+			trace.Answer = generation.Text
+			return trace, nil
+		}
+
+		// Run everything the model asked for, any final results are the
+		// answer, otherwise the observations go back to the model.
+		var finals, observations []string
+		var calls, responses []llm.Part
+		for _, inv := range invocations {
+			step := Step{Response: generation.Text, Tool: inv.name, Args: inv.args}
+			if inv.call != nil {
+				step.Response = fmt.Sprintf("%s(%v)", inv.call.Name, inv.call.Args)
+			}
+
+			var result ToolResult
+			if inv.tool == nil {
+				result = ToolResult{Text: fmt.Sprintf("There is no function named '%s'", inv.name)}
+			} else if result, err = inv.tool.Run(ctx, turn, inv.args); err != nil {
+				step.Error = err.Error()
+				step.Duration = time.Since(stepStart)
+				trace.record(ctx, step)
+				return trace, err
+			}
+			step.Result = result.Text
+			step.Final = result.Final
+			step.FollowUp = result.FollowUp
+			step.Duration = time.Since(stepStart)
+			trace.record(ctx, step)
+
+			switch {
+			case result.Final:
+				finals = append(finals, result.Text)
+			case inv.call != nil:
+				calls = append(calls, llm.Part{FunctionCall: inv.call})
+				responses = append(responses, llm.Part{FunctionResponse: &llm.FunctionResponse{
+					Name:     inv.call.Name,
+					Response: map[string]any{"result": result.Text},
+				}})
+			default:
+				observations = append(observations, fmt.Sprintf("OBSERVATION from %s:\n%s", inv.name, result.Text))
+			}
+		}
+
+		if len(finals) > 0 {
+			trace.Answer = strings.Join(finals, "\n")
+			return trace, nil
+		}
+		if len(calls) > 0 {
+			messages = append(messages,
+				llm.Message{Role: llm.RoleModel, Parts: calls},
+				llm.Message{Role: llm.RoleTool, Parts: responses})
+		} else {
+			messages = append(messages,
+				llm.NewMessage(llm.RoleModel, generation.Text),
+				llm.NewMessage(llm.RoleTool, strings.Join(observations, "\n\n")))
+		}
+		if ctx.Err() != nil {
+			break
 		}
-		return fmt.Sprintf("I will remember that '%s'", rest), nil
-	default:
-		return cmd + " " + rest, nil
 	}
 
+	slog.WarnContext(ctx, "kernel ran out of budget", "session", turn.SessionId, "steps", len(trace.Steps))
+	trace.Answer = "Sorry, I wasn't able to finish answering that."
+	return trace, nil
 }
 
-func (k *HandRolledKernel) Chat(ctx context.Context, name, sessionId, text string) (string, error) {
+func (k *HandRolledKernel) Chat(ctx context.Context, speaker Speaker, sessionId, text string) (*Response, error) {
+	// If we asked a clarifying question, this is the answer so retry the
+	// original question with it.
+	turn := &Turn{Speaker: speaker, SessionId: sessionId, Question: text}
+	turn.Pending = k.pendingQuestion(ctx, sessionId, text)
+	if turn.Pending != nil {
+		turn.Question = turn.Pending.MergedQuestion()
+	}
 
-	emb, err := k.llm.EmbedText(ctx, text)
+	emb, err := k.llm.EmbedText(ctx, turn.Question, llm.QueryEmbedding())
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	context, err := k.db.Find(emb, 2)
+	matches, err := k.db.Find(ctx, emb, db.FindOptions{
+		Count:         maxContextMatches,
+		MinSimilarity: k.minSimilarity,
+		Scopes:        speaker.Scopes(),
+		Mode:          k.searchMode,
+		Query:         turn.Question,
+		Diversity:     k.diversity,
+	})
 	if err != nil {
-		context = []string{}
+		slog.WarnContext(ctx, "unable to find context", "error", err)
+		matches = []db.Match{}
+	}
+	for _, m := range matches {
+		slog.DebugContext(ctx, "using context", "id", m.ID, "similarity", m.Similarity)
 	}
+	citations := k.citations(ctx, matches)
+	context := numberedContext(matches, citations)
 
-	prompt, err := llm.ChatPrompt(text, context)
+	var history []session.Turn
+	if sessionId != "" {
+		history, err = k.sessions.History(ctx, sessionId, maxHistoryTurns)
+		if err != nil {
+			slog.WarnContext(ctx, "unable to load session history", "session", sessionId, "error", err)
+		}
+	}
+
+	// With native function calling the tools are declared as functions
+	// rather than described in the prompt.
+	tools := k.tools.Describe()
+	if _, native := k.llm.(llm.FunctionCaller); native {
+		tools = ""
+	}
+	messages, err := llm.ChatMessages(turn.Question, context, session.Messages(history), tools)
 	if err != nil {
-		fmt.Println("error generating chat prompt", err.Error())
-		prompt = text
+		slog.WarnContext(ctx, "unable to generate chat prompt", "error", err)
+		messages = []llm.Message{llm.NewMessage(llm.RoleUser, turn.Question)}
 	}
-	responseText, err := k.llm.GenerateText(ctx, prompt)
+
+	trace, err := k.run(ctx, turn, messages)
 	if err != nil {
-		return "", err
+		return nil, fmt.Errorf("running chain failed: %w", err)
+	}
+	resp := &Response{
+		Text:      trace.Answer,
+		Citations: cited(trace.Answer, citations),
+		Usage:     trace.Usage,
+		Provider:  trace.Provider,
+		TraceID:   trace.ID,
+	}
+	if step := trace.finalStep(); step != nil {
+		resp.Action = step.Tool
+		resp.Args = step.Args
+		resp.FollowUp = step.FollowUp
 	}
 
-	// TODO - process response for remembering, looking up calendar and starting chain, etc
-	cmd, rest, found := strings.Cut(responseText, " ")
-	if found && cmd[len(cmd)-1:] == ":" {
-		// we have a command
-		cmd = cmd[:len(cmd)-1]
-		responseText, err = k.RunChain(ctx, cmd, rest, name)
+	if turn.Pending != nil {
+		// The question was answered, stop waiting for more information.
+		if err := k.sessions.SetPending(ctx, sessionId, nil); err != nil {
+			slog.WarnContext(ctx, "unable to clear pending question", "session", sessionId, "error", err)
+		}
+	}
+
+	if sessionId != "" {
+		err = k.sessions.Append(ctx, sessionId,
+			session.Turn{Role: llm.RoleUser, Text: text},
+			session.Turn{Role: llm.RoleModel, Text: resp.Text})
 		if err != nil {
-			fmt.Println("running chain failed ", err.Error())
-			return "", err
+			slog.WarnContext(ctx, "unable to save session turns", "session", sessionId, "error", err)
 		}
 	}
-	return responseText, nil
+	return resp, nil
+}
+
+func (k *HandRolledKernel) Ping(ctx context.Context) error {
+	return k.db.Ping(ctx)
 }
 
 func (k *HandRolledKernel) Close() error {
+	if k.sessions != nil {
+		k.sessions.Close()
+	}
+	if k.db != nil {
+		k.db.Close()
+	}
 	if k.llm != nil {
 		return k.llm.Close()
 	}
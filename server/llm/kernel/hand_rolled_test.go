@@ -0,0 +1,399 @@
+package kernel
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rcleveng/assistant/server/calendar"
+	"github.com/rcleveng/assistant/server/db"
+	"github.com/rcleveng/assistant/server/llm"
+	"github.com/rcleveng/assistant/server/llm/fake"
+	"github.com/rcleveng/assistant/server/session"
+)
+
+func TestChatSendsHistory(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewLlmClient("ANSWER: Paris", "ANSWER: About 2 million")
+	k := NewHandRolledKernelWithClients(client, db.NoopEmbeddingsDB{}, session.NewMemoryStore())
+
+	resp, err := k.Chat(ctx, BasicSpeaker("rob"), "s1", "What is the capital of France?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Text != "Paris" {
+		t.Errorf("Expected 'Paris' got '%s'", resp.Text)
+	}
+
+	if _, err := k.Chat(ctx, BasicSpeaker("rob"), "s1", "How many people live there?"); err != nil {
+		t.Fatal(err)
+	}
+	prompt := client.LastPrompt()
+	for _, want := range []string{"What is the capital of France?", "Paris", "USERQUESTION: How many people live there?"} {
+		if !strings.Contains(prompt, want) {
+			t.Errorf("Expected prompt to contain '%s', got %s", want, prompt)
+		}
+	}
+
+	if _, err := k.Chat(ctx, BasicSpeaker("rob"), "s2", "Hello"); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(client.LastPrompt(), "France") {
+		t.Error("Expected a new session to not include other sessions history")
+	}
+}
+
+func TestChatNeedMore(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewLlmClient("NEEDMORE: Which city?", "ANSWER: It is sunny in Seattle")
+	sessions := session.NewMemoryStore()
+	k := NewHandRolledKernelWithClients(client, db.NoopEmbeddingsDB{}, sessions)
+
+	resp, err := k.Chat(ctx, BasicSpeaker("rob"), "s1", "What is the weather?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Text != "Which city?" || !resp.FollowUp || resp.Action != "NEEDMORE" {
+		t.Errorf("Expected clarifying question, got %#v", resp)
+	}
+	if p, _ := sessions.Pending(ctx, "s1"); p == nil || p.Question != "What is the weather?" {
+		t.Errorf("Expected original question to be pending, got %#v", p)
+	}
+
+	resp, err = k.Chat(ctx, BasicSpeaker("rob"), "s1", "Seattle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Text != "It is sunny in Seattle" || resp.FollowUp || resp.Action != "ANSWER" {
+		t.Errorf("Expected answer, got %#v", resp)
+	}
+	if !strings.Contains(client.LastPrompt(), "USERQUESTION: What is the weather?\n\nAdditional information:\nSeattle") {
+		t.Errorf("Expected original question to be retried with the answer, got %s", client.LastPrompt())
+	}
+	if p, _ := sessions.Pending(ctx, "s1"); p != nil {
+		t.Errorf("Expected pending question to be cleared, got %#v", p)
+	}
+}
+
+func TestChatNeedMoreGivesUp(t *testing.T) {
+	ctx := context.Background()
+	responses := make([]string, maxClarifyingQuestions+1)
+	for i := range responses {
+		responses[i] = "NEEDMORE: Which city?"
+	}
+	client := fake.NewLlmClient(responses...)
+	sessions := session.NewMemoryStore()
+	k := NewHandRolledKernelWithClients(client, db.NoopEmbeddingsDB{}, sessions)
+
+	var resp *Response
+	for i := range responses {
+		var err error
+		if resp, err = k.Chat(ctx, BasicSpeaker("rob"), "s1", "What is the weather?"); err != nil {
+			t.Fatal(err)
+		}
+		if i < maxClarifyingQuestions && resp.Text != "Which city?" {
+			t.Errorf("Expected clarifying question on round %d, got '%s'", i, resp.Text)
+		}
+	}
+	if !strings.HasPrefix(resp.Text, "Sorry") || resp.FollowUp {
+		t.Errorf("Expected to give up, got %#v", resp)
+	}
+	if p, _ := sessions.Pending(ctx, "s1"); p != nil {
+		t.Errorf("Expected pending question to be cleared, got %#v", p)
+	}
+}
+
+type testCalendar struct {
+	day time.Time
+}
+
+func (c *testCalendar) Events(ctx context.Context, day time.Time) ([]calendar.Event, error) {
+	c.day = day
+	return []calendar.Event{{
+		Summary: "Dentist",
+		Start:   day.Add(10 * time.Hour),
+		End:     day.Add(11 * time.Hour),
+	}}, nil
+}
+
+func TestChatCalendar(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewLlmClient("CALENDAR: I need to look up the calendar on 2023-12-14", "ANSWER: You see the dentist at 10")
+	k := NewHandRolledKernelWithClients(client, db.NoopEmbeddingsDB{}, session.NewMemoryStore())
+	cal := &testCalendar{}
+	k.SetCalendar(cal, time.UTC)
+
+	resp, err := k.Chat(ctx, BasicSpeaker("rob"), "s1", "What am I doing on Thursday?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Text != "You see the dentist at 10" {
+		t.Errorf("Expected answer from calendar, got '%s'", resp.Text)
+	}
+	if cal.day.Format(time.DateOnly) != "2023-12-14" {
+		t.Errorf("Expected calendar lookup for 2023-12-14, got %v", cal.day)
+	}
+	prompt := client.LastPrompt()
+	for _, want := range []string{"10:00 - 11:00: Dentist", "USERQUESTION: What am I doing on Thursday?"} {
+		if !strings.Contains(prompt, want) {
+			t.Errorf("Expected calendar prompt to contain '%s', got %s", want, prompt)
+		}
+	}
+}
+
+func TestChatTolerantResponses(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewLlmClient(
+		"Sure! Here you go:\n**ANSWER:** Paris",
+		"I should check.\n```\nCALENDAR: 2023-12-14\n```",
+		"answer: You are free all day",
+	)
+	k := NewHandRolledKernelWithClients(client, db.NoopEmbeddingsDB{}, session.NewMemoryStore())
+	k.SetCalendar(&testCalendar{}, time.UTC)
+
+	resp, err := k.Chat(ctx, BasicSpeaker("rob"), "s1", "What is the capital of France?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Text != "Paris" {
+		t.Errorf("Expected 'Paris' got '%s'", resp.Text)
+	}
+
+	resp, err = k.Chat(ctx, BasicSpeaker("rob"), "s1", "What am I doing on the 14th?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Text != "You are free all day" {
+		t.Errorf("Expected 'You are free all day' got '%s'", resp.Text)
+	}
+	if !strings.Contains(client.LastPrompt(), "OBSERVATION from CALENDAR") {
+		t.Errorf("Expected calendar observation in prompt, got %s", client.LastPrompt())
+	}
+}
+
+type testMemory struct {
+	owner     string
+	scope     db.Scope
+	text      string
+	embedding []float32
+}
+
+type testEmbeddingsDB struct {
+	db.NoopEmbeddingsDB
+	memories []testMemory
+}
+
+func (d *testEmbeddingsDB) Add(ctx context.Context, author int64, owner string, scope db.Scope, text string, embeddings []float32) (int64, error) {
+	d.memories = append(d.memories, testMemory{owner, scope, text, embeddings})
+	return int64(len(d.memories)), nil
+}
+
+// Returns every memory visible in opts.Scopes that is similar enough, in
+// the order they were added.
+func (d *testEmbeddingsDB) Find(ctx context.Context, embedding []float32, opts db.FindOptions) ([]db.Match, error) {
+	var found []db.Match
+	for i, m := range d.memories {
+		similarity := db.CosineSimilarity(embedding, m.embedding)
+		if similarity < opts.MinSimilarity {
+			continue
+		}
+		for _, s := range opts.Scopes {
+			if m.scope == s {
+				found = append(found, db.Match{ID: int64(i + 1), Content: m.text, Scope: m.scope, Similarity: similarity})
+			}
+		}
+	}
+	return found, nil
+}
+
+func TestChatScopedMemories(t *testing.T) {
+	ctx := context.Background()
+	remember := func(args map[string]any) *llm.Generation {
+		return &llm.Generation{FunctionCalls: []llm.FunctionCall{{Name: "REMEMBER", Args: args}}}
+	}
+	client := fake.NewFunctionCallingClient(
+		remember(map[string]any{"text": "my locker code is 1234"}),
+		remember(map[string]any{"text": "the standup is at 9", "scope": "channel"}),
+	)
+	edb := &testEmbeddingsDB{}
+	k := NewHandRolledKernelWithClients(client, edb, session.NewMemoryStore())
+	k.SetMinSimilarity(0)
+
+	alice := SlackSpeaker("UALICE", "CTEAM")
+	bob := SlackSpeaker("UBOB", "CTEAM")
+	if _, err := k.Chat(ctx, alice, "s1", "Remember my locker code is 1234"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := k.Chat(ctx, alice, "s1", "Remember for the channel that the standup is at 9"); err != nil {
+		t.Fatal(err)
+	}
+	if len(edb.memories) != 2 || edb.memories[0].owner != "slack:UALICE" || edb.memories[0].scope != "user:slack:UALICE" {
+		t.Fatalf("Expected a private memory owned by alice, got %#v", edb.memories)
+	}
+	if edb.memories[1].scope != "channel:slack:CTEAM" {
+		t.Fatalf("Expected a channel memory, got %#v", edb.memories[1])
+	}
+
+	if _, err := k.Chat(ctx, bob, "s2", "What is the locker code?"); err != nil {
+		t.Fatal(err)
+	}
+	prompt := client.LastPrompt()
+	if strings.Contains(prompt, "1234") {
+		t.Errorf("Expected alice's private memory to be hidden from bob, got %s", prompt)
+	}
+	if !strings.Contains(prompt, "standup is at 9") {
+		t.Errorf("Expected the channel memory to be visible to bob, got %s", prompt)
+	}
+
+	if _, err := k.Chat(ctx, alice, "s3", "What is the locker code?"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(client.LastPrompt(), "1234") {
+		t.Errorf("Expected alice to see her own memory, got %s", client.LastPrompt())
+	}
+}
+
+func TestChatContextSimilarity(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewLlmClient("ANSWER: Blue")
+	edb := &testEmbeddingsDB{}
+	for _, text := range []string{"The sky over Seattle is blue", "Bananas are yellow"} {
+		edb.Add(ctx, 0, "", db.GlobalScope, text, fake.HashEmbedding(text))
+	}
+	k := NewHandRolledKernelWithClients(client, edb, session.NewMemoryStore())
+
+	if _, err := k.Chat(ctx, BasicSpeaker("rob"), "s1", "What color is the sky over Seattle?"); err != nil {
+		t.Fatal(err)
+	}
+	prompt := client.LastPrompt()
+	if !strings.Contains(prompt, "The sky over Seattle is blue") {
+		t.Errorf("Expected similar memory in the prompt, got %s", prompt)
+	}
+	if strings.Contains(prompt, "Bananas") {
+		t.Errorf("Expected unrelated memory to be left out of the prompt, got %s", prompt)
+	}
+}
+
+func TestChatHybridSearch(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewLlmClient("ANSWER: A full disk", "ANSWER: A full disk")
+	edb, err := db.NewMemoryDatabase(db.Cosine, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, text := range []string{"INC-4821 was caused by a full disk", "Standup is at 9"} {
+		edb.Add(ctx, 0, "", db.GlobalScope, text, fake.HashEmbedding(text))
+	}
+	k := NewHandRolledKernelWithClients(client, edb, session.NewMemoryStore())
+	k.SetMinSimilarity(0.9)
+
+	question := "Any updates on INC-4821?"
+	if _, err := k.Chat(ctx, BasicSpeaker("rob"), "s1", question); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(client.LastPrompt(), "full disk") {
+		t.Errorf("Expected the ticket to be too dissimilar for vector search, got %s", client.LastPrompt())
+	}
+
+	k.SetSearch(db.HybridSearch, 0)
+	if _, err := k.Chat(ctx, BasicSpeaker("rob"), "s2", question); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(client.LastPrompt(), "INC-4821 was caused by a full disk") {
+		t.Errorf("Expected hybrid search to find the ticket by its number, got %s", client.LastPrompt())
+	}
+	if strings.Contains(client.LastPrompt(), "Standup") {
+		t.Errorf("Expected unrelated memories to be left out, got %s", client.LastPrompt())
+	}
+}
+
+func TestSpeakerScope(t *testing.T) {
+	admin := SlackSpeaker("U1", "C1")
+	admin.ShareGlobally = true
+	tests := []struct {
+		speaker Speaker
+		kind    string
+		want    db.Scope
+	}{
+		{SlackSpeaker("U1", "C1"), "", "user:slack:U1"},
+		{SlackSpeaker("U1", "C1"), "channel", "channel:slack:C1"},
+		{SlackSpeaker("U1", "C1"), "Global", "channel:slack:C1"},
+		{ChatSpeaker("users/42", "Rob", ""), "global", "user:chat:42"},
+		{ChatSpeaker("users/42", "Rob", ""), "channel", "user:chat:42"},
+		{admin, "global", db.GlobalScope},
+	}
+	for _, tc := range tests {
+		got, err := tc.speaker.Scope(tc.kind)
+		if err != nil || got != tc.want {
+			t.Errorf("%#v.Scope(%q) = %q, %v, want %q", tc.speaker, tc.kind, got, err, tc.want)
+		}
+	}
+	if _, err := BasicSpeaker("").Scope(""); err == nil {
+		t.Error("Expected an error without a speaker")
+	}
+}
+
+func TestChatRememberAndRecall(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewLlmClient("REMEMBER: the wifi password is hunter2", "ANSWER: hunter2")
+	edb, err := db.NewMemoryDatabase(db.Cosine, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := NewHandRolledKernelWithClients(client, edb, session.NewMemoryStore())
+
+	if _, err := k.Chat(ctx, BasicSpeaker("rob"), "s1", "Remember the wifi password is hunter2"); err != nil {
+		t.Fatal(err)
+	}
+	if got := client.LastEmbed(); got.TaskType != llm.TaskRetrievalDocument {
+		t.Errorf("Expected memories embedded as documents, got %+v", got)
+	}
+	if _, err := k.Chat(ctx, BasicSpeaker("rob"), "s2", "What is the wifi password?"); err != nil {
+		t.Fatal(err)
+	}
+	if got := client.LastEmbed(); got.TaskType != llm.TaskRetrievalQuery {
+		t.Errorf("Expected questions embedded as queries, got %+v", got)
+	}
+	if !strings.Contains(client.LastPrompt(), "the wifi password is hunter2") {
+		t.Errorf("Expected the remembered fact as context, got %s", client.LastPrompt())
+	}
+}
+
+func TestChatForget(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewLlmClient(
+		"REMEMBER: my parking spot is B12",
+		"FORGET: my parking spot is B12",
+		"FORGET: my parking spot is B12",
+	)
+	edb, _ := db.NewMemoryDatabase(db.Cosine, "")
+	k := NewHandRolledKernelWithClients(client, edb, session.NewMemoryStore())
+	alice := SlackSpeaker("UALICE", "CTEAM")
+	bob := SlackSpeaker("UBOB", "CTEAM")
+
+	if _, err := k.Chat(ctx, alice, "s1", "Remember my parking spot is B12"); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := k.Chat(ctx, bob, "s2", "Forget my parking spot is B12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(resp.Text, "couldn't find") {
+		t.Errorf("Expected bob to be unable to forget alice's memory, got '%s'", resp.Text)
+	}
+	if all, _ := edb.List(ctx, db.ListOptions{}); len(all) != 1 {
+		t.Fatalf("Expected alice's memory to remain, got %#v", all)
+	}
+
+	resp, err = k.Chat(ctx, alice, "s1", "Forget my parking spot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Text != "I have forgotten that 'my parking spot is B12'" {
+		t.Errorf("Unexpected response '%s'", resp.Text)
+	}
+	if all, _ := edb.List(ctx, db.ListOptions{}); len(all) != 0 {
+		t.Errorf("Expected the memory to be deleted, got %#v", all)
+	}
+}
@@ -3,6 +3,8 @@ package kernel
 import (
 	"context"
 	"io"
+
+	"github.com/rcleveng/assistant/server/llm"
 )
 
 // LLM Kernel
@@ -11,11 +13,34 @@ type ChainRunner interface {
 }
 
 type Chatter interface {
-	Chat(ctx context.Context, name, sessionId, text string) (string, error)
+	Chat(ctx context.Context, speaker Speaker, sessionId, text string) (*Response, error)
 }
 
 type Kernel interface {
 	ChainRunner
 	Chatter
+	// Returns an error if the kernel's databases can't be reached
+	Ping(ctx context.Context) error
 	io.Closer
 }
+
+// The kernel's reply to a chat message.
+type Response struct {
+	Text string `json:"text"`
+	// The tool that gave the answer, e.g. ANSWER, REMEMBER or NEEDMORE.
+	// Empty if the model replied without running one.
+	Action string `json:"action,omitempty"`
+	// Arguments the action was run with, e.g. the text to remember
+	Args map[string]string `json:"args,omitempty"`
+	// Sources cited by Text
+	Citations []Citation `json:"citations,omitempty"`
+	// Text is a clarifying question, the next message should answer it
+	FollowUp bool `json:"followUp,omitempty"`
+	// Tokens used by every model call made for the reply
+	Usage llm.Usage `json:"usage"`
+	// The model provider that wrote the reply, set when the client chooses
+	// between providers
+	Provider string `json:"provider,omitempty"`
+	// Identifies the reply's steps in the logs
+	TraceID string `json:"traceId,omitempty"`
+}
@@ -0,0 +1,136 @@
+package kernel
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// A command parsed from the model's text response.
+type Action struct {
+	// Upper case command name, e.g. ANSWER
+	Command  string
+	Argument string
+}
+
+// What to do with a response that has no known commands.
+type FallbackPolicy int
+
+const (
+	// Treat the whole response as the argument to the answer command.
+	FallbackAnswer FallbackPolicy = iota
+	// Return no actions and let the caller decide.
+	FallbackNone
+)
+
+// Parses "COMMAND: argument" actions out of model output.  It tolerates
+// leading prose, markdown decoration, code fences, lower case commands at the
+// start of a line and several commands in one response.  Before the first
+// command an upper case command is found anywhere in a line, other cases only
+// at the start so prose like "the answer: 42" isn't mistaken for a command.
+// Once inside an argument only a command starting a line begins the next
+// action, so an answer that mentions "FORGET:" doesn't forget anything.
+type ResponseParser struct {
+	commands map[string]bool
+	// Matches any known command followed by a colon
+	pattern  *regexp.Regexp
+	fallback FallbackPolicy
+	answer   string
+}
+
+// Creates a parser for the known commands, answer is the command used by
+// FallbackAnswer.
+func NewResponseParser(commands []string, answer string, fallback FallbackPolicy) *ResponseParser {
+	known := make(map[string]bool, len(commands))
+	quoted := make([]string, 0, len(commands))
+	for _, c := range commands {
+		known[strings.ToUpper(c)] = true
+		quoted = append(quoted, regexp.QuoteMeta(c))
+	}
+	// Longest first so a command that prefixes another doesn't win.
+	sort.Slice(quoted, func(i, j int) bool { return len(quoted[i]) > len(quoted[j]) })
+
+	// group 1 is everything before the command, group 2 the command.
+	// Markdown emphasis may wrap the command with or without the colon.
+	pattern := regexp.MustCompile(`(?i)(^|.*?[^A-Za-z0-9_])[*_]*(` + strings.Join(quoted, "|") + `)[*_]*\s*:[*_]*`)
+	return &ResponseParser{
+		commands: known,
+		pattern:  pattern,
+		fallback: fallback,
+		answer:   strings.ToUpper(answer),
+	}
+}
+
+// Returns the actions in the order they appear in text.
+func (p *ResponseParser) Parse(text string) []Action {
+	actions := make([]Action, 0)
+	var current *Action
+	var arg []string
+
+	flush := func() {
+		if current != nil {
+			current.Argument = strings.TrimSpace(strings.Join(arg, "\n"))
+			actions = append(actions, *current)
+		}
+		current = nil
+		arg = nil
+	}
+
+	for _, line := range strings.Split(text, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			continue
+		}
+		// Only the first command can follow prose, which is dropped.  Later
+		// ones start their line so nothing precedes them.
+		if cmd, end, found := p.findCommand(line, current != nil); found {
+			flush()
+			current = &Action{Command: cmd}
+			line = line[end:]
+		}
+		if current != nil {
+			arg = append(arg, line)
+		}
+	}
+	flush()
+
+	if len(actions) == 0 && p.fallback == FallbackAnswer && strings.TrimSpace(text) != "" {
+		actions = append(actions, Action{Command: p.answer, Argument: stripFences(text)})
+	}
+	return actions
+}
+
+// Finds the first command in line, returns the command along with where its
+// match ends.  With startOnly set the command must start the line.
+func (p *ResponseParser) findCommand(line string, startOnly bool) (string, int, bool) {
+	offset := 0
+	for offset < len(line) {
+		m := p.pattern.FindStringSubmatchIndex(line[offset:])
+		if m == nil {
+			return "", 0, false
+		}
+		prefix := line[offset : offset+m[3]]
+		cmd := line[offset+m[4] : offset+m[5]]
+		// Any case at the start of the line once markdown list and quote
+		// markers are removed, upper case anywhere unless startOnly.
+		atStart := offset == 0 && strings.Trim(prefix, " \t>-*#`") == ""
+		if atStart || (!startOnly && cmd == strings.ToUpper(cmd)) {
+			return strings.ToUpper(cmd), offset + m[1], true
+		}
+		if startOnly {
+			return "", 0, false
+		}
+		offset = offset + m[5]
+	}
+	return "", 0, false
+}
+
+func stripFences(text string) string {
+	lines := strings.Split(text, "\n")
+	kept := lines[:0]
+	for _, l := range lines {
+		if !strings.HasPrefix(strings.TrimSpace(l), "```") {
+			kept = append(kept, l)
+		}
+	}
+	return strings.TrimSpace(strings.Join(kept, "\n"))
+}
@@ -0,0 +1,54 @@
+package kernel
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestResponseParser(t *testing.T) {
+	p := NewResponseParser([]string{"ANSWER", "REMEMBER", "CALENDAR", "NEEDMORE", "FORGET"}, "ANSWER", FallbackAnswer)
+
+	tests := []struct {
+		name     string
+		response string
+		want     []Action
+	}{
+		{"plain", "ANSWER: Paris", []Action{{"ANSWER", "Paris"}}},
+		{"no space", "ANSWER:Paris", []Action{{"ANSWER", "Paris"}}},
+		{"leading prose", "Sure! ANSWER: The capital of France is Paris.", []Action{{"ANSWER", "The capital of France is Paris."}}},
+		{"bold", "**ANSWER:** Paris", []Action{{"ANSWER", "Paris"}}},
+		{"bold without colon", "**ANSWER**: Paris", []Action{{"ANSWER", "Paris"}}},
+		{"list item", "- CALENDAR: 2023-12-14", []Action{{"CALENDAR", "2023-12-14"}}},
+		{"code fence", "```\nANSWER: Paris\n```", []Action{{"ANSWER", "Paris"}}},
+		{"lower case", "answer: Paris", []Action{{"ANSWER", "Paris"}}},
+		{"title case multi-line", "Answer: Paris is the capital.\nIt has about 2 million people.\n", []Action{{"ANSWER", "Paris is the capital.\nIt has about 2 million people."}}},
+		{"prose before command", "I need to check your calendar for that.\n\nCALENDAR: 2023-12-14", []Action{{"CALENDAR", "2023-12-14"}}},
+		{"colons in argument", "CALENDAR: I need to look up the calendar on the specific date in ISO-8601 format: 2023-12-14", []Action{{"CALENDAR", "I need to look up the calendar on the specific date in ISO-8601 format: 2023-12-14"}}},
+		{"multiple commands", "REMEMBER: my wife's birthday is June 3\nANSWER: I'll remember that.", []Action{{"REMEMBER", "my wife's birthday is June 3"}, {"ANSWER", "I'll remember that."}}},
+		{"command inside remember", "REMEMBER: my hint is ANSWER: blue", []Action{{"REMEMBER", "my hint is ANSWER: blue"}}},
+		{"command inside answer", "ANSWER: To delete a memory use the FORGET: command", []Action{{"ANSWER", "To delete a memory use the FORGET: command"}}},
+		{"command inside answer next line", "ANSWER: Sure.\nJust say FORGET: the wifi password", []Action{{"ANSWER", "Sure.\nJust say FORGET: the wifi password"}}},
+		{"needmore", "NEEDMORE: Which city do you mean?", []Action{{"NEEDMORE", "Which city do you mean?"}}},
+		{"no command", "The capital of France is Paris.", []Action{{"ANSWER", "The capital of France is Paris."}}},
+		{"unknown command", "NOTE: I don't know", []Action{{"ANSWER", "NOTE: I don't know"}}},
+		{"lower case in prose", "The answer: 42", []Action{{"ANSWER", "The answer: 42"}}},
+		{"fenced prose", "```\nParis\n```", []Action{{"ANSWER", "Paris"}}},
+		{"empty", "  ", []Action{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := p.Parse(tt.response)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse(%q)\nexpected %#v\n     got %#v", tt.response, tt.want, got)
+			}
+		})
+	}
+}
+
+func TestResponseParserFallbackNone(t *testing.T) {
+	p := NewResponseParser([]string{"ANSWER"}, "ANSWER", FallbackNone)
+	if got := p.Parse("The capital of France is Paris."); len(got) != 0 {
+		t.Errorf("Expected no actions, got %#v", got)
+	}
+}
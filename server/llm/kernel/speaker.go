@@ -0,0 +1,87 @@
+package kernel
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/rcleveng/assistant/server/db"
+)
+
+// Who is talking to the kernel, used to decide which memories they can see.
+type Speaker struct {
+	// Platform qualified user id, e.g. "slack:U123"
+	ID   string
+	Name string
+	// Platform qualified channel or space, empty when there isn't one
+	Space string
+	// May store memories every user can see.  None of the platform speakers
+	// set this, it is for callers that trust the speaker, such as operators.
+	ShareGlobally bool
+}
+
+// Speaker for a Google Chat sender, user and space are resource names like
+// "users/123" and "spaces/AAA".
+func ChatSpeaker(user, name, space string) Speaker {
+	s := Speaker{ID: "chat:" + strings.TrimPrefix(user, "users/"), Name: name}
+	if space != "" {
+		s.Space = "chat:" + strings.TrimPrefix(space, "spaces/")
+	}
+	return s
+}
+
+// Speaker for a Slack user in a channel.
+func SlackSpeaker(user, channel string) Speaker {
+	s := Speaker{ID: "slack:" + user, Name: user}
+	if channel != "" {
+		s.Space = "slack:" + channel
+	}
+	return s
+}
+
+// Speaker for the basic chat endpoint, which only knows the user's name.
+// The name isn't authenticated so the endpoint is for development only.  An
+// empty name gives an anonymous speaker that only sees global memories and
+// can't store any, rather than one identity shared by every caller.
+func BasicSpeaker(name string) Speaker {
+	if name == "" {
+		return Speaker{}
+	}
+	return Speaker{ID: "basic:" + name, Name: name}
+}
+
+// Returns the memory scopes visible to the speaker.
+func (s Speaker) Scopes() []db.Scope {
+	scopes := []db.Scope{db.GlobalScope}
+	if s.Space != "" {
+		scopes = append(scopes, db.ChannelScope(s.Space))
+	}
+	if s.ID != "" {
+		scopes = append(scopes, db.UserScope(s.ID))
+	}
+	return scopes
+}
+
+// Returns the scope to store a memory in, kind is "user", "channel" or
+// "global" and defaults to the most private scope available.  Global is only
+// allowed when the speaker can share globally, otherwise it is downgraded to
+// the channel, or the user when there is no channel, since the kind comes
+// from the model.
+func (s Speaker) Scope(kind string) (db.Scope, error) {
+	if s.ID == "" {
+		return "", errors.New("no speaker to store the memory for")
+	}
+	switch strings.ToLower(strings.TrimSpace(kind)) {
+	case "global", "everyone":
+		if s.ShareGlobally {
+			return db.GlobalScope, nil
+		}
+		if s.Space != "" {
+			return db.ChannelScope(s.Space), nil
+		}
+	case "channel", "space":
+		if s.Space != "" {
+			return db.ChannelScope(s.Space), nil
+		}
+	}
+	return db.UserScope(s.ID), nil
+}
@@ -0,0 +1,164 @@
+package kernel
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/rcleveng/assistant/server/llm"
+	"github.com/rcleveng/assistant/server/session"
+)
+
+// An argument accepted by a tool.
+type ToolArg struct {
+	Name string
+	// JSON schema type: string, integer, number or boolean
+	Type        string
+	Description string
+	Required    bool
+}
+
+// The question the kernel is working on, passed to every tool.
+type Turn struct {
+	Speaker   Speaker
+	SessionId string
+	// The question being answered, including answers to clarifying questions
+	Question string
+	// Question parked on the session, tools that consume it set this to nil
+	Pending *session.Pending
+}
+
+// The outcome of running a tool.
+type ToolResult struct {
+	// The observation sent back to the model, or the reply to the user when
+	// Final is set.
+	Text  string
+	Final bool
+	// Text is a question for the user rather than an answer
+	FollowUp bool
+}
+
+// A command the model can ask the kernel to run.
+type Tool struct {
+	// Upper case name the model uses, e.g. CALENDAR
+	Name        string
+	Description string
+	// The first argument receives the text after "NAME:" when the model
+	// responds with plain text.
+	Args []ToolArg
+	Run  func(ctx context.Context, turn *Turn, args map[string]string) (ToolResult, error)
+}
+
+var toolName = regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+
+// Tools the kernel offers to the model, in registration order.
+type ToolRegistry struct {
+	tools map[string]*Tool
+	order []string
+}
+
+func NewToolRegistry() *ToolRegistry {
+	return &ToolRegistry{tools: map[string]*Tool{}}
+}
+
+func (r *ToolRegistry) Register(tool Tool) error {
+	if !toolName.MatchString(tool.Name) {
+		return fmt.Errorf("invalid tool name '%s', must be upper case", tool.Name)
+	}
+	if tool.Run == nil {
+		return fmt.Errorf("tool '%s' has no Run function", tool.Name)
+	}
+	if _, found := r.tools[tool.Name]; found {
+		return fmt.Errorf("tool '%s' is already registered", tool.Name)
+	}
+	r.tools[tool.Name] = &tool
+	r.order = append(r.order, tool.Name)
+	return nil
+}
+
+// Finds a tool by name, ignoring case.
+func (r *ToolRegistry) Lookup(name string) (*Tool, bool) {
+	t, found := r.tools[strings.ToUpper(name)]
+	return t, found
+}
+
+// Names of the registered tools.
+func (r *ToolRegistry) Names() []string {
+	return append([]string(nil), r.order...)
+}
+
+func (r *ToolRegistry) Tools() []*Tool {
+	tools := make([]*Tool, len(r.order))
+	for i, name := range r.order {
+		tools[i] = r.tools[name]
+	}
+	return tools
+}
+
+// Describes the tools for the prompt, one paragraph per tool:
+//
+//	CALENDAR: $DATE
+//	Looks up the events on a day.
+//	DATE (string, required): the day in ISO-8601 format
+func (r *ToolRegistry) Describe() string {
+	var b strings.Builder
+	for _, t := range r.Tools() {
+		b.WriteString(t.Name + ":")
+		if len(t.Args) > 0 {
+			b.WriteString(" $" + strings.ToUpper(t.Args[0].Name))
+		}
+		b.WriteString("\n" + t.Description + "\n")
+		for _, a := range t.Args {
+			required := "optional"
+			if a.Required {
+				required = "required"
+			}
+			fmt.Fprintf(&b, "%s (%s, %s): %s\n", strings.ToUpper(a.Name), a.Type, required, a.Description)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// Declares the tools as functions for providers with native function calling.
+func (r *ToolRegistry) Declarations() []llm.FunctionDeclaration {
+	decls := make([]llm.FunctionDeclaration, 0, len(r.order))
+	for _, t := range r.Tools() {
+		decl := llm.FunctionDeclaration{Name: t.Name, Description: t.Description}
+		if len(t.Args) > 0 {
+			params := &llm.Schema{Type: "object", Properties: map[string]*llm.Schema{}}
+			for _, a := range t.Args {
+				params.Properties[a.Name] = &llm.Schema{Type: a.Type, Description: a.Description}
+				if a.Required {
+					params.Required = append(params.Required, a.Name)
+				}
+			}
+			decl.Parameters = params
+		}
+		decls = append(decls, decl)
+	}
+	return decls
+}
+
+// Converts the arguments of a function call to strings for the tool.
+func callArgs(call llm.FunctionCall) map[string]string {
+	args := make(map[string]string, len(call.Args))
+	for k, v := range call.Args {
+		if s, ok := v.(string); ok {
+			args[k] = s
+		} else {
+			args[k] = fmt.Sprint(v)
+		}
+	}
+	return args
+}
+
+// Maps the text after "NAME:" onto the tool's first argument.
+func textArgs(tool *Tool, text string) map[string]string {
+	args := map[string]string{}
+	if len(tool.Args) > 0 {
+		args[tool.Args[0].Name] = strings.TrimSpace(text)
+	}
+	return args
+}
@@ -0,0 +1,151 @@
+package kernel
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rcleveng/assistant/server/db"
+	"github.com/rcleveng/assistant/server/llm"
+	"github.com/rcleveng/assistant/server/llm/fake"
+	"github.com/rcleveng/assistant/server/session"
+)
+
+func echoTool(name string) Tool {
+	return Tool{
+		Name:        name,
+		Description: "Echoes the input back.",
+		Args:        []ToolArg{{Name: "input", Type: "string", Description: "Text to echo", Required: true}},
+		Run: func(ctx context.Context, turn *Turn, args map[string]string) (ToolResult, error) {
+			return ToolResult{Text: "echo " + args["input"]}, nil
+		},
+	}
+}
+
+func TestToolRegistry(t *testing.T) {
+	r := NewToolRegistry()
+	if err := r.Register(echoTool("ECHO")); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Register(echoTool("ECHO")); err == nil {
+		t.Error("Expected error registering a duplicate tool")
+	}
+	if err := r.Register(echoTool("echo me")); err == nil {
+		t.Error("Expected error registering an invalid name")
+	}
+	if err := r.Register(Tool{Name: "NORUN"}); err == nil {
+		t.Error("Expected error registering a tool without Run")
+	}
+
+	if _, found := r.Lookup("echo"); !found {
+		t.Error("Expected lookup to ignore case")
+	}
+
+	want := "ECHO: $INPUT\nEchoes the input back.\nINPUT (string, required): Text to echo\n\n"
+	if got := r.Describe(); got != want {
+		t.Errorf("Expected description:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestAgentLoop(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewLlmClient("ECHO: hello", "ANSWER: the echo said hello")
+	k := NewHandRolledKernelWithClients(client, db.NoopEmbeddingsDB{}, session.NewMemoryStore())
+	if err := k.Tools().Register(echoTool("ECHO")); err != nil {
+		t.Fatal(err)
+	}
+
+	turn := &Turn{Question: "what does the echo say?"}
+	trace, err := k.run(ctx, turn, []llm.Message{llm.NewMessage(llm.RoleUser, turn.Question)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trace.Answer != "the echo said hello" {
+		t.Errorf("Expected final answer, got '%s'", trace.Answer)
+	}
+	if len(trace.Steps) != 2 || trace.Steps[0].Tool != "ECHO" || trace.Steps[0].Result != "echo hello" || !trace.Steps[1].Final {
+		t.Errorf("Unexpected steps %#v", trace.Steps)
+	}
+	if !strings.Contains(client.LastPrompt(), "OBSERVATION from ECHO:\necho hello") {
+		t.Errorf("Expected observation to be sent to the model, got %s", client.LastPrompt())
+	}
+}
+
+func TestAgentLoopBudget(t *testing.T) {
+	ctx := context.Background()
+	responses := make([]string, 10)
+	for i := range responses {
+		responses[i] = "ECHO: again"
+	}
+	client := fake.NewLlmClient(responses...)
+	k := NewHandRolledKernelWithClients(client, db.NoopEmbeddingsDB{}, session.NewMemoryStore())
+	k.Tools().Register(echoTool("ECHO"))
+	k.SetBudget(3, time.Minute)
+
+	trace, err := k.run(ctx, &Turn{}, []llm.Message{llm.NewMessage(llm.RoleUser, "loop forever")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trace.Steps) != 3 {
+		t.Errorf("Expected 3 steps, got %d", len(trace.Steps))
+	}
+	if !strings.HasPrefix(trace.Answer, "Sorry") {
+		t.Errorf("Expected to give up, got '%s'", trace.Answer)
+	}
+}
+
+func TestAgentLoopFunctionCalling(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewFunctionCallingClient(
+		&llm.Generation{
+			FunctionCalls: []llm.FunctionCall{{Name: "ECHO", Args: map[string]any{"input": "hello"}}},
+			Usage:         &llm.Usage{PromptTokens: 8, CandidateTokens: 2, TotalTokens: 10},
+		},
+		&llm.Generation{
+			FunctionCalls: []llm.FunctionCall{{Name: "ANSWER", Args: map[string]any{"answer": "the echo said hello"}}},
+			Usage:         &llm.Usage{PromptTokens: 12, CandidateTokens: 3, TotalTokens: 15},
+			Provider:      "backup",
+		},
+	)
+	k := NewHandRolledKernelWithClients(client, db.NoopEmbeddingsDB{}, session.NewMemoryStore())
+	k.Tools().Register(echoTool("ECHO"))
+
+	resp, err := k.Chat(ctx, BasicSpeaker("rob"), "s1", "what does the echo say?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Text != "the echo said hello" || resp.Action != "ANSWER" || resp.Args["answer"] != resp.Text {
+		t.Errorf("Expected final answer, got %#v", resp)
+	}
+	if resp.Usage != (llm.Usage{PromptTokens: 20, CandidateTokens: 5, TotalTokens: 25}) {
+		t.Errorf("Expected usage of both calls, got %#v", resp.Usage)
+	}
+	if resp.TraceID == "" {
+		t.Error("Expected a trace id")
+	}
+	if resp.Provider != "backup" {
+		t.Errorf("Expected the provider of the answer, got '%s'", resp.Provider)
+	}
+
+	found := false
+	for _, f := range client.Functions {
+		if f.Name == "ECHO" {
+			found = true
+			if f.Parameters == nil || f.Parameters.Properties["input"] == nil || f.Parameters.Required[0] != "input" {
+				t.Errorf("Unexpected declaration %#v", f)
+			}
+		}
+	}
+	if !found {
+		t.Error("Expected ECHO to be declared as a function")
+	}
+	if strings.Contains(client.Messages[0].Text(), "ECHO: $INPUT") {
+		t.Error("Expected tools not to be described in the prompt when using functions")
+	}
+
+	last := client.Messages[len(client.Messages)-1]
+	if last.Role != llm.RoleTool || last.Parts[0].FunctionResponse == nil || last.Parts[0].FunctionResponse.Response["result"] != "echo hello" {
+		t.Errorf("Expected function response to be sent back, got %#v", last)
+	}
+}
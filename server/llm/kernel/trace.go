@@ -0,0 +1,99 @@
+package kernel
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"time"
+
+	"github.com/rcleveng/assistant/server/llm"
+)
+
+// One model → tool round trip of the agent loop.
+type Step struct {
+	// Raw model output
+	Response string
+	Tool     string
+	Args     map[string]string
+	// Observation or final reply from the tool
+	Result string
+	Final  bool
+	// The final result is a question for the user
+	FollowUp bool
+	Error    string
+	Duration time.Duration
+}
+
+// Everything the kernel did to answer a question, kept for debugging.
+type Trace struct {
+	// Random id logged with every step so a response can be found in the
+	// logs
+	ID        string
+	SessionId string
+	Question  string
+	Steps     []Step
+	Answer    string
+	// Tokens used by every model call
+	Usage llm.Usage
+	// Provider of the last model call, when the client reports it
+	Provider string
+	Duration time.Duration
+}
+
+func newTrace(sessionId, question string) *Trace {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return &Trace{ID: hex.EncodeToString(id), SessionId: sessionId, Question: question}
+}
+
+// Adds the generation's usage and notes its provider.
+func (t *Trace) addGeneration(generation *llm.Generation) {
+	if generation.Provider != "" {
+		t.Provider = generation.Provider
+	}
+	usage := generation.Usage
+	if usage == nil {
+		return
+	}
+	t.Usage.PromptTokens += usage.PromptTokens
+	t.Usage.CandidateTokens += usage.CandidateTokens
+	t.Usage.TotalTokens += usage.TotalTokens
+}
+
+// Returns the first step whose tool gave the answer, or nil if the model
+// answered without running a tool.
+func (t *Trace) finalStep() *Step {
+	for i := range t.Steps {
+		if t.Steps[i].Final && t.Steps[i].Tool != "" {
+			return &t.Steps[i]
+		}
+	}
+	return nil
+}
+
+func (t *Trace) record(ctx context.Context, step Step) {
+	t.Steps = append(t.Steps, step)
+	slog.InfoContext(ctx, "kernel step",
+		"trace", t.ID,
+		"session", t.SessionId,
+		"step", len(t.Steps),
+		"tool", step.Tool,
+		"args", step.Args,
+		"result", step.Result,
+		"final", step.Final,
+		"error", step.Error,
+		"duration", step.Duration)
+}
+
+func (t *Trace) log(ctx context.Context) {
+	slog.InfoContext(ctx, "kernel trace",
+		"trace", t.ID,
+		"session", t.SessionId,
+		"question", t.Question,
+		"steps", len(t.Steps),
+		"answer", t.Answer,
+		"tokens", t.Usage.TotalTokens,
+		"provider", t.Provider,
+		"duration", t.Duration)
+}
@@ -2,12 +2,198 @@ package llm
 
 import (
 	"context"
+	"strings"
 )
 
 // LLM Client, currently only PALM is supported.
 type LlmClient interface {
 	GenerateText(ctx context.Context, prompt string) (string, error)
-	EmbedText(ctx context.Context, text string) ([]float32, error)
-	BatchEmbedText(ctx context.Context, text []string) ([][]float32, error)
+	// Streams the generated text as it arrives, see StreamChunk.
+	GenerateTextStream(ctx context.Context, prompt string) (<-chan StreamChunk, error)
+	// Generates the next model turn for a conversation, the last message
+	// should be from the user (or a tool).
+	GenerateMessages(ctx context.Context, messages []Message) (*Generation, error)
+	EmbedText(ctx context.Context, text string, opts EmbedOptions) ([]float32, error)
+	BatchEmbedText(ctx context.Context, text []string, opts EmbedOptions) ([][]float32, error)
 	Close() error
 }
+
+// What an embedding will be used for, models that support task types tune
+// the embedding for it.
+type TaskType string
+
+const (
+	// Lets the model decide, embeddings may not match well across tasks
+	TaskUnspecified TaskType = ""
+	// Text to search with, such as a question
+	TaskRetrievalQuery TaskType = "retrieval_query"
+	// Text to be found by a search, such as a memory or a document chunk
+	TaskRetrievalDocument TaskType = "retrieval_document"
+	// Text compared with other text of the same kind
+	TaskSimilarity TaskType = "similarity"
+	// Text that will be classified
+	TaskClassification TaskType = "classification"
+)
+
+// How text is embedded.
+type EmbedOptions struct {
+	TaskType TaskType
+	// Title of the document the text is from, only used with
+	// TaskRetrievalDocument
+	Title string
+}
+
+// Options for embedding text to search with.
+func QueryEmbedding() EmbedOptions {
+	return EmbedOptions{TaskType: TaskRetrievalQuery}
+}
+
+// Options for embedding text to be searched, title may be empty.
+func DocumentEmbedding(title string) EmbedOptions {
+	return EmbedOptions{TaskType: TaskRetrievalDocument, Title: title}
+}
+
+// Who authored a message in a conversation.
+type Role string
+
+const (
+	// Instructions for the model, providers without native support fold
+	// these into the first user message.
+	RoleSystem Role = "system"
+	RoleUser   Role = "user"
+	RoleModel  Role = "model"
+	// Output of a tool the model asked to run.
+	RoleTool Role = "tool"
+)
+
+// A single piece of a message, only one field is set.
+type Part struct {
+	Text string
+	// Set on model messages when the model asks to call a function
+	FunctionCall *FunctionCall
+	// Set on tool messages with the result of a function call
+	FunctionResponse *FunctionResponse
+}
+
+// Implemented by clients whose provider supports native function calling,
+// callers should fall back to parsing text when a client doesn't.
+type FunctionCaller interface {
+	// Like GenerateMessages, but the model may respond by calling one of the
+	// functions instead of with text.
+	GenerateWithFunctions(ctx context.Context, messages []Message, functions []FunctionDeclaration) (*Generation, error)
+}
+
+// A function the model may call.
+type FunctionDeclaration struct {
+	// Must start with a letter or underscore, then letters, digits and
+	// underscores.
+	Name        string
+	Description string
+	// Object schema of the arguments, nil if the function takes none
+	Parameters *Schema
+}
+
+// Subset of OpenAPI schema used to describe function arguments.
+type Schema struct {
+	// object, string, integer, number, boolean or array
+	Type        string
+	Description string
+	Enum        []string
+	// Element type for arrays
+	Items *Schema
+	// Fields of an object
+	Properties map[string]*Schema
+	Required   []string
+}
+
+// A function call requested by the model.
+type FunctionCall struct {
+	Name string
+	Args map[string]any
+}
+
+// The result of a function call sent back to the model.
+type FunctionResponse struct {
+	Name     string
+	Response map[string]any
+}
+
+// A message in a conversation.
+type Message struct {
+	Role  Role
+	Parts []Part
+}
+
+// Creates a message with a single text part.
+func NewMessage(role Role, text string) Message {
+	return Message{Role: role, Parts: []Part{{Text: text}}}
+}
+
+// Returns the text of all parts joined together.
+func (m Message) Text() string {
+	var b strings.Builder
+	for _, p := range m.Parts {
+		b.WriteString(p.Text)
+	}
+	return b.String()
+}
+
+// Flattens a conversation into a single prompt string, one message per
+// paragraph.
+func MessagesText(messages []Message) string {
+	texts := make([]string, 0, len(messages))
+	for _, m := range messages {
+		texts = append(texts, m.Text())
+	}
+	return strings.Join(texts, "\n\n")
+}
+
+// Result of a non-streaming generation.
+type Generation struct {
+	Text string
+	// Function calls requested by the model, only from FunctionCaller
+	FunctionCalls []FunctionCall
+	FinishReason  string
+	Usage         *Usage
+	// Name of the provider that generated it, set by clients that choose
+	// between providers
+	Provider string
+}
+
+// Token accounting for a single generation, fields are zero when the
+// provider does not report them.
+type Usage struct {
+	PromptTokens    int32 `json:"promptTokens"`
+	CandidateTokens int32 `json:"candidateTokens"`
+	TotalTokens     int32 `json:"totalTokens"`
+}
+
+// One element of a streaming generation.  Text is the delta since the
+// previous chunk.  The last chunk sent before the channel is closed has Done
+// set and carries the FinishReason and Usage, or Err if the stream failed or
+// its context was canceled.  Chunks not yet read when the context is
+// canceled may be dropped in favour of the one with Err.
+type StreamChunk struct {
+	Text         string
+	Done         bool
+	FinishReason string
+	Usage        *Usage
+	Err          error
+	// Name of the provider streaming it, set by clients that choose between
+	// providers
+	Provider string
+}
+
+// Reads the whole stream and returns the concatenated text along with the
+// final chunk.
+func CollectStream(stream <-chan StreamChunk) (string, StreamChunk) {
+	var text strings.Builder
+	var last StreamChunk
+	for chunk := range stream {
+		text.WriteString(chunk.Text)
+		if chunk.Done || chunk.Err != nil {
+			last = chunk
+		}
+	}
+	return text.String(), last
+}
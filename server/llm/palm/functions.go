@@ -0,0 +1,166 @@
+package palm
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	betapb "cloud.google.com/go/ai/generativelanguage/apiv1beta/generativelanguagepb"
+	"github.com/rcleveng/assistant/server/llm"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Function calling is only in v1beta so these requests go through the beta
+// client.
+func (c *PalmLLMClient) GenerateWithFunctions(ctx context.Context, messages []llm.Message, functions []llm.FunctionDeclaration) (*llm.Generation, error) {
+	contents, err := toBetaContents(messages)
+	if err != nil {
+		return nil, err
+	}
+
+	decls := make([]*betapb.FunctionDeclaration, len(functions))
+	for i, f := range functions {
+		decls[i] = &betapb.FunctionDeclaration{
+			Name:        f.Name,
+			Description: f.Description,
+			Parameters:  toBetaSchema(f.Parameters),
+		}
+	}
+	req := &betapb.GenerateContentRequest{
+		Model:    c.model,
+		Contents: contents,
+	}
+	if len(decls) > 0 {
+		req.Tools = []*betapb.Tool{{FunctionDeclarations: decls}}
+	}
+
+	resp, err := c.betaclient.GenerateContent(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Candidates) == 0 {
+		return nil, fmt.Errorf("no candidate response, just %#v", resp)
+	}
+
+	cand := resp.Candidates[0]
+	generation := &llm.Generation{
+		FinishReason: cand.FinishReason.String(),
+		Usage:        betaUsage(resp.GetUsageMetadata(), cand.TokenCount),
+	}
+	var text strings.Builder
+	for _, part := range cand.GetContent().GetParts() {
+		if call := part.GetFunctionCall(); call != nil {
+			generation.FunctionCalls = append(generation.FunctionCalls, llm.FunctionCall{
+				Name: call.Name,
+				Args: call.GetArgs().AsMap(),
+			})
+			continue
+		}
+		text.WriteString(part.GetText())
+	}
+	generation.Text = text.String()
+	return generation, nil
+}
+
+// The v1beta version of usage.
+func betaUsage(metadata *betapb.GenerateContentResponse_UsageMetadata, candidateTokens int32) *llm.Usage {
+	if metadata == nil {
+		return usage(nil, candidateTokens)
+	}
+	return &llm.Usage{
+		PromptTokens:    metadata.PromptTokenCount,
+		CandidateTokens: metadata.CandidatesTokenCount,
+		TotalTokens:     metadata.TotalTokenCount,
+	}
+}
+
+func toBetaSchema(s *llm.Schema) *betapb.Schema {
+	if s == nil {
+		return nil
+	}
+	schema := &betapb.Schema{
+		Type:        betapb.Type(betapb.Type_value[strings.ToUpper(s.Type)]),
+		Description: s.Description,
+		Enum:        s.Enum,
+		Items:       toBetaSchema(s.Items),
+		Required:    s.Required,
+	}
+	if len(s.Properties) > 0 {
+		schema.Properties = make(map[string]*betapb.Schema, len(s.Properties))
+		for name, p := range s.Properties {
+			schema.Properties[name] = toBetaSchema(p)
+		}
+	}
+	return schema
+}
+
+// Like toContents, but function calls are sent as model turns and function
+// responses as function turns.
+func toBetaContents(messages []llm.Message) ([]*betapb.Content, error) {
+	var system []*betapb.Part
+	contents := make([]*betapb.Content, 0, len(messages))
+	for _, m := range messages {
+		parts := make([]*betapb.Part, 0, len(m.Parts))
+		hasResponse := false
+		for _, p := range m.Parts {
+			switch {
+			case p.FunctionCall != nil:
+				args, err := structpb.NewStruct(p.FunctionCall.Args)
+				if err != nil {
+					return nil, err
+				}
+				parts = append(parts, &betapb.Part{Data: &betapb.Part_FunctionCall{
+					FunctionCall: &betapb.FunctionCall{Name: p.FunctionCall.Name, Args: args},
+				}})
+			case p.FunctionResponse != nil:
+				resp, err := structpb.NewStruct(p.FunctionResponse.Response)
+				if err != nil {
+					return nil, err
+				}
+				hasResponse = true
+				parts = append(parts, &betapb.Part{Data: &betapb.Part_FunctionResponse{
+					FunctionResponse: &betapb.FunctionResponse{Name: p.FunctionResponse.Name, Response: resp},
+				}})
+			default:
+				parts = append(parts, &betapb.Part{Data: &betapb.Part_Text{Text: p.Text}})
+			}
+		}
+
+		var role string
+		switch m.Role {
+		case llm.RoleSystem:
+			system = append(system, parts...)
+			continue
+		case llm.RoleUser:
+			role = "user"
+		case llm.RoleTool:
+			role = "user"
+			if hasResponse {
+				role = "function"
+			}
+		case llm.RoleModel:
+			role = "model"
+		default:
+			return nil, fmt.Errorf("unknown message role '%s'", m.Role)
+		}
+
+		if n := len(contents); n > 0 && contents[n-1].Role == role {
+			contents[n-1].Parts = append(contents[n-1].Parts, parts...)
+			continue
+		}
+		contents = append(contents, &betapb.Content{Role: role, Parts: parts})
+	}
+
+	if n := len(contents); n == 0 || contents[n-1].Role == "model" {
+		return nil, fmt.Errorf("conversation must end with a user or function message")
+	}
+	if len(system) > 0 {
+		for _, c := range contents {
+			if c.Role == "user" {
+				c.Parts = append(system, c.Parts...)
+				break
+			}
+		}
+	}
+	return contents, nil
+}
@@ -4,33 +4,48 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"strings"
 
 	generativelanguage "cloud.google.com/go/ai/generativelanguage/apiv1"
 	pb "cloud.google.com/go/ai/generativelanguage/apiv1/generativelanguagepb"
+	generativelanguagebeta "cloud.google.com/go/ai/generativelanguage/apiv1beta"
 
 	"github.com/google/generative-ai-go/genai"
 	"github.com/rcleveng/assistant/server/env"
+	"github.com/rcleveng/assistant/server/llm"
+	"github.com/rcleveng/assistant/server/llm/fallback"
+	"github.com/rcleveng/assistant/server/llm/retry"
 	"google.golang.org/api/option"
 )
 
+// Model used for text generation unless another is chosen.
+const defaultGenerativeModel = "models/gemini-pro"
+
+// Model used for embeddings.
+const embeddingModel = "models/embedding-001"
+
 type PalmLLMClient struct {
 	// Everything we need context wise from the environment
 	environment *env.Environment
 	// client to call api
-	client    *genai.Client
-	genclient *generativelanguage.GenerativeClient
+	client     *genai.Client
+	genclient  *generativelanguage.GenerativeClient
+	betaclient *generativelanguagebeta.GenerativeClient
+	// Generative model, such as models/gemini-pro
+	model string
 }
 
 func (c *PalmLLMClient) Close() error {
 	err := c.client.Close()
 	err2 := c.genclient.Close()
-	return errors.Join(err, err2)
+	err3 := c.betaclient.Close()
+	return errors.Join(err, err2, err3)
 }
 
 func (c *PalmLLMClient) GenerateText(ctx context.Context, prompt string) (string, error) {
-	em := c.client.GenerativeModel("gemini-pro")
+	em := c.client.GenerativeModel(c.model)
 	resp, err := em.GenerateContent(ctx, genai.Text(prompt))
 	if err != nil {
 		return "", err
@@ -43,6 +58,165 @@ func (c *PalmLLMClient) GenerateText(ctx context.Context, prompt string) (string
 	return "", fmt.Errorf("no candidate response, just %#v", resp)
 }
 
+// Calls the API directly rather than through genai, which doesn't pass on the
+// usage metadata of streamed responses.
+func (c *PalmLLMClient) GenerateTextStream(ctx context.Context, prompt string) (<-chan llm.StreamChunk, error) {
+	resps, err := c.genclient.StreamGenerateContent(ctx, &pb.GenerateContentRequest{
+		Model: c.model,
+		Contents: []*pb.Content{{
+			Role:  "user",
+			Parts: []*pb.Part{{Data: &pb.Part_Text{Text: prompt}}},
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sender, stream := llm.NewStreamSender(ctx)
+	go func() {
+		defer sender.Close()
+
+		final := llm.StreamChunk{Done: true}
+		// Each response reports the usage so far, the last one is the total.
+		var metadata *pb.GenerateContentResponse_UsageMetadata
+		var candidateTokens int32
+		for {
+			resp, err := resps.Recv()
+			// Once the model reported why it stopped the generation is complete,
+			// don't fail the whole stream on an error reading the trailer.
+			if err == io.EOF || (err != nil && final.FinishReason != "") {
+				if err != nil && err != io.EOF {
+					slog.WarnContext(ctx, "ignoring error after end of stream", "error", err)
+				}
+				final.Usage = usage(metadata, candidateTokens)
+				sender.Send(final)
+				return
+			}
+			if err != nil {
+				if ctx.Err() != nil {
+					err = ctx.Err()
+				}
+				sender.Send(llm.StreamChunk{Done: true, Err: err})
+				return
+			}
+			if resp.UsageMetadata != nil {
+				metadata = resp.UsageMetadata
+			}
+			if len(resp.Candidates) == 0 {
+				continue
+			}
+			// Only the first candidate is streamed.
+			cand := resp.Candidates[0]
+			if cand.FinishReason != pb.Candidate_FINISH_REASON_UNSPECIFIED {
+				final.FinishReason = cand.FinishReason.String()
+			}
+			candidateTokens += cand.TokenCount
+			if text := partsText(cand.GetContent()); text != "" {
+				if !sender.Send(llm.StreamChunk{Text: text}) {
+					return
+				}
+			}
+		}
+	}()
+	return stream, nil
+}
+
+func (c *PalmLLMClient) GenerateMessages(ctx context.Context, messages []llm.Message) (*llm.Generation, error) {
+	contents, err := toContents(messages)
+	if err != nil {
+		return nil, err
+	}
+
+	// genai only supports multi-turn through ChatSession which always
+	// streams, so call the API directly.
+	resp, err := c.genclient.GenerateContent(ctx, &pb.GenerateContentRequest{
+		Model:    c.model,
+		Contents: contents,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Candidates) == 0 {
+		return nil, fmt.Errorf("no candidate response, just %#v", resp)
+	}
+
+	cand := resp.Candidates[0]
+	return &llm.Generation{
+		Text:         partsText(cand.GetContent()),
+		FinishReason: cand.FinishReason.String(),
+		Usage:        usage(resp.GetUsageMetadata(), cand.TokenCount),
+	}, nil
+}
+
+// Returns the text of a content's parts.
+func partsText(content *pb.Content) string {
+	var b strings.Builder
+	for _, part := range content.GetParts() {
+		b.WriteString(part.GetText())
+	}
+	return b.String()
+}
+
+// Returns the usage reported for a response, falling back to the first
+// candidate's token count when the API didn't report it.
+func usage(metadata *pb.GenerateContentResponse_UsageMetadata, candidateTokens int32) *llm.Usage {
+	if metadata == nil {
+		return &llm.Usage{CandidateTokens: candidateTokens, TotalTokens: candidateTokens}
+	}
+	return &llm.Usage{
+		PromptTokens:    metadata.PromptTokenCount,
+		CandidateTokens: metadata.CandidatesTokenCount,
+		TotalTokens:     metadata.TotalTokenCount,
+	}
+}
+
+// Maps messages onto Gemini contents.  Gemini only knows about user and
+// model turns which must alternate, so system messages are folded into the
+// first user turn, tool output is sent as a user turn and consecutive turns
+// from the same role are merged.
+func toContents(messages []llm.Message) ([]*pb.Content, error) {
+	var system []*pb.Part
+	contents := make([]*pb.Content, 0, len(messages))
+	for _, m := range messages {
+		parts := make([]*pb.Part, 0, len(m.Parts))
+		for _, p := range m.Parts {
+			parts = append(parts, &pb.Part{Data: &pb.Part_Text{Text: p.Text}})
+		}
+
+		var role string
+		switch m.Role {
+		case llm.RoleSystem:
+			system = append(system, parts...)
+			continue
+		case llm.RoleUser, llm.RoleTool:
+			role = "user"
+		case llm.RoleModel:
+			role = "model"
+		default:
+			return nil, fmt.Errorf("unknown message role '%s'", m.Role)
+		}
+
+		if n := len(contents); n > 0 && contents[n-1].Role == role {
+			contents[n-1].Parts = append(contents[n-1].Parts, parts...)
+			continue
+		}
+		contents = append(contents, &pb.Content{Role: role, Parts: parts})
+	}
+
+	if len(contents) == 0 || contents[len(contents)-1].Role != "user" {
+		return nil, fmt.Errorf("conversation must end with a user message")
+	}
+	if len(system) > 0 {
+		for _, c := range contents {
+			if c.Role == "user" {
+				c.Parts = append(system, c.Parts...)
+				break
+			}
+		}
+	}
+	return contents, nil
+}
+
 func responseString(resp *genai.GenerateContentResponse) string {
 	var b strings.Builder
 	for i, cand := range resp.Candidates {
@@ -68,9 +242,38 @@ func contentString(c *genai.Content) string {
 	return b.String()
 }
 
-func (c *PalmLLMClient) EmbedText(ctx context.Context, text string) ([]float32, error) {
-	em := c.client.EmbeddingModel("models/embedding-001")
-	res, err := em.EmbedContent(ctx, genai.Text(text))
+// Returns the API's task type for an llm.TaskType.
+func taskType(t llm.TaskType) (genai.TaskType, error) {
+	switch t {
+	case llm.TaskUnspecified:
+		return genai.TaskTypeUnspecified, nil
+	case llm.TaskRetrievalQuery:
+		return genai.TaskTypeRetrievalQuery, nil
+	case llm.TaskRetrievalDocument:
+		return genai.TaskTypeRetrievalDocument, nil
+	case llm.TaskSimilarity:
+		return genai.TaskTypeSemanticSimilarity, nil
+	case llm.TaskClassification:
+		return genai.TaskTypeClassification, nil
+	default:
+		return genai.TaskTypeUnspecified, fmt.Errorf("unknown embedding task type '%s'", t)
+	}
+}
+
+func (c *PalmLLMClient) EmbedText(ctx context.Context, text string, opts llm.EmbedOptions) ([]float32, error) {
+	tt, err := taskType(opts.TaskType)
+	if err != nil {
+		return nil, err
+	}
+	em := c.client.EmbeddingModel(embeddingModel)
+	em.TaskType = tt
+	var res *genai.EmbedContentResponse
+	// The API only accepts a title for documents.
+	if tt == genai.TaskTypeRetrievalDocument && opts.Title != "" {
+		res, err = em.EmbedContentWithTitle(ctx, opts.Title, genai.Text(text))
+	} else {
+		res, err = em.EmbedContent(ctx, genai.Text(text))
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -92,23 +295,27 @@ func toContent(parts []string) *pb.Content {
 	return &pb.Content{Role: "user", Parts: p}
 }
 
-func (c *PalmLLMClient) batchEmbedContentWithTitle(ctx context.Context, title string, texts []string) (*pb.BatchEmbedContentsResponse, error) {
+func (c *PalmLLMClient) batchEmbedContent(ctx context.Context, texts []string, tt genai.TaskType, title string) (*pb.BatchEmbedContentsResponse, error) {
 	reqs := make([]*pb.EmbedContentRequest, len(texts))
-	taskType := pb.TaskType(genai.TaskTypeUnspecified)
-
 	for i, e := range texts {
-		slog.InfoContext(ctx, "Adding emb batch", "i", i, "e", e)
-		reqs[i] = &pb.EmbedContentRequest{
-			Model: "models/embedding-001",
+		req := &pb.EmbedContentRequest{
+			Model: embeddingModel,
 			// TODO - support multiple parts per embedding
-			Content:  toContent([]string{e}),
-			TaskType: &taskType,
-			Title:    &title,
+			Content: toContent([]string{e}),
+		}
+		if tt != genai.TaskTypeUnspecified {
+			taskType := pb.TaskType(tt)
+			req.TaskType = &taskType
 		}
+		// The API only accepts a title for documents.
+		if tt == genai.TaskTypeRetrievalDocument && title != "" {
+			req.Title = &title
+		}
+		reqs[i] = req
 	}
 
 	req := &pb.BatchEmbedContentsRequest{
-		Model:    "models/embedding-001",
+		Model:    embeddingModel,
 		Requests: reqs,
 	}
 	res, err := c.genclient.BatchEmbedContents(ctx, req)
@@ -118,24 +325,106 @@ func (c *PalmLLMClient) batchEmbedContentWithTitle(ctx context.Context, title st
 	return res, nil
 }
 
-func (c *PalmLLMClient) BatchEmbedText(ctx context.Context, texts []string) ([][]float32, error) {
-	resp, err := c.batchEmbedContentWithTitle(ctx, "", texts)
+// The API takes at most 100 texts per batch, requests are also kept to a
+// modest size so a slow one doesn't hold up a whole document.
+var embedBatchLimits = llm.BatchLimits{
+	MaxTexts:    100,
+	MaxBytes:    256 * 1024,
+	Concurrency: 4,
+}
+
+// Texts are split into batches the API accepts, see llm.EmbedInBatches.
+func (c *PalmLLMClient) BatchEmbedText(ctx context.Context, texts []string, opts llm.EmbedOptions) ([][]float32, error) {
+	tt, err := taskType(opts.TaskType)
 	if err != nil {
 		return nil, err
 	}
+	return llm.EmbedInBatches(ctx, texts, embedBatchLimits, func(ctx context.Context, batch []string) ([][]float32, error) {
+		resp, err := c.batchEmbedContent(ctx, batch, tt, opts.Title)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.Embeddings == nil {
+			return nil, fmt.Errorf("unable to find embedding json structure")
+		}
 
-	if resp.Embeddings == nil {
-		return nil, fmt.Errorf("unable to find embedding json structure")
+		embeddings := make([][]float32, 0, len(batch))
+		for _, emb := range resp.Embeddings {
+			embeddings = append(embeddings, emb.Values)
+		}
+		return embeddings, nil
+	})
+}
+
+// Returns the name the API expects for model, such as models/gemini-pro, or
+// the default model if model is empty.
+func modelName(model string) string {
+	if model == "" {
+		return defaultGenerativeModel
 	}
+	if !strings.HasPrefix(model, "models/") && !strings.HasPrefix(model, "tunedModels/") {
+		return "models/" + model
+	}
+	return model
+}
 
-	embeddings := make([][]float32, 0, len(texts))
-	for _, emb := range resp.Embeddings {
-		embeddings = append(embeddings, emb.Values)
+// Returns the generative model the client uses.
+func (c *PalmLLMClient) Model() string {
+	return c.model
+}
+
+// Creates the client the assistant uses, the environment's model with
+// retries.  When fallback models are set each is tried in turn while the
+// ones before it are failing, and the retries apply to the whole chain so a
+// failing model falls back at once instead of after its own retries.
+func NewClientForEnvironment(ctx context.Context, environment *env.Environment, opts ...option.ClientOption) (llm.LlmClient, error) {
+	models := append([]string{environment.LlmModel}, environment.LlmFallbackModels...)
+	retries := retry.OptionsFromEnvironment(environment)
+	// Each model keeps its rate limit and per attempt timeout.
+	attempt := retries
+	if len(models) > 1 {
+		attempt.MaxRetries = 0
+	}
+	providers := make([]fallback.Provider, 0, len(models))
+	for _, model := range models {
+		client, err := NewPalmLLMClientForModel(ctx, environment, model, opts...)
+		if err != nil {
+			for _, p := range providers {
+				p.Client.Close()
+			}
+			return nil, err
+		}
+		// Every model embeds with embeddingModel, so their embeddings can
+		// be compared.
+		providers = append(providers, fallback.Provider{
+			Name:             strings.TrimPrefix(client.Model(), "models/"),
+			Client:           retry.NewClient(client, attempt),
+			SharedEmbeddings: true,
+		})
+	}
+	if len(providers) == 1 {
+		return providers[0].Client, nil
 	}
-	return embeddings, nil
+	client, err := fallback.NewClient(providers, fallback.DefaultOptions())
+	if err != nil {
+		return nil, err
+	}
+	// The models limit and time out their own attempts.
+	chain := retries
+	chain.RateLimit = 0
+	chain.Timeout = 0
+	return retry.NewClient(client, chain), nil
 }
 
+// Creates a client for the environment's model, see env.Environment.LlmModel.
 func NewPalmLLMClient(ctx context.Context, environment *env.Environment, opts ...option.ClientOption) (*PalmLLMClient, error) {
+	return NewPalmLLMClientForModel(ctx, environment, environment.LlmModel, opts...)
+}
+
+// Creates a client that generates text with model, embeddings always use the
+// same model so they can be compared.
+func NewPalmLLMClientForModel(ctx context.Context, environment *env.Environment, model string, opts ...option.ClientOption) (*PalmLLMClient, error) {
 	allopts := append([]option.ClientOption{option.WithAPIKey(environment.PalmApiKey)}, opts...)
 	client, err := genai.NewClient(ctx, allopts...)
 	if err != nil {
@@ -145,6 +434,14 @@ func NewPalmLLMClient(ctx context.Context, environment *env.Environment, opts ..
 	// TODO - remove this once the go client supports the batchEmbeddings
 	genclient, err := generativelanguage.NewGenerativeRESTClient(ctx, allopts...)
 	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	betaclient, err := generativelanguagebeta.NewGenerativeRESTClient(ctx, allopts...)
+	if err != nil {
+		genclient.Close()
+		client.Close()
 		return nil, err
 	}
 
@@ -152,5 +449,7 @@ func NewPalmLLMClient(ctx context.Context, environment *env.Environment, opts ..
 		environment: environment,
 		client:      client,
 		genclient:   genclient,
+		betaclient:  betaclient,
+		model:       modelName(model),
 	}, nil
 }
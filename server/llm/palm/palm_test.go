@@ -2,17 +2,26 @@ package palm
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 
 	pb "cloud.google.com/go/ai/generativelanguage/apiv1/generativelanguagepb"
+	betapb "cloud.google.com/go/ai/generativelanguage/apiv1beta/generativelanguagepb"
 
 	"github.com/rcleveng/assistant/server/env"
+	"github.com/rcleveng/assistant/server/llm"
 	"google.golang.org/api/option"
 	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
 )
 
 func createResponse(statusCode int, resp proto.Message) (func(w http.ResponseWriter, req *http.Request), error) {
@@ -73,3 +82,438 @@ func TestGenerateText(t *testing.T) {
 		t.Errorf("Expected '%s' got '%s'", message, string(resp))
 	}
 }
+
+func TestGenerateTextStream(t *testing.T) {
+	var index int32 = 0
+	chunks := []string{"Hello", " World"}
+	var body []byte
+	body = append(body, '[')
+	for i, text := range chunks {
+		resp := &pb.GenerateContentResponse{
+			Candidates: []*pb.Candidate{{
+				Index:      &index,
+				TokenCount: 1,
+				Content: &pb.Content{
+					Parts: []*pb.Part{{Data: &pb.Part_Text{Text: text}}},
+				},
+			}},
+		}
+		if i == len(chunks)-1 {
+			resp.Candidates[0].FinishReason = pb.Candidate_STOP
+			resp.UsageMetadata = &pb.GenerateContentResponse_UsageMetadata{
+				PromptTokenCount:     3,
+				CandidatesTokenCount: 2,
+				TotalTokenCount:      5,
+			}
+		}
+		b, err := protojson.Marshal(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i > 0 {
+			body = append(body, ',')
+		}
+		body = append(body, b...)
+	}
+	body = append(body, ']')
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(body)
+	}))
+	defer ts.Close()
+
+	e := &env.Environment{Platform: env.GOTEST}
+	ctx := context.Background()
+	client, err := NewPalmLLMClient(ctx, e, option.WithoutAuthentication(), option.WithEndpoint(ts.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stream, err := client.GenerateTextStream(ctx, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	text, last := llm.CollectStream(stream)
+	if last.Err != nil {
+		t.Fatal(last.Err)
+	}
+	if text != "Hello World" {
+		t.Errorf("Expected 'Hello World' got '%s'", text)
+	}
+	if !last.Done {
+		t.Error("Expected final chunk to be marked done")
+	}
+	if want := (llm.Usage{PromptTokens: 3, CandidateTokens: 2, TotalTokens: 5}); last.Usage == nil || *last.Usage != want {
+		t.Errorf("Expected usage %+v from the last response, got %+v", want, last.Usage)
+	}
+	if last.FinishReason == "" {
+		t.Error("Expected a finish reason")
+	}
+}
+
+func TestGenerateTextStreamCanceled(t *testing.T) {
+	var index int32 = 0
+	first, err := protojson.Marshal(&pb.GenerateContentResponse{
+		Candidates: []*pb.Candidate{{
+			Index:   &index,
+			Content: &pb.Content{Parts: []*pb.Part{{Data: &pb.Part_Text{Text: "Hello"}}}},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Sends the first response then stalls until the client goes away.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(append([]byte("["), first...))
+		w.(http.Flusher).Flush()
+		<-req.Context().Done()
+	}))
+	defer ts.Close()
+
+	e := &env.Environment{Platform: env.GOTEST}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client, err := NewPalmLLMClient(ctx, e, option.WithoutAuthentication(), option.WithEndpoint(ts.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := client.GenerateTextStream(ctx, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chunk := <-stream; chunk.Text != "Hello" {
+		t.Fatalf("Expected the first chunk, got %+v", chunk)
+	}
+	cancel()
+
+	_, last := llm.CollectStream(stream)
+	if !last.Done || !errors.Is(last.Err, context.Canceled) {
+		t.Errorf("Expected a final chunk with the cancelation, got %+v", last)
+	}
+}
+
+func TestGenerateMessages(t *testing.T) {
+	message := "Hello Again"
+	var index int32 = 0
+	body, err := protojson.Marshal(&pb.GenerateContentResponse{
+		Candidates: []*pb.Candidate{{
+			Index:      &index,
+			TokenCount: 2,
+			Content: &pb.Content{
+				Parts: []*pb.Part{{Data: &pb.Part_Text{Text: message}}},
+				Role:  "model",
+			},
+		}},
+		UsageMetadata: &pb.GenerateContentResponse_UsageMetadata{
+			PromptTokenCount:     7,
+			CandidatesTokenCount: 2,
+			TotalTokenCount:      9,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := &pb.GenerateContentRequest{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		if err := protojson.Unmarshal(b, req); err != nil {
+			t.Error(err)
+		}
+		w.Write(body)
+	}))
+	defer ts.Close()
+
+	e := &env.Environment{Platform: env.GOTEST}
+	ctx := context.Background()
+	client, err := NewPalmLLMClient(ctx, e, option.WithoutAuthentication(), option.WithEndpoint(ts.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.GenerateMessages(ctx, []llm.Message{
+		llm.NewMessage(llm.RoleSystem, "Be nice"),
+		llm.NewMessage(llm.RoleUser, "Hello"),
+		llm.NewMessage(llm.RoleModel, "Hi"),
+		llm.NewMessage(llm.RoleUser, "Hello again"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Text != message {
+		t.Errorf("Expected '%s' got '%s'", message, resp.Text)
+	}
+	if want := (llm.Usage{PromptTokens: 7, CandidateTokens: 2, TotalTokens: 9}); resp.Usage == nil || *resp.Usage != want {
+		t.Errorf("Expected usage %+v from the metadata, got %+v", want, resp.Usage)
+	}
+
+	roles := []string{}
+	for _, c := range req.Contents {
+		roles = append(roles, c.Role)
+	}
+	if fmt.Sprint(roles) != "[user model user]" {
+		t.Errorf("Expected user/model/user turns, got %v", roles)
+	}
+	if len(req.Contents) > 0 && req.Contents[0].Parts[0].GetText() != "Be nice" {
+		t.Errorf("Expected system message to lead the first user turn, got %v", req.Contents[0])
+	}
+}
+
+func TestUsageWithoutMetadata(t *testing.T) {
+	if want := (llm.Usage{CandidateTokens: 3, TotalTokens: 3}); *usage(nil, 3) != want {
+		t.Errorf("Expected the candidate's token count, got %+v", usage(nil, 3))
+	}
+}
+
+func TestToContentsRequiresUserTurn(t *testing.T) {
+	if _, err := toContents([]llm.Message{llm.NewMessage(llm.RoleSystem, "Be nice")}); err == nil {
+		t.Error("Expected error for conversation without a user message")
+	}
+	if _, err := toContents([]llm.Message{
+		llm.NewMessage(llm.RoleUser, "Hello"),
+		llm.NewMessage(llm.RoleModel, "Hi"),
+	}); err == nil {
+		t.Error("Expected error for conversation ending with the model")
+	}
+}
+
+func TestGenerateWithFunctions(t *testing.T) {
+	var index int32 = 0
+	args, _ := structpb.NewStruct(map[string]any{"date": "2023-12-14"})
+	body, err := protojson.Marshal(&betapb.GenerateContentResponse{
+		Candidates: []*betapb.Candidate{{
+			Index: &index,
+			Content: &betapb.Content{
+				Parts: []*betapb.Part{{Data: &betapb.Part_FunctionCall{
+					FunctionCall: &betapb.FunctionCall{Name: "CALENDAR", Args: args},
+				}}},
+				Role: "model",
+			},
+		}},
+		UsageMetadata: &betapb.GenerateContentResponse_UsageMetadata{
+			PromptTokenCount:     40,
+			CandidatesTokenCount: 5,
+			TotalTokenCount:      45,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := &betapb.GenerateContentRequest{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		if err := protojson.Unmarshal(b, req); err != nil {
+			t.Error(err)
+		}
+		w.Write(body)
+	}))
+	defer ts.Close()
+
+	e := &env.Environment{Platform: env.GOTEST}
+	ctx := context.Background()
+	client, err := NewPalmLLMClient(ctx, e, option.WithoutAuthentication(), option.WithEndpoint(ts.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.GenerateWithFunctions(ctx, []llm.Message{
+		llm.NewMessage(llm.RoleUser, "What's on today?"),
+		{Role: llm.RoleModel, Parts: []llm.Part{{FunctionCall: &llm.FunctionCall{Name: "ANSWER", Args: map[string]any{}}}}},
+		{Role: llm.RoleTool, Parts: []llm.Part{{FunctionResponse: &llm.FunctionResponse{Name: "ANSWER", Response: map[string]any{"result": "ok"}}}}},
+	}, []llm.FunctionDeclaration{{
+		Name:        "CALENDAR",
+		Description: "Look up the calendar",
+		Parameters: &llm.Schema{
+			Type:       "object",
+			Properties: map[string]*llm.Schema{"date": {Type: "string"}},
+			Required:   []string{"date"},
+		},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp.FunctionCalls) != 1 || resp.FunctionCalls[0].Name != "CALENDAR" || resp.FunctionCalls[0].Args["date"] != "2023-12-14" {
+		t.Errorf("Unexpected function calls %#v", resp.FunctionCalls)
+	}
+	if want := (llm.Usage{PromptTokens: 40, CandidateTokens: 5, TotalTokens: 45}); resp.Usage == nil || *resp.Usage != want {
+		t.Errorf("Expected usage %+v from the metadata, got %+v", want, resp.Usage)
+	}
+
+	if len(req.Tools) != 1 || req.Tools[0].FunctionDeclarations[0].Parameters.Type != betapb.Type_OBJECT {
+		t.Errorf("Expected function declarations in request, got %v", req.Tools)
+	}
+	roles := []string{}
+	for _, c := range req.Contents {
+		roles = append(roles, c.Role)
+	}
+	if fmt.Sprint(roles) != "[user model function]" {
+		t.Errorf("Expected user/model/function turns, got %v", roles)
+	}
+}
+
+func TestBatchEmbedTextTaskType(t *testing.T) {
+	body, err := protojson.Marshal(&pb.BatchEmbedContentsResponse{
+		Embeddings: []*pb.ContentEmbedding{{Values: []float32{0.1, 0.2}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := &pb.BatchEmbedContentsRequest{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		if err := protojson.Unmarshal(b, req); err != nil {
+			t.Error(err)
+		}
+		w.Write(body)
+	}))
+	defer ts.Close()
+
+	e := &env.Environment{Platform: env.GOTEST}
+	ctx := context.Background()
+	client, err := NewPalmLLMClient(ctx, e, option.WithoutAuthentication(), option.WithEndpoint(ts.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		opts     llm.EmbedOptions
+		taskType pb.TaskType
+		title    string
+	}{
+		{"unspecified", llm.EmbedOptions{}, pb.TaskType_TASK_TYPE_UNSPECIFIED, ""},
+		{"query", llm.QueryEmbedding(), pb.TaskType_RETRIEVAL_QUERY, ""},
+		{"document", llm.DocumentEmbedding("Guide"), pb.TaskType_RETRIEVAL_DOCUMENT, "Guide"},
+		{"title only for documents", llm.EmbedOptions{TaskType: llm.TaskSimilarity, Title: "Guide"}, pb.TaskType_SEMANTIC_SIMILARITY, ""},
+		{"classification", llm.EmbedOptions{TaskType: llm.TaskClassification}, pb.TaskType_CLASSIFICATION, ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req.Reset()
+			embeddings, err := client.BatchEmbedText(ctx, []string{"hello"}, tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(embeddings) != 1 {
+				t.Fatalf("Expected 1 embedding, got %d", len(embeddings))
+			}
+			if len(req.Requests) != 1 {
+				t.Fatalf("Expected 1 request, got %v", req.Requests)
+			}
+			if got := req.Requests[0].GetTaskType(); got != tc.taskType {
+				t.Errorf("Expected task type %v, got %v", tc.taskType, got)
+			}
+			if got := req.Requests[0].GetTitle(); got != tc.title {
+				t.Errorf("Expected title '%s', got '%s'", tc.title, got)
+			}
+		})
+	}
+
+	if _, err := client.BatchEmbedText(ctx, []string{"hello"}, llm.EmbedOptions{TaskType: "clustering"}); err == nil {
+		t.Error("Expected an error for an unknown task type")
+	}
+}
+
+func TestBatchEmbedTextBatches(t *testing.T) {
+	var mu sync.Mutex
+	sizes := []int{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		req := &pb.BatchEmbedContentsRequest{}
+		if err := protojson.Unmarshal(b, req); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		sizes = append(sizes, len(req.Requests))
+		mu.Unlock()
+		// Embeds each text as its number.
+		resp := &pb.BatchEmbedContentsResponse{}
+		for _, r := range req.Requests {
+			n, _ := strconv.Atoi(r.Content.Parts[0].GetText())
+			resp.Embeddings = append(resp.Embeddings, &pb.ContentEmbedding{Values: []float32{float32(n)}})
+		}
+		body, _ := protojson.Marshal(resp)
+		w.Write(body)
+	}))
+	defer ts.Close()
+
+	e := &env.Environment{Platform: env.GOTEST}
+	ctx := context.Background()
+	client, err := NewPalmLLMClient(ctx, e, option.WithoutAuthentication(), option.WithEndpoint(ts.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	texts := make([]string, 250)
+	for i := range texts {
+		texts[i] = strconv.Itoa(i)
+	}
+	embeddings, err := client.BatchEmbedText(ctx, texts, llm.DocumentEmbedding(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Ints(sizes)
+	if fmt.Sprint(sizes) != "[50 100 100]" {
+		t.Errorf("Expected batches of at most 100 texts, got %v", sizes)
+	}
+	for i, emb := range embeddings {
+		if len(emb) != 1 || emb[0] != float32(i) {
+			t.Fatalf("Expected embeddings in order, got %v at %d", emb, i)
+		}
+	}
+}
+
+func TestNewClientForEnvironmentFallback(t *testing.T) {
+	message := "From the fallback"
+	body, err := protojson.Marshal(&pb.GenerateContentResponse{
+		Candidates: []*pb.Candidate{{
+			Content: &pb.Content{
+				Parts: []*pb.Part{{Data: &pb.Part_Text{Text: message}}},
+				Role:  "model",
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	overloaded := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "models/overloaded") {
+			overloaded++
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"error":{"code":429,"message":"quota exceeded","status":"RESOURCE_EXHAUSTED"}}`))
+			return
+		}
+		w.Write(body)
+	}))
+	defer ts.Close()
+
+	e := &env.Environment{
+		Platform:          env.GOTEST,
+		LlmModel:          "overloaded",
+		LlmFallbackModels: []string{"gemini-pro"},
+	}
+	ctx := context.Background()
+	client, err := NewClientForEnvironment(ctx, e, option.WithoutAuthentication(), option.WithEndpoint(ts.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	gen, err := client.GenerateMessages(ctx, []llm.Message{llm.NewMessage(llm.RoleUser, "Hello")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gen.Text != message || gen.Provider != "gemini-pro" {
+		t.Errorf("Expected the fallback model to answer, got %+v", gen)
+	}
+	if overloaded != 1 {
+		t.Errorf("Expected to fall back without retrying the overloaded model, got %d calls", overloaded)
+	}
+}
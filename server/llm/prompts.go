@@ -21,37 +21,48 @@ const (
 	PROMPT_CHAT PromptId = iota
 )
 
-func ChatPrompt(query string, context []string) (string, error) {
+// Builds the conversation for a chat query, the instructions, tool
+// descriptions and context are sent as the system message followed by the
+// previous turns and the user's question.
+func ChatMessages(query string, context []string, history []Message, tools string) ([]Message, error) {
 	c := strings.Join(context, "\n")
 	now := time.Now()
 	todaysDate := now.Format("Monday January 2, 2006")
-	prompt, err := Prompt(PROMPT_CHAT, map[string]string{
-		"Query":      query,
+	system, err := Prompt(PROMPT_CHAT, map[string]string{
 		"Context":    c,
+		"Tools":      tools,
 		"TodaysDate": todaysDate})
 
 	if err != nil {
 		fmt.Printf("error '%s' creating prompt for: '%s", err.Error(), query)
+		return nil, err
 	}
-	return prompt, err
+	messages := make([]Message, 0, len(history)+2)
+	messages = append(messages, NewMessage(RoleSystem, system))
+	messages = append(messages, history...)
+	messages = append(messages, NewMessage(RoleUser, "USERQUESTION: "+query))
+	return messages, nil
 }
 
 func Prompt(id PromptId, data map[string]string) (string, error) {
+	var name, text string
 	switch id {
 	case PROMPT_CHAT:
-		tmpl, err := template.New("chat").Parse(ChatPromptTemplate)
-		if err != nil {
-			return "", err
-		}
-		buf := new(bytes.Buffer)
-		if err = tmpl.Execute(buf, data); err != nil {
-			return "", err
-		}
-
-		result := buf.String()
-		slog.Info(fmt.Sprintf("using chatprompt: \n%s\n===============================", result))
-		return result, nil
+		name, text = "chat", ChatPromptTemplate
 	default:
 		return "", fmt.Errorf("unknown prompt id")
 	}
+
+	tmpl, err := template.New(name).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	buf := new(bytes.Buffer)
+	if err = tmpl.Execute(buf, data); err != nil {
+		return "", err
+	}
+
+	result := buf.String()
+	slog.Info(fmt.Sprintf("using %sprompt: \n%s\n===============================", name, result))
+	return result, nil
 }
@@ -0,0 +1,354 @@
+// Package retry wraps an llm.LlmClient so transient failures such as rate
+// limits and overloaded servers are retried with backoff instead of reaching
+// the user.
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/rcleveng/assistant/server/env"
+	"github.com/rcleveng/assistant/server/llm"
+	"golang.org/x/time/rate"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type Options struct {
+	// Attempts after the first one fails, 0 disables retries
+	MaxRetries int
+	// Wait before the first retry, doubled for each one after that up to
+	// MaxBackoff
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Between 0 and 1, how much each wait is randomized so clients that
+	// failed together don't retry together.  0.5 waits 50% to 150% of the
+	// backoff.
+	Jitter float64
+	// Most calls per second, 0 for no limit.  Retries count as calls.
+	RateLimit float64
+	// Calls that can be made at once before RateLimit applies, at least 1
+	Burst int
+	// Longest a single attempt may take, 0 for no limit.  Streams must finish
+	// within it.
+	Timeout time.Duration
+	// Returns true if a failed call is worth retrying, defaults to Retryable
+	Retryable func(error) bool
+}
+
+// Returns options suited to interactive use, a few quick retries.
+func DefaultOptions() Options {
+	return Options{
+		MaxRetries:     3,
+		InitialBackoff: 500 * time.Millisecond,
+		MaxBackoff:     8 * time.Second,
+		Jitter:         0.5,
+		Burst:          1,
+		Timeout:        time.Minute,
+		Retryable:      Retryable,
+	}
+}
+
+// Returns the default options with the LLM_ settings of the environment.
+func OptionsFromEnvironment(environment *env.Environment) Options {
+	opts := DefaultOptions()
+	switch {
+	case environment.LlmMaxRetries < 0:
+		opts.MaxRetries = 0
+	case environment.LlmMaxRetries > 0:
+		opts.MaxRetries = int(environment.LlmMaxRetries)
+	}
+	if environment.LlmRateLimit > 0 {
+		opts.RateLimit = float64(environment.LlmRateLimit)
+		opts.Burst = max(1, int(math.Ceil(opts.RateLimit)))
+	}
+	if environment.LlmTimeout > 0 {
+		opts.Timeout = environment.LlmTimeout
+	}
+	return opts
+}
+
+// HTTP statuses of REST calls that may succeed if tried again.
+var retryableStatuses = map[int]bool{
+	http.StatusRequestTimeout:      true,
+	http.StatusTooManyRequests:     true,
+	http.StatusInternalServerError: true,
+	http.StatusBadGateway:          true,
+	http.StatusServiceUnavailable:  true,
+	http.StatusGatewayTimeout:      true,
+}
+
+// Codes of gRPC calls that may succeed if tried again.
+var retryableCodes = map[codes.Code]bool{
+	codes.ResourceExhausted: true,
+	codes.Unavailable:       true,
+	codes.Aborted:           true,
+	codes.Internal:          true,
+	codes.DeadlineExceeded:  true,
+}
+
+// Returns true if err is from a REST or gRPC call that failed for a
+// transient reason, such as a rate limit or an overloaded server.
+func Retryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	// REST errors also look like gRPC errors, but always with code Unknown.
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return retryableStatuses[apiErr.Code]
+	}
+	if s, ok := status.FromError(err); ok {
+		return retryableCodes[s.Code()]
+	}
+	return false
+}
+
+// An llm.LlmClient that retries failed calls of the client it wraps.
+type Client struct {
+	client  llm.LlmClient
+	opts    Options
+	limiter *rate.Limiter
+	// Waits between attempts, replaced by tests
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+// Adds GenerateWithFunctions when the wrapped client supports it, so callers
+// checking for llm.FunctionCaller see the same thing as without retries.
+type functionClient struct {
+	*Client
+	caller llm.FunctionCaller
+}
+
+// Wraps client so its calls are rate limited, timed out and retried as opts
+// says.  Closing the returned client closes client.
+func NewClient(client llm.LlmClient, opts Options) llm.LlmClient {
+	c := newClient(client, opts)
+	if caller, ok := client.(llm.FunctionCaller); ok {
+		return &functionClient{Client: c, caller: caller}
+	}
+	return c
+}
+
+func newClient(client llm.LlmClient, opts Options) *Client {
+	if opts.Retryable == nil {
+		opts.Retryable = Retryable
+	}
+	c := &Client{client: client, opts: opts, sleep: sleep}
+	if opts.RateLimit > 0 {
+		c.limiter = rate.NewLimiter(rate.Limit(opts.RateLimit), max(opts.Burst, 1))
+	}
+	return c
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Returns how long to wait before retry number attempt, counting from 0.
+// random is between 0 and 1 and spreads the wait by Jitter.
+func (c *Client) backoff(attempt int, random float64) time.Duration {
+	d := float64(c.opts.InitialBackoff) * math.Pow(2, float64(attempt))
+	if c.opts.MaxBackoff > 0 {
+		d = math.Min(d, float64(c.opts.MaxBackoff))
+	}
+	d *= 1 + c.opts.Jitter*(2*random-1)
+	return time.Duration(d)
+}
+
+// Returns a context for one attempt, limited to Timeout.
+func (c *Client) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.opts.Timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, c.opts.Timeout)
+}
+
+// Returns true if an attempt that failed with err should be tried again.
+func (c *Client) retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	// The caller still has time, so only the attempt timed out.
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	return c.opts.Retryable(err)
+}
+
+// Calls f until it succeeds, fails with an error that isn't worth retrying,
+// or runs out of retries.  f is responsible for any timeout.
+func (c *Client) retry(ctx context.Context, call string, f func(ctx context.Context) error) error {
+	for attempt := 0; ; attempt++ {
+		if c.limiter != nil {
+			if err := c.limiter.Wait(ctx); err != nil {
+				return err
+			}
+		}
+		err := f(ctx)
+		if err == nil {
+			return nil
+		}
+		if attempt >= c.opts.MaxRetries || !c.retryable(ctx, err) {
+			return err
+		}
+		delay := c.backoff(attempt, rand.Float64())
+		slog.WarnContext(ctx, "retrying llm call", "call", call, "attempt", attempt+1, "delay", delay, "error", err)
+		if err := c.sleep(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+// Like retry, but each attempt is limited to Timeout.
+func (c *Client) do(ctx context.Context, call string, f func(ctx context.Context) error) error {
+	return c.retry(ctx, call, func(ctx context.Context) error {
+		ctx, cancel := c.withTimeout(ctx)
+		defer cancel()
+		return f(ctx)
+	})
+}
+
+func (c *Client) GenerateText(ctx context.Context, prompt string) (string, error) {
+	var text string
+	err := c.do(ctx, "GenerateText", func(ctx context.Context) error {
+		var err error
+		text, err = c.client.GenerateText(ctx, prompt)
+		return err
+	})
+	return text, err
+}
+
+// Only opening the stream is retried, once chunks have been sent a failure
+// is reported on the stream as usual.
+func (c *Client) GenerateTextStream(ctx context.Context, prompt string) (<-chan llm.StreamChunk, error) {
+	var stream <-chan llm.StreamChunk
+	cancel := func() {}
+	err := c.retry(ctx, "GenerateTextStream", func(ctx context.Context) error {
+		attemptCtx, attemptCancel := c.withTimeout(ctx)
+		s, err := c.client.GenerateTextStream(attemptCtx, prompt)
+		if err != nil {
+			attemptCancel()
+			return err
+		}
+		stream, cancel = s, attemptCancel
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if c.opts.Timeout <= 0 {
+		return stream, nil
+	}
+
+	// Keep the attempt's context alive until the stream is done.
+	sender, forwarded := llm.NewStreamSender(ctx)
+	go func() {
+		defer cancel()
+		defer sender.Close()
+		for chunk := range stream {
+			if !sender.Send(chunk) {
+				return
+			}
+		}
+	}()
+	return forwarded, nil
+}
+
+func (c *Client) GenerateMessages(ctx context.Context, messages []llm.Message) (*llm.Generation, error) {
+	var gen *llm.Generation
+	err := c.do(ctx, "GenerateMessages", func(ctx context.Context) error {
+		var err error
+		gen, err = c.client.GenerateMessages(ctx, messages)
+		return err
+	})
+	return gen, err
+}
+
+func (c *functionClient) GenerateWithFunctions(ctx context.Context, messages []llm.Message, functions []llm.FunctionDeclaration) (*llm.Generation, error) {
+	var gen *llm.Generation
+	err := c.do(ctx, "GenerateWithFunctions", func(ctx context.Context) error {
+		var err error
+		gen, err = c.caller.GenerateWithFunctions(ctx, messages, functions)
+		return err
+	})
+	return gen, err
+}
+
+func (c *Client) EmbedText(ctx context.Context, text string, opts llm.EmbedOptions) ([]float32, error) {
+	var embedding []float32
+	err := c.do(ctx, "EmbedText", func(ctx context.Context) error {
+		var err error
+		embedding, err = c.client.EmbedText(ctx, text, opts)
+		return err
+	})
+	return embedding, err
+}
+
+// When only some texts fail, just those are retried.
+func (c *Client) BatchEmbedText(ctx context.Context, texts []string, opts llm.EmbedOptions) ([][]float32, error) {
+	embeddings := make([][]float32, len(texts))
+	errs := make([]error, len(texts))
+	// Indexes of the texts still to embed
+	pending := make([]int, len(texts))
+	for i := range pending {
+		pending[i] = i
+	}
+	err := c.do(ctx, "BatchEmbedText", func(ctx context.Context) error {
+		batch := make([]string, len(pending))
+		for n, i := range pending {
+			batch[n] = texts[i]
+		}
+		result, err := c.client.BatchEmbedText(ctx, batch, opts)
+		var batchErr *llm.BatchError
+		if err != nil && !errors.As(err, &batchErr) {
+			return err
+		}
+		if len(result) != len(batch) || (batchErr != nil && len(batchErr.Errors) != len(batch)) {
+			return fmt.Errorf("expected %d embeddings, got %d", len(batch), len(result))
+		}
+		failed := make([]int, 0)
+		for n, i := range pending {
+			if batchErr != nil && batchErr.Errors[n] != nil {
+				errs[i] = batchErr.Errors[n]
+				failed = append(failed, i)
+				continue
+			}
+			embeddings[i], errs[i] = result[n], nil
+		}
+		pending = failed
+		return err
+	})
+	if err == nil {
+		return embeddings, nil
+	}
+	var batchErr *llm.BatchError
+	if !errors.As(err, &batchErr) {
+		if len(pending) == len(texts) {
+			return nil, err
+		}
+		for _, i := range pending {
+			errs[i] = err
+		}
+	}
+	// Report failures against every text, not just the last attempt's.
+	return embeddings, &llm.BatchError{Errors: errs}
+}
+
+func (c *Client) Close() error {
+	return c.client.Close()
+}
@@ -0,0 +1,270 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rcleveng/assistant/server/llm"
+	"github.com/rcleveng/assistant/server/llm/fake"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Fails calls with the errors in failures, in order, before handing them to
+// the fake client.
+type flakyClient struct {
+	*fake.LlmClient
+	mu       sync.Mutex
+	failures []error
+	calls    int
+	// Texts of each BatchEmbedText call
+	batches [][]string
+}
+
+func (c *flakyClient) fail() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+	if len(c.failures) == 0 {
+		return nil
+	}
+	err := c.failures[0]
+	c.failures = c.failures[1:]
+	return err
+}
+
+func (c *flakyClient) GenerateText(ctx context.Context, prompt string) (string, error) {
+	if err := c.fail(); err != nil {
+		return "", err
+	}
+	return c.LlmClient.GenerateText(ctx, prompt)
+}
+
+func (c *flakyClient) BatchEmbedText(ctx context.Context, texts []string, opts llm.EmbedOptions) ([][]float32, error) {
+	c.mu.Lock()
+	c.batches = append(c.batches, texts)
+	c.mu.Unlock()
+	embeddings, _ := c.LlmClient.BatchEmbedText(ctx, texts, opts)
+	// Texts starting with "bad" fail the first time they are seen.
+	errs := make([]error, len(texts))
+	failed := false
+	for i, text := range texts {
+		if text[:3] == "bad" && len(c.batches) == 1 {
+			errs[i] = &googleapi.Error{Code: http.StatusServiceUnavailable}
+			embeddings[i] = nil
+			failed = true
+		}
+	}
+	if failed {
+		return embeddings, &llm.BatchError{Errors: errs}
+	}
+	return embeddings, nil
+}
+
+// Returns a client that doesn't wait between attempts.
+func newTestClient(client llm.LlmClient, opts Options) *Client {
+	c := newClient(client, opts)
+	c.sleep = func(ctx context.Context, d time.Duration) error { return ctx.Err() }
+	return c
+}
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"rest rate limit", &googleapi.Error{Code: http.StatusTooManyRequests}, true},
+		{"rest unavailable", &googleapi.Error{Code: http.StatusServiceUnavailable}, true},
+		{"rest bad request", &googleapi.Error{Code: http.StatusBadRequest}, false},
+		{"wrapped rest", fmt.Errorf("calling: %w", &googleapi.Error{Code: http.StatusBadGateway}), true},
+		{"grpc exhausted", status.Error(codes.ResourceExhausted, "quota"), true},
+		{"grpc unavailable", status.Error(codes.Unavailable, "overloaded"), true},
+		{"grpc invalid", status.Error(codes.InvalidArgument, "bad"), false},
+		{"plain", errors.New("oops"), false},
+		{"canceled", context.Canceled, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := Retryable(tc.err); got != tc.want {
+				t.Errorf("Retryable(%v) = %v, want %v", tc.err, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	c := newClient(fake.NewLlmClient(), Options{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second, Jitter: 0.5})
+	tests := []struct {
+		attempt int
+		random  float64
+		want    time.Duration
+	}{
+		{0, 0.5, 100 * time.Millisecond},
+		{1, 0.5, 200 * time.Millisecond},
+		{3, 0.5, 800 * time.Millisecond},
+		{4, 0.5, time.Second},
+		{0, 0, 50 * time.Millisecond},
+		{0, 1, 150 * time.Millisecond},
+		{10, 1, 1500 * time.Millisecond},
+	}
+	for _, tc := range tests {
+		if got := c.backoff(tc.attempt, tc.random); got != tc.want {
+			t.Errorf("backoff(%d, %v) = %v, want %v", tc.attempt, tc.random, got, tc.want)
+		}
+	}
+}
+
+func TestRetries(t *testing.T) {
+	ctx := context.Background()
+	unavailable := status.Error(codes.Unavailable, "overloaded")
+	tests := []struct {
+		name     string
+		failures []error
+		retries  int
+		calls    int
+		wantErr  bool
+	}{
+		{"succeeds", nil, 3, 1, false},
+		{"transient", []error{unavailable, &googleapi.Error{Code: http.StatusTooManyRequests}}, 3, 3, false},
+		{"exhausted", []error{unavailable, unavailable, unavailable}, 2, 3, true},
+		{"permanent", []error{status.Error(codes.PermissionDenied, "no"), unavailable}, 3, 1, true},
+		{"disabled", []error{unavailable}, 0, 1, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			flaky := &flakyClient{LlmClient: fake.NewLlmClient("hello"), failures: tc.failures}
+			c := newTestClient(flaky, Options{MaxRetries: tc.retries})
+			text, err := c.GenerateText(ctx, "hi")
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Expected error %v, got %v", tc.wantErr, err)
+			}
+			if !tc.wantErr && text != "hello" {
+				t.Errorf("Expected hello, got %s", text)
+			}
+			if flaky.calls != tc.calls {
+				t.Errorf("Expected %d calls, got %d", tc.calls, flaky.calls)
+			}
+		})
+	}
+}
+
+// Blocks every call until its context is done.
+type slowClient struct {
+	*fake.LlmClient
+	mu    sync.Mutex
+	calls int
+}
+
+func (c *slowClient) GenerateText(ctx context.Context, prompt string) (string, error) {
+	c.mu.Lock()
+	c.calls++
+	c.mu.Unlock()
+	<-ctx.Done()
+	return "", ctx.Err()
+}
+
+func TestTimeout(t *testing.T) {
+	slow := &slowClient{LlmClient: fake.NewLlmClient()}
+	c := newTestClient(slow, Options{MaxRetries: 2, Timeout: 5 * time.Millisecond})
+	if _, err := c.GenerateText(context.Background(), "hi"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the attempt to time out, got %v", err)
+	}
+	if slow.calls != 3 {
+		t.Errorf("Expected timed out attempts to be retried, got %d calls", slow.calls)
+	}
+
+	// When the caller gives up there is no point retrying.
+	slow.calls = 0
+	c = newTestClient(slow, Options{MaxRetries: 2, Timeout: time.Minute})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	if _, err := c.GenerateText(ctx, "hi"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the call to time out, got %v", err)
+	}
+	if slow.calls != 1 {
+		t.Errorf("Expected no retries after the caller's deadline, got %d calls", slow.calls)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	ctx := context.Background()
+	c := newTestClient(fake.NewLlmClient(), Options{RateLimit: 100, Burst: 1})
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		if _, err := c.GenerateText(ctx, "hi"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The first call uses the burst, the other three wait 10ms each.
+	if elapsed := time.Since(start); elapsed < 25*time.Millisecond {
+		t.Errorf("Expected calls to be rate limited, took %v", elapsed)
+	}
+}
+
+func TestBatchEmbedTextRetriesFailed(t *testing.T) {
+	flaky := &flakyClient{LlmClient: fake.NewLlmClient()}
+	c := newTestClient(flaky, Options{MaxRetries: 1})
+	texts := []string{"good one", "bad two", "good three", "bad four"}
+	embeddings, err := c.BatchEmbedText(context.Background(), texts, llm.DocumentEmbedding(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flaky.batches) != 2 || fmt.Sprint(flaky.batches[1]) != "[bad two bad four]" {
+		t.Errorf("Expected only the failed texts to be retried, got %v", flaky.batches)
+	}
+	for i, text := range texts {
+		if fmt.Sprint(embeddings[i]) != fmt.Sprint(fake.HashEmbedding(text)) {
+			t.Errorf("Expected the embedding of '%s' at %d", text, i)
+		}
+	}
+
+	// Without retries the failures are reported against every text.
+	flaky = &flakyClient{LlmClient: fake.NewLlmClient()}
+	c = newTestClient(flaky, Options{})
+	embeddings, err = c.BatchEmbedText(context.Background(), texts, llm.DocumentEmbedding(""))
+	var batchErr *llm.BatchError
+	if !errors.As(err, &batchErr) || fmt.Sprint(batchErr.Failed()) != "[1 3]" {
+		t.Fatalf("Expected texts 1 and 3 to fail, got %v", err)
+	}
+	if embeddings[0] == nil || embeddings[1] != nil {
+		t.Errorf("Expected only the failed texts to be missing, got %v", embeddings)
+	}
+}
+
+func TestStreamTimeout(t *testing.T) {
+	c := NewClient(fake.NewLlmClient("one two three"), Options{Timeout: time.Minute})
+	stream, err := c.GenerateTextStream(context.Background(), "hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, last := llm.CollectStream(stream)
+	if text != "one two three" || !last.Done {
+		t.Errorf("Expected the whole stream, got '%s' %+v", text, last)
+	}
+}
+
+func TestFunctionCaller(t *testing.T) {
+	if _, ok := NewClient(fake.NewLlmClient(), DefaultOptions()).(llm.FunctionCaller); ok {
+		t.Error("Expected no function calling when the wrapped client can't")
+	}
+	generation := &llm.Generation{FunctionCalls: []llm.FunctionCall{{Name: "remember"}}}
+	c, ok := NewClient(fake.NewFunctionCallingClient(generation), DefaultOptions()).(llm.FunctionCaller)
+	if !ok {
+		t.Fatal("Expected function calling when the wrapped client can")
+	}
+	gen, err := c.GenerateWithFunctions(context.Background(), []llm.Message{llm.NewMessage(llm.RoleUser, "hi")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gen.FunctionCalls) != 1 || gen.FunctionCalls[0].Name != "remember" {
+		t.Errorf("Expected the wrapped client's generation, got %+v", gen)
+	}
+}
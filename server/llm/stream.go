@@ -0,0 +1,41 @@
+package llm
+
+import "context"
+
+// Writes the chunks of a stream so that the consumer always gets a final
+// chunk, even when the context is canceled while nobody is reading.
+type StreamSender struct {
+	ctx    context.Context
+	stream chan StreamChunk
+}
+
+// Returns a sender and the channel it writes to.  The producer must call
+// Close when done.
+func NewStreamSender(ctx context.Context) (*StreamSender, <-chan StreamChunk) {
+	// The one slot of buffer is where the final chunk goes on cancelation.
+	s := &StreamSender{ctx: ctx, stream: make(chan StreamChunk, 1)}
+	return s, s.stream
+}
+
+// Sends chunk, returning false if the context was canceled first.  In that
+// case a final chunk with the context's error has been queued in its place
+// and the producer should stop.
+func (s *StreamSender) Send(chunk StreamChunk) bool {
+	select {
+	case s.stream <- chunk:
+		return true
+	case <-s.ctx.Done():
+		// Only this sender writes to the stream, so once an unread chunk is
+		// dropped the final one fits in the buffer.
+		select {
+		case <-s.stream:
+		default:
+		}
+		s.stream <- StreamChunk{Done: true, Err: s.ctx.Err()}
+		return false
+	}
+}
+
+func (s *StreamSender) Close() {
+	close(s.stream)
+}
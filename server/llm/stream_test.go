@@ -0,0 +1,25 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestStreamSenderCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sender, stream := NewStreamSender(ctx)
+	if !sender.Send(StreamChunk{Text: "unread"}) {
+		t.Fatal("Expected the first chunk to be buffered")
+	}
+	cancel()
+	if sender.Send(StreamChunk{Text: "more"}) {
+		t.Fatal("Expected sending to stop once canceled")
+	}
+	sender.Close()
+
+	text, last := CollectStream(stream)
+	if text != "" || !last.Done || !errors.Is(last.Err, context.Canceled) {
+		t.Errorf("Expected only a final canceled chunk, got '%s' %+v", text, last)
+	}
+}
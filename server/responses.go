@@ -9,7 +9,7 @@ import (
 
 // Encodes the resource as JSON, logs to locally and writes it to the
 // response w.
-func EncodeAndLogResponse(resp json.Marshaler, w http.ResponseWriter) error {
+func EncodeAndLogResponse(resp any, w http.ResponseWriter) error {
 	b := new(bytes.Buffer)
 	enc := json.NewEncoder(b)
 	enc.SetIndent("", "  ")
@@ -0,0 +1,77 @@
+package session
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Session store that keeps everything in memory, sessions are lost on
+// restart.
+type MemoryStore struct {
+	mu       sync.Mutex
+	sessions map[string][]Turn
+	pending  map[string]Pending
+	// Maximum number of turns kept per session, 0 keeps everything.
+	MaxTurns int
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		sessions: map[string][]Turn{},
+		pending:  map[string]Pending{},
+		MaxTurns: DefaultMaxTurns,
+	}
+}
+
+func (s *MemoryStore) Append(ctx context.Context, sessionId string, turns ...Turn) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for _, t := range turns {
+		if t.Created.IsZero() {
+			t.Created = now
+		}
+		s.sessions[sessionId] = append(s.sessions[sessionId], t)
+	}
+	if all := s.sessions[sessionId]; s.MaxTurns > 0 && len(all) > s.MaxTurns {
+		s.sessions[sessionId] = append([]Turn(nil), all[len(all)-s.MaxTurns:]...)
+	}
+	return nil
+}
+
+func (s *MemoryStore) History(ctx context.Context, sessionId string, limit int) ([]Turn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	all := s.sessions[sessionId]
+	if limit > 0 && len(all) > limit {
+		all = all[len(all)-limit:]
+	}
+	return append([]Turn(nil), all...), nil
+}
+
+func (s *MemoryStore) Pending(ctx context.Context, sessionId string) (*Pending, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.pending[sessionId]
+	if !ok {
+		return nil, nil
+	}
+	p.Answers = append([]string(nil), p.Answers...)
+	return &p, nil
+}
+
+func (s *MemoryStore) SetPending(ctx context.Context, sessionId string, pending *Pending) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if pending == nil {
+		delete(s.pending, sessionId)
+		return nil
+	}
+	p := *pending
+	p.Answers = append([]string(nil), p.Answers...)
+	s.pending[sessionId] = p
+	return nil
+}
+
+func (s *MemoryStore) Close() {}
@@ -0,0 +1,155 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	pgx "github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/rcleveng/assistant/server/db"
+	"github.com/rcleveng/assistant/server/env"
+	"github.com/rcleveng/assistant/server/llm"
+)
+
+// Session store backed by the session_turns and session_pending tables.
+type PostgresStore struct {
+	pool *pgxpool.Pool
+	// Maximum number of turns kept per session, 0 keeps everything.
+	MaxTurns int
+}
+
+func (s *PostgresStore) Append(ctx context.Context, sessionId string, turns ...Turn) error {
+	sql := `
+INSERT INTO session_turns(
+	session_id, role, text, created
+) VALUES(
+	$1, $2, $3, NOW()
+);`
+	trim := `
+DELETE FROM session_turns
+WHERE session_id = $1 AND id NOT IN (
+	SELECT id FROM session_turns
+	WHERE session_id = $1
+	ORDER BY id DESC
+	LIMIT $2
+);`
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	batch := &pgx.Batch{}
+	for _, t := range turns {
+		batch.Queue(sql, sessionId, string(t.Role), t.Text)
+	}
+	if s.MaxTurns > 0 {
+		batch.Queue(trim, sessionId, s.MaxTurns)
+	}
+	if err := tx.SendBatch(ctx, batch).Close(); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func (s *PostgresStore) History(ctx context.Context, sessionId string, limit int) ([]Turn, error) {
+	// Take the newest turns then put them back in order.
+	sql := `SELECT role, text, created FROM (
+		SELECT id, role, text, created
+		FROM session_turns
+		WHERE session_id = $1
+		ORDER BY id DESC
+		LIMIT $2
+	) AS recent ORDER BY id;
+`
+	// LIMIT NULL returns every row
+	var lim any
+	if limit > 0 {
+		lim = limit
+	}
+	rows, err := s.pool.Query(ctx, sql, sessionId, lim)
+	if err != nil {
+		return nil, err
+	}
+	var t Turn
+	var role string
+	turns := make([]Turn, 0)
+	_, err = pgx.ForEachRow(rows, []any{&role, &t.Text, &t.Created}, func() error {
+		t.Role = llm.Role(role)
+		turns = append(turns, t)
+		return nil
+	})
+	return turns, err
+}
+
+func (s *PostgresStore) Pending(ctx context.Context, sessionId string) (*Pending, error) {
+	sql := `SELECT question, answers, rounds
+	FROM session_pending
+	WHERE session_id = $1;
+`
+	p := &Pending{}
+	err := s.pool.QueryRow(ctx, sql, sessionId).Scan(&p.Question, &p.Answers, &p.Rounds)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (s *PostgresStore) SetPending(ctx context.Context, sessionId string, pending *Pending) error {
+	if pending == nil {
+		_, err := s.pool.Exec(ctx, `DELETE FROM session_pending WHERE session_id = $1;`, sessionId)
+		return err
+	}
+
+	sql := `
+INSERT INTO session_pending(
+	session_id, question, answers, rounds, updated
+) VALUES(
+	$1, $2, $3, $4, NOW()
+) ON CONFLICT (session_id) DO UPDATE SET
+	question = EXCLUDED.question,
+	answers = EXCLUDED.answers,
+	rounds = EXCLUDED.rounds,
+	updated = EXCLUDED.updated;`
+	answers := pending.Answers
+	if answers == nil {
+		answers = []string{}
+	}
+	_, err := s.pool.Exec(ctx, sql, sessionId, pending.Question, answers, pending.Rounds)
+	return err
+}
+
+// The pool belongs to whoever created the store.
+func (s *PostgresStore) Close() {
+}
+
+// Creates a store using an existing pool, such as the embeddings database's,
+// the caller keeps ownership of the pool.
+func NewPostgresStore(pool *pgxpool.Pool) *PostgresStore {
+	return &PostgresStore{pool: pool, MaxTurns: DefaultMaxTurns}
+}
+
+// Creates the session store for the environment's database backend, backends
+// without tables for sessions keep them in memory.  Postgres and SQLite
+// sessions share edb's connection.
+func NewStore(ctx context.Context, env *env.Environment, edb db.EmbeddingsDB) (Store, error) {
+	switch db.Backend(env) {
+	case db.PostgresBackend:
+		pg, ok := edb.(*db.PostgresDatabase)
+		if !ok {
+			return nil, fmt.Errorf("postgres sessions need the postgres embeddings database, got %T", edb)
+		}
+		return NewPostgresStore(pg.Pool()), nil
+	case db.SQLiteBackend:
+		lite, ok := edb.(*db.SQLiteDatabase)
+		if !ok {
+			return nil, fmt.Errorf("sqlite sessions need the sqlite embeddings database, got %T", edb)
+		}
+		return NewSQLiteStore(lite.DB()), nil
+	default:
+		return NewMemoryStore(), nil
+	}
+}
@@ -0,0 +1,99 @@
+// Package session stores the turns of each conversation so the kernel can
+// send the history along with follow up questions.
+package session
+
+import (
+	"context"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/rcleveng/assistant/server/llm"
+)
+
+// A single turn of a conversation.
+type Turn struct {
+	Role    llm.Role
+	Text    string
+	Created time.Time
+}
+
+// A question parked while the user answers clarifying questions.
+type Pending struct {
+	// The user's original question
+	Question string
+	// Answers to the clarifying questions, in order
+	Answers []string
+	// Number of clarifying questions asked so far
+	Rounds int
+}
+
+// Returns the original question with the answers to the clarifying
+// questions appended.
+func (p *Pending) MergedQuestion() string {
+	if len(p.Answers) == 0 {
+		return p.Question
+	}
+	return p.Question + "\n\nAdditional information:\n" + strings.Join(p.Answers, "\n")
+}
+
+// Turns a new store keeps per session, older ones are dropped.
+const DefaultMaxTurns = 100
+
+// Stores conversation turns keyed by session id.
+type Store interface {
+	// Appends turns to the end of the session.
+	Append(ctx context.Context, sessionId string, turns ...Turn) error
+	// Returns up to the last limit turns of the session, oldest first.  A
+	// limit of 0 returns the whole session.
+	History(ctx context.Context, sessionId string, limit int) ([]Turn, error)
+	// Returns the pending question for the session or nil if there is none.
+	Pending(ctx context.Context, sessionId string) (*Pending, error)
+	// Parks a pending question on the session, nil clears it.
+	SetPending(ctx context.Context, sessionId string, pending *Pending) error
+
+	Close()
+}
+
+// Session id for a Google Chat conversation from the space (spaces/AAA),
+// thread (spaces/AAA/threads/BBB) and user (users/123) resource names.
+// Replies in a thread share the thread's session, otherwise the whole space
+// (or DM) is one session.  In spaces with several people pass the user so
+// each has their own session, and a question asked of one isn't answered by
+// another; leave it empty for a DM.  The id has no slashes so it can be used
+// in a URL path.
+func ChatSessionID(space, thread, user string) string {
+	id := "chat:" + strings.TrimPrefix(space, "spaces/")
+	if thread != "" {
+		id += ":" + path.Base(thread)
+	}
+	if user != "" {
+		id += ":" + path.Base(user)
+	}
+	return id
+}
+
+// Session id for a Slack conversation.  threadTs is the timestamp of the
+// thread's parent message, for a new thread that is the message itself.  As
+// with ChatSessionID, each user in a thread has their own session.
+func SlackSessionID(channel, threadTs, user string) string {
+	id := "slack:" + channel + ":" + threadTs
+	if user != "" {
+		id += ":" + user
+	}
+	return id
+}
+
+// Session id for the basic chat endpoint which has no notion of spaces.
+func BasicSessionID(name string) string {
+	return "basic:" + name
+}
+
+// Converts turns to messages for the LLM.
+func Messages(turns []Turn) []llm.Message {
+	messages := make([]llm.Message, len(turns))
+	for i, t := range turns {
+		messages[i] = llm.NewMessage(t.Role, t.Text)
+	}
+	return messages
+}
@@ -0,0 +1,191 @@
+package session
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/rcleveng/assistant/server/db"
+	"github.com/rcleveng/assistant/server/db/migrations"
+	"github.com/rcleveng/assistant/server/env"
+	"github.com/rcleveng/assistant/server/llm"
+)
+
+func TestSessionIDs(t *testing.T) {
+	tests := []struct {
+		got, want string
+	}{
+		{ChatSessionID("spaces/AAA", "", ""), "chat:AAA"},
+		{ChatSessionID("spaces/AAA", "spaces/AAA/threads/BBB", ""), "chat:AAA:BBB"},
+		{ChatSessionID("spaces/AAA", "spaces/AAA/threads/BBB", "users/42"), "chat:AAA:BBB:42"},
+		{ChatSessionID("spaces/AAA", "", "users/42"), "chat:AAA:42"},
+		{SlackSessionID("C123", "1700000000.000100", ""), "slack:C123:1700000000.000100"},
+		{SlackSessionID("C123", "1700000000.000100", "U1"), "slack:C123:1700000000.000100:U1"},
+		{BasicSessionID("rob"), "basic:rob"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("Expected '%s' got '%s'", tt.want, tt.got)
+		}
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	s.MaxTurns = 3
+
+	for _, text := range []string{"one", "two", "three", "four"} {
+		if err := s.Append(ctx, "a", Turn{Role: llm.RoleUser, Text: text}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Append(ctx, "b", Turn{Role: llm.RoleUser, Text: "other"})
+
+	turns, err := s.History(ctx, "a", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(turns) != 2 || turns[0].Text != "three" || turns[1].Text != "four" {
+		t.Errorf("Expected last two turns in order, got %#v", turns)
+	}
+	if turns[0].Created.IsZero() {
+		t.Error("Expected created time to be set")
+	}
+
+	all, _ := s.History(ctx, "a", 0)
+	if len(all) != 3 {
+		t.Errorf("Expected session to be capped at 3 turns, got %d", len(all))
+	}
+
+	none, _ := s.History(ctx, "missing", 10)
+	if len(none) != 0 {
+		t.Errorf("Expected no turns for unknown session, got %d", len(none))
+	}
+}
+
+func TestSQLiteStore(t *testing.T) {
+	ctx := context.Background()
+	edb, err := db.NewSQLiteDatabase(ctx, filepath.Join(t.TempDir(), "assistant.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer edb.Close()
+	s := NewSQLiteStore(edb.DB())
+	s.MaxTurns = 2
+	s.Append(ctx, "b", Turn{Role: llm.RoleModel, Text: "other"})
+
+	for _, text := range []string{"one", "two", "three"} {
+		if err := s.Append(ctx, "a", Turn{Role: llm.RoleUser, Text: text}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	turns, err := s.History(ctx, "a", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(turns) != 1 || turns[0].Text != "three" || turns[0].Role != llm.RoleUser {
+		t.Errorf("Expected the last turn, got %#v", turns)
+	}
+	if all, _ := s.History(ctx, "a", 0); len(all) != 2 || all[0].Text != "two" {
+		t.Errorf("Expected session to be capped at the last 2 turns, got %#v", all)
+	}
+	if other, _ := s.History(ctx, "b", 0); len(other) != 1 {
+		t.Errorf("Expected other sessions to be kept, got %#v", other)
+	}
+
+	if p, err := s.Pending(ctx, "a"); p != nil || err != nil {
+		t.Errorf("Expected nothing pending, got %#v %v", p, err)
+	}
+	if err := s.SetPending(ctx, "a", &Pending{Question: "q", Rounds: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetPending(ctx, "a", &Pending{Question: "q", Answers: []string{"x"}, Rounds: 2}); err != nil {
+		t.Fatal(err)
+	}
+	p, err := s.Pending(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p == nil || p.Question != "q" || p.Rounds != 2 || len(p.Answers) != 1 || p.Answers[0] != "x" {
+		t.Errorf("Expected updated pending question, got %#v", p)
+	}
+	s.SetPending(ctx, "a", nil)
+	if p, _ := s.Pending(ctx, "a"); p != nil {
+		t.Errorf("Expected pending question to be cleared, got %#v", p)
+	}
+}
+
+func TestNewStore(t *testing.T) {
+	ctx := context.Background()
+	s, err := NewStore(ctx, &env.Environment{DatabaseBackend: db.MemoryBackend}, db.NoopEmbeddingsDB{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.(*MemoryStore); !ok {
+		t.Errorf("Expected a memory store, got %T", s)
+	}
+	// Postgres and SQLite sessions share the embeddings database's
+	// connection rather than opening their own.
+	if _, err := NewStore(ctx, &env.Environment{DatabaseBackend: db.PostgresBackend}, db.NoopEmbeddingsDB{}); err == nil {
+		t.Error("Expected an error without a postgres embeddings database")
+	}
+	if _, err := NewStore(ctx, &env.Environment{DatabaseBackend: db.SQLiteBackend}, db.NoopEmbeddingsDB{}); err == nil {
+		t.Error("Expected an error without a sqlite embeddings database")
+	}
+	edb, err := db.NewSQLiteDatabase(ctx, ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer edb.Close()
+	if s, err := NewStore(ctx, &env.Environment{DatabaseBackend: db.SQLiteBackend}, edb); err != nil {
+		t.Error(err)
+	} else if _, ok := s.(*SQLiteStore); !ok {
+		t.Errorf("Expected a sqlite store, got %T", s)
+	}
+}
+
+// Runs against the database in PG_TEST_DSN like the embeddings conformance
+// tests.
+func TestPostgresStore(t *testing.T) {
+	dsn := os.Getenv("PG_TEST_DSN")
+	if dsn == "" {
+		t.Skip("PG_TEST_DSN not set")
+	}
+	ctx := context.Background()
+	pool, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	all, err := migrations.Postgres()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrations.NewMigrator(migrations.NewPostgresDriver(pool), all).Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.Exec(ctx, `DELETE FROM session_turns WHERE session_id LIKE 'test:%';`); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewPostgresStore(pool)
+	s.MaxTurns = 2
+	s.Append(ctx, "test:b", Turn{Role: llm.RoleModel, Text: "other"})
+	if err := s.Append(ctx, "test:a", Turn{Role: llm.RoleUser, Text: "one"}, Turn{Role: llm.RoleModel, Text: "two"}, Turn{Role: llm.RoleUser, Text: "three"}); err != nil {
+		t.Fatal(err)
+	}
+	turns, err := s.History(ctx, "test:a", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(turns) != 2 || turns[0].Text != "two" || turns[1].Text != "three" {
+		t.Errorf("Expected session to be capped at the last 2 turns, got %#v", turns)
+	}
+	if other, _ := s.History(ctx, "test:b", 0); len(other) != 1 {
+		t.Errorf("Expected other sessions to be kept, got %#v", other)
+	}
+}
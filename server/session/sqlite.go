@@ -0,0 +1,144 @@
+package session
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/rcleveng/assistant/server/llm"
+)
+
+// Session store in the same SQLite file as the embeddings.
+type SQLiteStore struct {
+	db *sql.DB
+	// Maximum number of turns kept per session, 0 keeps everything.
+	MaxTurns int
+}
+
+// Creates a store using an existing handle, such as the embeddings
+// database's, the caller keeps ownership of the handle.
+func NewSQLiteStore(sqldb *sql.DB) *SQLiteStore {
+	return &SQLiteStore{db: sqldb, MaxTurns: DefaultMaxTurns}
+}
+
+func (s *SQLiteStore) Append(ctx context.Context, sessionId string, turns ...Turn) error {
+	sql := `
+INSERT INTO session_turns(
+	session_id, role, text, created
+) VALUES(
+	?, ?, ?, ?
+);`
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	now := time.Now().UnixMilli()
+	for _, t := range turns {
+		if _, err := tx.ExecContext(ctx, sql, sessionId, string(t.Role), t.Text, now); err != nil {
+			return err
+		}
+	}
+	if s.MaxTurns > 0 {
+		trim := `
+DELETE FROM session_turns
+WHERE session_id = ? AND id NOT IN (
+	SELECT id FROM session_turns
+	WHERE session_id = ?
+	ORDER BY id DESC
+	LIMIT ?
+);`
+		if _, err := tx.ExecContext(ctx, trim, sessionId, sessionId, s.MaxTurns); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) History(ctx context.Context, sessionId string, limit int) ([]Turn, error) {
+	// Take the newest turns then put them back in order, LIMIT -1 returns
+	// every row.
+	sql := `SELECT role, text, created FROM (
+		SELECT id, role, text, created
+		FROM session_turns
+		WHERE session_id = ?
+		ORDER BY id DESC
+		LIMIT ?
+	) ORDER BY id;
+`
+	if limit <= 0 {
+		limit = -1
+	}
+	rows, err := s.db.QueryContext(ctx, sql, sessionId, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	turns := make([]Turn, 0)
+	for rows.Next() {
+		var t Turn
+		var role string
+		var created int64
+		if err := rows.Scan(&role, &t.Text, &created); err != nil {
+			return nil, err
+		}
+		t.Role = llm.Role(role)
+		t.Created = time.UnixMilli(created)
+		turns = append(turns, t)
+	}
+	return turns, rows.Err()
+}
+
+func (s *SQLiteStore) Pending(ctx context.Context, sessionId string) (*Pending, error) {
+	query := `SELECT question, answers, rounds
+	FROM session_pending
+	WHERE session_id = ?;
+`
+	p := &Pending{}
+	var answers string
+	err := s.db.QueryRowContext(ctx, query, sessionId).Scan(&p.Question, &answers, &p.Rounds)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(answers), &p.Answers); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (s *SQLiteStore) SetPending(ctx context.Context, sessionId string, pending *Pending) error {
+	if pending == nil {
+		_, err := s.db.ExecContext(ctx, `DELETE FROM session_pending WHERE session_id = ?;`, sessionId)
+		return err
+	}
+
+	sql := `
+INSERT INTO session_pending(
+	session_id, question, answers, rounds, updated
+) VALUES(
+	?, ?, ?, ?, ?
+) ON CONFLICT (session_id) DO UPDATE SET
+	question = excluded.question,
+	answers = excluded.answers,
+	rounds = excluded.rounds,
+	updated = excluded.updated;`
+	answers := pending.Answers
+	if answers == nil {
+		answers = []string{}
+	}
+	encoded, err := json.Marshal(answers)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, sql, sessionId, pending.Question, string(encoded), pending.Rounds, time.Now().UnixMilli())
+	return err
+}
+
+// The handle belongs to whoever created the store.
+func (s *SQLiteStore) Close() {
+}